@@ -1,10 +1,14 @@
 package spacemap
 
 import (
+	"encoding"
+	"github.com/arran4/spacemap/quadtree"
+	"github.com/arran4/spacemap/rtree"
 	"github.com/arran4/spacemap/shared"
 	"github.com/arran4/spacemap/simplearray"
 	"github.com/arran4/spacemap/space2trees"
 	"github.com/arran4/spacemap/spacepartition"
+	"github.com/arran4/spacemap/spatialhash"
 	"image"
 	"testing"
 )
@@ -40,6 +44,51 @@ var (
 	_ Interface = (*space2trees.Struct)(nil)
 	_ Interface = (*spacepartition.Struct)(nil)
 	_ Interface = (*simplearray.Struct)(nil)
+	_ Interface = (*quadtree.Struct)(nil)
+	_ Interface = (*rtree.Struct)(nil)
+	_ Interface = (*spatialhash.Struct)(nil)
+
+	_ RegionQuerier = (*space2trees.Struct)(nil)
+	_ RegionQuerier = (*spacepartition.Struct)(nil)
+	_ RegionQuerier = (*simplearray.Struct)(nil)
+	_ RegionQuerier = (*quadtree.Struct)(nil)
+	_ RegionQuerier = (*rtree.Struct)(nil)
+	_ RegionQuerier = (*spatialhash.Struct)(nil)
+
+	_ Updater = (*space2trees.Struct)(nil)
+	_ Updater = (*spacepartition.Struct)(nil)
+	_ Updater = (*simplearray.Struct)(nil)
+	_ Updater = (*quadtree.Struct)(nil)
+	_ Updater = (*rtree.Struct)(nil)
+	_ Updater = (*spatialhash.Struct)(nil)
+
+	_ ZOrderer = (*space2trees.Struct)(nil)
+	_ ZOrderer = (*spacepartition.Struct)(nil)
+	_ ZOrderer = (*simplearray.Struct)(nil)
+	_ ZOrderer = (*quadtree.Struct)(nil)
+	_ ZOrderer = (*rtree.Struct)(nil)
+	_ ZOrderer = (*spatialhash.Struct)(nil)
+
+	_ StackVisitor = (*space2trees.Struct)(nil)
+	_ StackVisitor = (*spacepartition.Struct)(nil)
+	_ StackVisitor = (*simplearray.Struct)(nil)
+	_ StackVisitor = (*quadtree.Struct)(nil)
+	_ StackVisitor = (*rtree.Struct)(nil)
+	_ StackVisitor = (*spatialhash.Struct)(nil)
+
+	_ ZQuerier = (*space2trees.Struct)(nil)
+	_ ZQuerier = (*spacepartition.Struct)(nil)
+	_ ZQuerier = (*simplearray.Struct)(nil)
+	_ ZQuerier = (*quadtree.Struct)(nil)
+	_ ZQuerier = (*rtree.Struct)(nil)
+	_ ZQuerier = (*spatialhash.Struct)(nil)
+
+	_ Clearer = (*space2trees.Struct)(nil)
+	_ Clearer = (*spacepartition.Struct)(nil)
+	_ Clearer = (*simplearray.Struct)(nil)
+	_ Clearer = (*quadtree.Struct)(nil)
+	_ Clearer = (*rtree.Struct)(nil)
+	_ Clearer = (*spatialhash.Struct)(nil)
 )
 
 func BenchmarkSpacePartitionAdd(b *testing.B) {
@@ -133,3 +182,314 @@ func BenchmarkSimpleArraySearch(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkSpacePartitionSearchIn(b *testing.B) {
+	sm := spacepartition.New()
+	sm.AddAll(benchShapes...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.GetStackIn(image.Rect(l.X, l.Y, l.X+16, l.Y+16), shared.Intersects)
+		}
+	}
+}
+
+func BenchmarkSpaceBTreeSearchIn(b *testing.B) {
+	sm := space2trees.New()
+	sm.AddAll(benchShapes...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.GetStackIn(image.Rect(l.X, l.Y, l.X+16, l.Y+16), shared.Intersects)
+		}
+	}
+}
+
+func BenchmarkSimpleArraySearchIn(b *testing.B) {
+	sm := simplearray.New()
+	sm.AddAll(benchShapes...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.GetStackIn(image.Rect(l.X, l.Y, l.X+16, l.Y+16), shared.Intersects)
+		}
+	}
+}
+
+func BenchmarkQuadTreeAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := quadtree.New()
+		sm.AddAll(benchShapes...)
+	}
+}
+
+func BenchmarkQuadTreeAddSearch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := quadtree.New()
+		sm.AddAll(benchShapes...)
+		for _, l := range spaceLookups {
+			sm.GetStackAt(l.X, l.Y)
+		}
+	}
+}
+
+func BenchmarkQuadTreeAddDelete(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := quadtree.New()
+		sm.AddAll(benchShapes...)
+		for _, l := range benchShapes {
+			sm.Remove(l)
+		}
+	}
+}
+
+func BenchmarkQuadTreeSearchIn(b *testing.B) {
+	sm := quadtree.New()
+	sm.AddAll(benchShapes...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.GetStackIn(image.Rect(l.X, l.Y, l.X+16, l.Y+16), shared.Intersects)
+		}
+	}
+}
+
+func BenchmarkRTreeAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := rtree.New()
+		sm.AddAll(benchShapes...)
+	}
+}
+
+func BenchmarkRTreeAddSearch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := rtree.New()
+		sm.AddAll(benchShapes...)
+		for _, l := range spaceLookups {
+			sm.GetStackAt(l.X, l.Y)
+		}
+	}
+}
+
+func BenchmarkRTreeAddDelete(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := rtree.New()
+		sm.AddAll(benchShapes...)
+		for _, l := range benchShapes {
+			sm.Remove(l)
+		}
+	}
+}
+
+func BenchmarkRTreeSearchIn(b *testing.B) {
+	sm := rtree.New()
+	sm.AddAll(benchShapes...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.GetStackIn(image.Rect(l.X, l.Y, l.X+16, l.Y+16), shared.Intersects)
+		}
+	}
+}
+
+func BenchmarkRTreeInsert(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := rtree.New()
+		for _, s := range benchShapes {
+			sm.Add(s, 0)
+		}
+	}
+}
+
+func BenchmarkSpatialHashAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := spatialhash.New(spatialhash.CellSize(16))
+		sm.AddAll(benchShapes...)
+	}
+}
+
+func BenchmarkSpatialHashAddSearch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := spatialhash.New(spatialhash.CellSize(16))
+		sm.AddAll(benchShapes...)
+		for _, l := range spaceLookups {
+			sm.GetStackAt(l.X, l.Y)
+		}
+	}
+}
+
+func BenchmarkSpatialHashAddDelete(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sm := spatialhash.New(spatialhash.CellSize(16))
+		sm.AddAll(benchShapes...)
+		for _, l := range benchShapes {
+			sm.Remove(l)
+		}
+	}
+}
+
+func BenchmarkSpatialHashSearchIn(b *testing.B) {
+	sm := spatialhash.New(spatialhash.CellSize(16))
+	sm.AddAll(benchShapes...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.GetStackIn(image.Rect(l.X, l.Y, l.X+16, l.Y+16), shared.Intersects)
+		}
+	}
+}
+
+// withBenchShapes adds benchShapes to sm.
+func withBenchShapes(sm Interface) StackVisitor {
+	for _, shape := range benchShapes {
+		sm.Add(shape, 0)
+	}
+	return sm.(StackVisitor)
+}
+
+// TestStackVisitorAllocs checks VisitStackAt, AppendStackAt into a large enough buffer and GetAt don't allocate.
+func TestStackVisitorAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector drops pooled buffers")
+	}
+	for name, sm := range map[string]Interface{
+		"SpacePartition": spacepartition.New(),
+		"SpaceBTree":     space2trees.New(),
+		"SimpleArray":    simplearray.New(),
+		"QuadTree":       quadtree.New(),
+		"RTree":          rtree.New(),
+		"SpatialHash":    spatialhash.New(),
+	} {
+		v := withBenchShapes(sm)
+		buf := make([]shared.Shape, 0, len(benchShapes))
+		count := 0
+		// The callback is made once as calling a method through an interface moves its closure to the heap.
+		visit := func(shape shared.Shape, zIndex int) bool {
+			count++
+			return true
+		}
+		allocs := testing.AllocsPerRun(2, func() {
+			for _, l := range spaceLookups {
+				v.VisitStackAt(l.X, l.Y, visit)
+				buf = v.AppendStackAt(buf[:0], l.X, l.Y)
+				sm.GetAt(l.X, l.Y)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per run want 0", name, allocs)
+		}
+		if count == 0 {
+			t.Errorf("%s: visited no shapes", name)
+		}
+	}
+}
+
+// benchmarkVisitStackAt visits the stacks once before timing so the pooled buffers have grown.
+func benchmarkVisitStackAt(b *testing.B, sm StackVisitor) {
+	visit := func(shape shared.Shape, zIndex int) bool {
+		return true
+	}
+	for _, l := range spaceLookups {
+		sm.VisitStackAt(l.X, l.Y, visit)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			sm.VisitStackAt(l.X, l.Y, visit)
+		}
+	}
+}
+
+// benchmarkAppendStackAt reuses one buffer, which is grown before timing.
+func benchmarkAppendStackAt(b *testing.B, sm StackVisitor) {
+	var buf []shared.Shape
+	for _, l := range spaceLookups {
+		buf = sm.AppendStackAt(buf[:0], l.X, l.Y)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range spaceLookups {
+			buf = sm.AppendStackAt(buf[:0], l.X, l.Y)
+		}
+	}
+}
+
+func BenchmarkSpacePartitionVisitStackAt(b *testing.B) {
+	benchmarkVisitStackAt(b, withBenchShapes(spacepartition.New()))
+}
+
+func BenchmarkSpacePartitionAppendStackAt(b *testing.B) {
+	benchmarkAppendStackAt(b, withBenchShapes(spacepartition.New()))
+}
+
+func BenchmarkSpaceBTreeVisitStackAt(b *testing.B) {
+	benchmarkVisitStackAt(b, withBenchShapes(space2trees.New()))
+}
+
+func BenchmarkSpaceBTreeAppendStackAt(b *testing.B) {
+	benchmarkAppendStackAt(b, withBenchShapes(space2trees.New()))
+}
+
+func BenchmarkSimpleArrayVisitStackAt(b *testing.B) {
+	benchmarkVisitStackAt(b, withBenchShapes(simplearray.New()))
+}
+
+func BenchmarkSimpleArrayAppendStackAt(b *testing.B) {
+	benchmarkAppendStackAt(b, withBenchShapes(simplearray.New()))
+}
+
+func BenchmarkQuadTreeVisitStackAt(b *testing.B) {
+	benchmarkVisitStackAt(b, withBenchShapes(quadtree.New()))
+}
+
+func BenchmarkQuadTreeAppendStackAt(b *testing.B) {
+	benchmarkAppendStackAt(b, withBenchShapes(quadtree.New()))
+}
+
+func BenchmarkRTreeVisitStackAt(b *testing.B) {
+	benchmarkVisitStackAt(b, withBenchShapes(rtree.New()))
+}
+
+func BenchmarkRTreeAppendStackAt(b *testing.B) {
+	benchmarkAppendStackAt(b, withBenchShapes(rtree.New()))
+}
+
+func BenchmarkSpatialHashVisitStackAt(b *testing.B) {
+	benchmarkVisitStackAt(b, withBenchShapes(spatialhash.New()))
+}
+
+func BenchmarkSpatialHashAppendStackAt(b *testing.B) {
+	benchmarkAppendStackAt(b, withBenchShapes(spatialhash.New()))
+}
+
+// benchmarkUnmarshalBinary loads an index of the bench shapes, to compare with adding them.
+func benchmarkUnmarshalBinary(b *testing.B, sm interface {
+	Interface
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}) {
+	for _, shape := range benchShapes {
+		sm.Add(shape, 0)
+	}
+	data, err := sm.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sm.UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSpacePartitionUnmarshalBinary(b *testing.B) {
+	benchmarkUnmarshalBinary(b, spacepartition.New())
+}
+
+func BenchmarkSpaceBTreeUnmarshalBinary(b *testing.B) {
+	benchmarkUnmarshalBinary(b, space2trees.New())
+}
@@ -0,0 +1,301 @@
+// Package concurrent makes maps safe for use by multiple goroutines.
+//
+// Map guards any spacemap.Interface with a sync.RWMutex, so queries run in parallel and each change waits for them to
+// finish. Snapshots instead publishes an immutable copy of the map after every change, so queries never wait, even
+// while a slow Add is being made.
+package concurrent
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"image"
+	"sync"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+)
+
+// Map is a spacemap.Interface which is safe for concurrent use. The optional interfaces are passed on to the wrapped
+// map, their methods do nothing when it doesn't implement them.
+type Map struct {
+	mu sync.RWMutex
+	m  spacemap.Interface
+}
+
+var (
+	_ spacemap.Interface      = (*Map)(nil)
+	_ spacemap.RegionQuerier  = (*Map)(nil)
+	_ spacemap.Updater        = (*Map)(nil)
+	_ spacemap.ZOrderer       = (*Map)(nil)
+	_ spacemap.NearestQuerier = (*Map)(nil)
+	_ spacemap.Caster         = (*Map)(nil)
+	_ spacemap.StackVisitor   = (*Map)(nil)
+	_ spacemap.ZQuerier       = (*Map)(nil)
+	_ spacemap.Clearer        = (*Map)(nil)
+)
+
+// New wraps m, which must not be used directly afterwards.
+func New(m spacemap.Interface) *Map {
+	return &Map{
+		m: m,
+	}
+}
+
+// Read calls f with the wrapped map while holding the read lock, so several queries see the same shapes. f must not
+// change the map.
+func (c *Map) Read(f func(m spacemap.Interface)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f(c.m)
+}
+
+// Write calls f with the wrapped map while holding the write lock, so several changes are seen together.
+func (c *Map) Write(f func(m spacemap.Interface)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(c.m)
+}
+
+func (c *Map) Add(shape shared.Shape, zIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m.Add(shape, zIndex)
+}
+
+func (c *Map) Remove(shape shared.Shape) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m.Remove(shape)
+}
+
+func (c *Map) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cl, ok := c.m.(spacemap.Clearer); ok {
+		cl.Clear()
+	}
+}
+
+// MarshalJSON fails when the wrapped map isn't a json.Marshaler.
+func (c *Map) MarshalJSON() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if jm, ok := c.m.(json.Marshaler); ok {
+		return jm.MarshalJSON()
+	}
+	return nil, errors.New("concurrent: wrapped map is not a json.Marshaler")
+}
+
+// UnmarshalJSON fails when the wrapped map isn't a json.Unmarshaler.
+func (c *Map) UnmarshalJSON(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ju, ok := c.m.(json.Unmarshaler); ok {
+		return ju.UnmarshalJSON(data)
+	}
+	return errors.New("concurrent: wrapped map is not a json.Unmarshaler")
+}
+
+// MarshalBinary fails when the wrapped map isn't an encoding.BinaryMarshaler.
+func (c *Map) MarshalBinary() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if bm, ok := c.m.(encoding.BinaryMarshaler); ok {
+		return bm.MarshalBinary()
+	}
+	return nil, errors.New("concurrent: wrapped map is not an encoding.BinaryMarshaler")
+}
+
+// UnmarshalBinary fails when the wrapped map isn't an encoding.BinaryUnmarshaler.
+func (c *Map) UnmarshalBinary(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bu, ok := c.m.(encoding.BinaryUnmarshaler); ok {
+		return bu.UnmarshalBinary(data)
+	}
+	return errors.New("concurrent: wrapped map is not an encoding.BinaryUnmarshaler")
+}
+
+func (c *Map) GetStackAt(x int, y int) []shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.GetStackAt(x, y)
+}
+
+func (c *Map) GetAt(x int, y int) shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.GetAt(x, y)
+}
+
+func (c *Map) GetBottomAt(x int, y int) shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.GetBottomAt(x, y)
+}
+
+// VisitStackAt holds the read lock while f is called, so f must not change the map.
+func (c *Map) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if v, ok := c.m.(spacemap.StackVisitor); ok {
+		v.VisitStackAt(x, y, f)
+	}
+}
+
+func (c *Map) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if v, ok := c.m.(spacemap.StackVisitor); ok {
+		return v.AppendStackAt(dst, x, y)
+	}
+	return dst
+}
+
+func (c *Map) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.Len()
+}
+
+func (c *Map) Contains(shape shared.Shape) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.Contains(shape)
+}
+
+func (c *Map) All() []shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.All()
+}
+
+func (c *Map) Bounds() image.Rectangle {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.Bounds()
+}
+
+func (c *Map) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if rq, ok := c.m.(spacemap.RegionQuerier); ok {
+		return rq.GetStackIn(r, mode)
+	}
+	return []shared.Shape{}
+}
+
+func (c *Map) GetZStackAt(x, y int) []shared.ZShape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if z, ok := c.m.(spacemap.ZQuerier); ok {
+		return z.GetZStackAt(x, y)
+	}
+	return []shared.ZShape{}
+}
+
+func (c *Map) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if z, ok := c.m.(spacemap.ZQuerier); ok {
+		return z.GetZStackIn(r, mode)
+	}
+	return []shared.ZShape{}
+}
+
+func (c *Map) Nearest(x, y int) shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if n, ok := c.m.(spacemap.NearestQuerier); ok {
+		return n.Nearest(x, y)
+	}
+	return nil
+}
+
+func (c *Map) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if n, ok := c.m.(spacemap.NearestQuerier); ok {
+		return n.KNearest(x, y, k, maxDistance)
+	}
+	return []shared.Shape{}
+}
+
+func (c *Map) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if cs, ok := c.m.(spacemap.Caster); ok {
+		return cs.SegmentCast(x0, y0, x1, y1)
+	}
+	return []shared.Hit{}
+}
+
+func (c *Map) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if cs, ok := c.m.(spacemap.Caster); ok {
+		return cs.RayCast(x, y, dx, dy, maxDistance)
+	}
+	return []shared.Hit{}
+}
+
+// Update re-indexes shape. Queries may use the shape while it is being changed, so change it within Write instead
+// when its PointIn or Bounds aren't safe to call concurrently.
+func (c *Map) Update(shape shared.Shape, oldBounds image.Rectangle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u, ok := c.m.(spacemap.Updater); ok {
+		u.Update(shape, oldBounds)
+	}
+}
+
+// Move changes the bounds of shape while holding the write lock.
+func (c *Map) Move(shape shared.Resizable, bounds image.Rectangle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u, ok := c.m.(spacemap.Updater); ok {
+		u.Move(shape, bounds)
+	}
+}
+
+func (c *Map) ZIndexOf(shape shared.Shape) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if z, ok := c.m.(spacemap.ZOrderer); ok {
+		return z.ZIndexOf(shape)
+	}
+	return 0, false
+}
+
+func (c *Map) SetZIndex(shape shared.Shape, zIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.m.(spacemap.ZOrderer); ok {
+		z.SetZIndex(shape, zIndex)
+	}
+}
+
+func (c *Map) BringToFront(shape shared.Shape) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.m.(spacemap.ZOrderer); ok {
+		z.BringToFront(shape)
+	}
+}
+
+func (c *Map) SendToBack(shape shared.Shape) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.m.(spacemap.ZOrderer); ok {
+		z.SendToBack(shape)
+	}
+}
+
+func (c *Map) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.m.(spacemap.ZOrderer); ok {
+		z.PlaceAbove(shape, other)
+	}
+}
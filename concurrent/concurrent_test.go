@@ -0,0 +1,107 @@
+package concurrent
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/simplearray"
+	"github.com/arran4/spacemap/spacemaptest"
+	"github.com/arran4/spacemap/spacepartition"
+)
+
+func TestConformance(t *testing.T) {
+	t.Run("Map", func(t *testing.T) {
+		spacemaptest.Run(t, func() spacemap.Interface { return New(spacepartition.New()) })
+	})
+	t.Run("Snapshots", func(t *testing.T) {
+		spacemaptest.Run(t, func() spacemap.Interface {
+			return NewSnapshots(spacepartition.New(), (*spacepartition.Struct).Clone)
+		})
+	})
+}
+
+// TestConcurrentUse is meant to be run with -race, one goroutine adds and removes shapes while others query them.
+func TestConcurrentUse(t *testing.T) {
+	maps := map[string]spacemap.Interface{
+		"Map":       New(spacepartition.New()),
+		"Snapshots": NewSnapshots(spacepartition.New(), (*spacepartition.Struct).Clone),
+	}
+	for name, m := range maps {
+		m := m
+		t.Run(name, func(t *testing.T) {
+			background := shared.NewRectangle(0, 0, 100, 100, shared.Name("background"))
+			m.Add(background, -1)
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if m.GetBottomAt(50, 50) != background {
+							t.Errorf("GetBottomAt(50, 50) lost the background")
+							return
+						}
+					}
+				}()
+			}
+			var want []shared.Shape
+			for i := 0; i < 50; i++ {
+				r := shared.NewRectangle(i, i, i+10, i+10, shared.Name(strconv.Itoa(i)))
+				m.Add(r, i)
+				if i%2 == 0 {
+					m.Remove(r)
+				} else if i > 38 && i <= 48 {
+					want = append([]shared.Shape{r}, want...)
+				}
+			}
+			close(done)
+			wg.Wait()
+			spacemaptest.CheckStack(t, m, 48, 48, append(want, background)...)
+		})
+	}
+}
+
+func TestSnapshots_Snapshot(t *testing.T) {
+	s := NewSnapshots(simplearray.New(), (*simplearray.Struct).Clone)
+	rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+	rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+	s.Add(rect1, 0)
+	before := s.Snapshot()
+	s.Write(func(pending spacemap.Interface) {
+		pending.Add(rect2, 0)
+		spacemaptest.CheckStack(t, s, 50, 50, rect1)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spacemaptest.CheckStack(t, s, 50, 50, rect1)
+		}()
+		wg.Wait()
+		pending.(spacemap.ZOrderer).SendToBack(rect2)
+	})
+	spacemaptest.CheckStack(t, before, 50, 50, rect1)
+	spacemaptest.CheckStack(t, s, 50, 50, rect1, rect2)
+	s.BringToFront(rect2)
+	spacemaptest.CheckStack(t, s, 50, 50, rect2, rect1)
+	spacemaptest.CheckStack(t, before, 50, 50, rect1)
+}
+
+func TestMap_Read(t *testing.T) {
+	m := New(simplearray.New())
+	rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+	m.Write(func(sm spacemap.Interface) {
+		sm.Add(rect1, 0)
+	})
+	m.Read(func(sm spacemap.Interface) {
+		spacemaptest.CheckStack(t, sm, 50, 50, rect1)
+	})
+}
@@ -0,0 +1,252 @@
+package concurrent
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"sync"
+	"sync/atomic"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+)
+
+// Snapshots is a spacemap.Interface which is safe for concurrent use and whose queries never wait. Queries are made on
+// the latest published snapshot, which never changes. Every change is made to a clone of it, which is published once
+// the change is complete, so each change costs a clone and changes are best grouped with Write.
+//
+// Shapes are shared by every snapshot and must not be changed once added, replace them with Remove and Add instead.
+type Snapshots struct {
+	// mu is only held by writers, so that each change is made to the snapshot published by the one before.
+	mu      sync.Mutex
+	clone   func(m spacemap.Interface) spacemap.Interface
+	current atomic.Value
+}
+
+// snapshot wraps the published map as atomic.Value must always be given the same type.
+type snapshot struct {
+	m spacemap.Interface
+}
+
+var (
+	_ spacemap.Interface      = (*Snapshots)(nil)
+	_ spacemap.RegionQuerier  = (*Snapshots)(nil)
+	_ spacemap.ZOrderer       = (*Snapshots)(nil)
+	_ spacemap.NearestQuerier = (*Snapshots)(nil)
+	_ spacemap.Caster         = (*Snapshots)(nil)
+	_ spacemap.StackVisitor   = (*Snapshots)(nil)
+	_ spacemap.ZQuerier       = (*Snapshots)(nil)
+	_ spacemap.Clearer        = (*Snapshots)(nil)
+)
+
+// NewSnapshots returns a Snapshots which publishes m as its first snapshot, m must not be changed afterwards. clone is
+// called to copy the latest snapshot for each change, such as (*spacepartition.Struct).Clone, so maps which are
+// cheap to clone make for cheap changes.
+func NewSnapshots[M spacemap.Interface](m M, clone func(M) M) *Snapshots {
+	s := &Snapshots{
+		clone: func(m spacemap.Interface) spacemap.Interface {
+			return clone(m.(M))
+		},
+	}
+	s.current.Store(snapshot{m: m})
+	return s
+}
+
+// Snapshot returns the latest map. It is never changed, so any number of queries can be made on it and they will all
+// see the same shapes.
+func (s *Snapshots) Snapshot() spacemap.Interface {
+	return s.current.Load().(snapshot).m
+}
+
+// Write calls f to make several changes to a clone of the latest snapshot, then publishes it as a single snapshot.
+// Queries made while f runs, including those made by f, see the snapshot from before the changes. f must not keep
+// pending or change the shapes themselves.
+func (s *Snapshots) Write(f func(pending spacemap.Interface)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.clone(s.Snapshot())
+	f(pending)
+	s.current.Store(snapshot{m: pending})
+}
+
+func (s *Snapshots) Add(shape shared.Shape, zIndex int) {
+	s.Write(func(pending spacemap.Interface) {
+		pending.Add(shape, zIndex)
+	})
+}
+
+func (s *Snapshots) Remove(shape shared.Shape) {
+	s.Write(func(pending spacemap.Interface) {
+		pending.Remove(shape)
+	})
+}
+
+// Clear publishes an empty snapshot, it does nothing when the snapshots aren't a spacemap.Clearer.
+func (s *Snapshots) Clear() {
+	s.Write(func(pending spacemap.Interface) {
+		if c, ok := pending.(spacemap.Clearer); ok {
+			c.Clear()
+		}
+	})
+}
+
+// MarshalJSON encodes the latest snapshot, it fails when the snapshots aren't a json.Marshaler.
+func (s *Snapshots) MarshalJSON() ([]byte, error) {
+	if jm, ok := s.Snapshot().(json.Marshaler); ok {
+		return jm.MarshalJSON()
+	}
+	return nil, errors.New("concurrent: snapshot is not a json.Marshaler")
+}
+
+// UnmarshalJSON replaces every shape with those encoded by MarshalJSON and publishes them as one snapshot, it fails
+// when the snapshots aren't a json.Unmarshaler.
+func (s *Snapshots) UnmarshalJSON(data []byte) (err error) {
+	s.Write(func(pending spacemap.Interface) {
+		ju, ok := pending.(json.Unmarshaler)
+		if !ok {
+			err = errors.New("concurrent: snapshot is not a json.Unmarshaler")
+			return
+		}
+		err = ju.UnmarshalJSON(data)
+	})
+	return err
+}
+
+func (s *Snapshots) GetStackAt(x int, y int) []shared.Shape {
+	return s.Snapshot().GetStackAt(x, y)
+}
+
+func (s *Snapshots) GetAt(x int, y int) shared.Shape {
+	return s.Snapshot().GetAt(x, y)
+}
+
+func (s *Snapshots) GetBottomAt(x int, y int) shared.Shape {
+	return s.Snapshot().GetBottomAt(x, y)
+}
+
+func (s *Snapshots) Len() int {
+	return s.Snapshot().Len()
+}
+
+func (s *Snapshots) Contains(shape shared.Shape) bool {
+	return s.Snapshot().Contains(shape)
+}
+
+func (s *Snapshots) All() []shared.Shape {
+	return s.Snapshot().All()
+}
+
+func (s *Snapshots) Bounds() image.Rectangle {
+	return s.Snapshot().Bounds()
+}
+
+// VisitStackAt does nothing when the snapshots aren't a spacemap.StackVisitor.
+func (s *Snapshots) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	if v, ok := s.Snapshot().(spacemap.StackVisitor); ok {
+		v.VisitStackAt(x, y, f)
+	}
+}
+
+// AppendStackAt returns dst unchanged when the snapshots aren't a spacemap.StackVisitor.
+func (s *Snapshots) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	if v, ok := s.Snapshot().(spacemap.StackVisitor); ok {
+		return v.AppendStackAt(dst, x, y)
+	}
+	return dst
+}
+
+// GetStackIn returns an empty stack when the snapshots aren't a spacemap.RegionQuerier.
+func (s *Snapshots) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	if rq, ok := s.Snapshot().(spacemap.RegionQuerier); ok {
+		return rq.GetStackIn(r, mode)
+	}
+	return []shared.Shape{}
+}
+
+// GetZStackAt returns an empty stack when the snapshots aren't a spacemap.ZQuerier.
+func (s *Snapshots) GetZStackAt(x, y int) []shared.ZShape {
+	if z, ok := s.Snapshot().(spacemap.ZQuerier); ok {
+		return z.GetZStackAt(x, y)
+	}
+	return []shared.ZShape{}
+}
+
+// GetZStackIn returns an empty stack when the snapshots aren't a spacemap.ZQuerier.
+func (s *Snapshots) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	if z, ok := s.Snapshot().(spacemap.ZQuerier); ok {
+		return z.GetZStackIn(r, mode)
+	}
+	return []shared.ZShape{}
+}
+
+// Nearest returns nil when the snapshots aren't a spacemap.NearestQuerier.
+func (s *Snapshots) Nearest(x, y int) shared.Shape {
+	if n, ok := s.Snapshot().(spacemap.NearestQuerier); ok {
+		return n.Nearest(x, y)
+	}
+	return nil
+}
+
+// KNearest returns no shapes when the snapshots aren't a spacemap.NearestQuerier.
+func (s *Snapshots) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	if n, ok := s.Snapshot().(spacemap.NearestQuerier); ok {
+		return n.KNearest(x, y, k, maxDistance)
+	}
+	return []shared.Shape{}
+}
+
+// SegmentCast returns no hits when the snapshots aren't a spacemap.Caster.
+func (s *Snapshots) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	if c, ok := s.Snapshot().(spacemap.Caster); ok {
+		return c.SegmentCast(x0, y0, x1, y1)
+	}
+	return []shared.Hit{}
+}
+
+// RayCast returns no hits when the snapshots aren't a spacemap.Caster.
+func (s *Snapshots) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	if c, ok := s.Snapshot().(spacemap.Caster); ok {
+		return c.RayCast(x, y, dx, dy, maxDistance)
+	}
+	return []shared.Hit{}
+}
+
+// ZIndexOf reports false when the snapshots aren't a spacemap.ZOrderer.
+func (s *Snapshots) ZIndexOf(shape shared.Shape) (int, bool) {
+	if z, ok := s.Snapshot().(spacemap.ZOrderer); ok {
+		return z.ZIndexOf(shape)
+	}
+	return 0, false
+}
+
+func (s *Snapshots) SetZIndex(shape shared.Shape, zIndex int) {
+	s.Write(func(pending spacemap.Interface) {
+		if z, ok := pending.(spacemap.ZOrderer); ok {
+			z.SetZIndex(shape, zIndex)
+		}
+	})
+}
+
+func (s *Snapshots) BringToFront(shape shared.Shape) {
+	s.Write(func(pending spacemap.Interface) {
+		if z, ok := pending.(spacemap.ZOrderer); ok {
+			z.BringToFront(shape)
+		}
+	})
+}
+
+func (s *Snapshots) SendToBack(shape shared.Shape) {
+	s.Write(func(pending spacemap.Interface) {
+		if z, ok := pending.(spacemap.ZOrderer); ok {
+			z.SendToBack(shape)
+		}
+	})
+}
+
+func (s *Snapshots) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	s.Write(func(pending spacemap.Interface) {
+		if z, ok := pending.(spacemap.ZOrderer); ok {
+			z.PlaceAbove(shape, other)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package spacemap
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/arran4/spacemap/quadtree"
+	"github.com/arran4/spacemap/rtree"
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/simplearray"
+	"github.com/arran4/spacemap/space2trees"
+	"github.com/arran4/spacemap/spacepartition"
+	"github.com/arran4/spacemap/spatialhash"
+	"github.com/google/go-cmp/cmp"
+)
+
+// GenerateMixedShapes returns n rectangles, circles, ellipses and polygons scattered within size.
+func GenerateMixedShapes(n, size int, seed int64) (result []shared.Shape) {
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < n; i++ {
+		name := shared.Name(fmt.Sprintf("shape%d", i))
+		x, y := r.Intn(size), r.Intn(size)
+		switch i % 4 {
+		case 0:
+			result = append(result, shared.NewRectangle(x, y, x+r.Intn(size/4)+1, y+r.Intn(size/4)+1, name))
+		case 1:
+			result = append(result, shared.NewCircle(x, y, r.Intn(size/8), name))
+		case 2:
+			result = append(result, shared.NewEllipse(x, y, r.Intn(size/8), r.Intn(size/8), name))
+		case 3:
+			points := make([]image.Point, 3+r.Intn(4))
+			for j := range points {
+				points[j] = image.Pt(x+r.Intn(size/4), y+r.Intn(size/4))
+			}
+			result = append(result, shared.NewPolygon(points, shared.FillRule(r.Intn(2)), name))
+		}
+	}
+	return result
+}
+
+func TestImplementationsAgree(t *testing.T) {
+	shapes := GenerateMixedShapes(60, 100, 1)
+	implementations := map[string]Interface{
+		"simplearray":    simplearray.New(),
+		"spacepartition": spacepartition.New(),
+		"space2trees":    space2trees.New(),
+		"quadtree":       quadtree.New(),
+		"rtree":          rtree.New(),
+		"spatialhash":    spatialhash.New(spatialhash.CellSize(16)),
+	}
+	type entry struct {
+		Shape  shared.Shape
+		ZIndex int
+	}
+	var stack []entry
+	for i, s := range shapes {
+		stack = append(stack, entry{s, i % 5})
+	}
+	for _, sm := range implementations {
+		for _, e := range stack {
+			sm.Add(e.Shape, e.ZIndex)
+		}
+	}
+	for i, s := range shapes {
+		switch {
+		case i%7 == 3:
+			for _, sm := range implementations {
+				sm.Remove(s)
+			}
+		case i%5 == 1:
+			s := s.(shared.Resizable)
+			oldBounds := s.Bounds()
+			s.SetBounds(oldBounds.Add(image.Pt(7-i%3*7, 3)))
+			for _, sm := range implementations {
+				sm.(Updater).Update(s, oldBounds)
+			}
+		}
+	}
+	remaining := stack[:0]
+	for i, e := range stack {
+		if i%7 != 3 {
+			remaining = append(remaining, e)
+		}
+	}
+	// The expected stack is topmost first, the last added first when the z-index is the same.
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].ZIndex < remaining[j].ZIndex
+	})
+	for y := -5; y < 130; y++ {
+		for x := -5; x < 130; x++ {
+			want := []shared.Shape{}
+			wantZ := []shared.ZShape{}
+			for i := len(remaining) - 1; i >= 0; i-- {
+				if remaining[i].Shape.PointIn(x, y) {
+					want = append(want, remaining[i].Shape)
+					wantZ = append(wantZ, shared.ZShape{Shape: remaining[i].Shape, ZIndex: remaining[i].ZIndex})
+				}
+			}
+			for name, sm := range implementations {
+				if diff := cmp.Diff(sm.GetStackAt(x, y), want); diff != "" {
+					t.Fatalf("%s GetStackAt(%d, %d) = \n%s", name, x, y, diff)
+				}
+				if diff := cmp.Diff(sm.(ZQuerier).GetZStackAt(x, y), wantZ); diff != "" {
+					t.Fatalf("%s GetZStackAt(%d, %d) = \n%s", name, x, y, diff)
+				}
+				var top, bottom shared.Shape
+				if len(want) > 0 {
+					top, bottom = want[0], want[len(want)-1]
+				}
+				if got := sm.GetAt(x, y); got != top {
+					t.Fatalf("%s GetAt(%d, %d) = %s want %s", name, x, y, got, top)
+				}
+				if got := sm.GetBottomAt(x, y); got != bottom {
+					t.Fatalf("%s GetBottomAt(%d, %d) = %s want %s", name, x, y, got, bottom)
+				}
+			}
+		}
+	}
+	var topmost []shared.Shape
+	for i := len(remaining) - 1; i >= 0; i-- {
+		topmost = append(topmost, remaining[i].Shape)
+	}
+	for y := -40; y < 170; y += 7 {
+		for x := -40; x < 170; x += 7 {
+			want := []shared.Shape{}
+			for _, n := range shared.ByDistance(topmost, x, y, 25) {
+				if len(want) < 4 {
+					want = append(want, n.Shape)
+				}
+			}
+			for name, sm := range implementations {
+				if diff := cmp.Diff(sm.(NearestQuerier).KNearest(x, y, 4, 25), want); diff != "" {
+					t.Fatalf("%s KNearest(%d, %d) = \n%s", name, x, y, diff)
+				}
+			}
+		}
+	}
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		x0, y0, x1, y1 := r.Intn(200)-50, r.Intn(200)-50, r.Intn(200)-50, r.Intn(200)-50
+		want := shared.Cast(x0, y0, x1, y1, topmost)
+		for name, sm := range implementations {
+			if diff := cmp.Diff(sm.(Caster).SegmentCast(x0, y0, x1, y1), want); diff != "" {
+				t.Fatalf("%s SegmentCast(%d, %d, %d, %d) = \n%s", name, x0, y0, x1, y1, diff)
+			}
+		}
+		dx, dy := r.Float64()-0.5, r.Float64()-0.5
+		want = shared.RayCast(x0, y0, dx, dy, math.Inf(1), image.Rect(-50, -50, 200, 200), func(x0, y0, x1, y1 int) []shared.Hit {
+			return shared.Cast(x0, y0, x1, y1, topmost)
+		})
+		for name, sm := range implementations {
+			if diff := cmp.Diff(sm.(Caster).RayCast(x0, y0, dx, dy, math.Inf(1)), want); diff != "" {
+				t.Fatalf("%s RayCast(%d, %d, %v, %v) = \n%s", name, x0, y0, dx, dy, diff)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package imagemap reads and writes HTML image maps, the areas of a <map> element, as shapes in a spacemap.Map whose
+// values are the links of the areas.
+//
+// A browser uses the first area in the document which contains a point, so areas are stacked in document order with
+// the first on top, and are written back out in the same order.
+package imagemap
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+)
+
+// Area is the value stored with the shape of each <area>.
+type Area struct {
+	Href string
+	Alt  string
+	// Default is set for an area which covers the whole image, it is written back without coordinates.
+	Default bool
+}
+
+// MapName is an option for Read selecting the <map> whose name or id it is, and for Write naming the <map>. Read
+// uses the first <map> without it.
+type MapName string
+
+// ImageBounds is an option for Read giving the bounds of the image, which a default area covers. Without it a default
+// area covers the bounds of the other areas.
+type ImageBounds image.Rectangle
+
+// ErrNoMap is returned by Read when the document has no matching <map>.
+var ErrNoMap = errors.New("imagemap: no matching map element")
+
+// Read adds the areas of a <map> in the HTML document r to m, each with a z-index above those after it and a shape
+// named after its id. Areas which a browser would ignore, with an unknown shape or too few coordinates, are skipped.
+// Only the tags of the document are read, so it doesn't need to be well formed and markup in scripts and comments is
+// ignored.
+func Read(r io.Reader, m *spacemap.Map[Area], ops ...shared.Op) error {
+	var name string
+	var bounds image.Rectangle
+	sized := false
+	for _, op := range ops {
+		switch op := op.(type) {
+		case MapName:
+			name = string(op)
+		case ImageBounds:
+			bounds, sized = image.Rectangle(op), true
+		}
+	}
+	doc, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("imagemap: %w", err)
+	}
+	type area struct {
+		shape shared.Shape
+		value Area
+	}
+	var areas []area
+	inMap, found := false, false
+	scanTags(string(doc), func(t tag) bool {
+		switch {
+		case t.Name == "map" && t.End:
+			found = inMap
+		case t.Name == "map":
+			inMap = name == "" || t.attr("name") == name || t.attr("id") == name
+		case t.Name == "area" && !t.End && inMap:
+			if shape, value, ok := parseArea(t); ok {
+				areas = append(areas, area{shape, value})
+			}
+		}
+		return !found
+	})
+	if !inMap {
+		return ErrNoMap
+	}
+	if !sized {
+		for _, a := range areas {
+			if b := a.shape.Bounds(); !a.value.Default && !b.Empty() {
+				bounds = bounds.Union(b)
+			}
+		}
+	}
+	for i, a := range areas {
+		if a.value.Default {
+			a.shape.(*shared.Rectangle).Rectangle = bounds
+		}
+		m.Add(a.shape, len(areas)-1-i, a.value)
+	}
+	return nil
+}
+
+// parseArea returns the shape and value of an <area>, following the rules browsers use for the shape and coords
+// attributes. The shape of a default area is sized later.
+func parseArea(t tag) (shared.Shape, Area, bool) {
+	value := Area{
+		Href: t.attr("href"),
+		Alt:  t.attr("alt"),
+	}
+	name := shared.Name(t.attr("id"))
+	coords := parseCoords(t.attr("coords"))
+	switch strings.ToLower(strings.TrimSpace(t.attr("shape"))) {
+	case "", "rect", "rectangle":
+		if len(coords) < 4 {
+			return nil, value, false
+		}
+		r := shared.NewRectangle(coords[0], coords[1], coords[2], coords[3], name)
+		r.Rectangle = r.Canon()
+		return r, value, true
+	case "circle", "circ":
+		if len(coords) < 3 || coords[2] <= 0 {
+			return nil, value, false
+		}
+		return shared.NewCircle(coords[0], coords[1], coords[2], name), value, true
+	case "poly", "polygon":
+		if len(coords) < 6 {
+			return nil, value, false
+		}
+		points := make([]image.Point, 0, len(coords)/2)
+		for i := 0; i+1 < len(coords); i += 2 {
+			points = append(points, image.Pt(coords[i], coords[i+1]))
+		}
+		return shared.NewPolygon(points, name), value, true
+	case "default":
+		value.Default = true
+		return shared.NewRectangle(0, 0, 0, 0, name), value, true
+	}
+	return nil, value, false
+}
+
+// parseCoords reads a list of numbers separated by commas, spaces or semicolons, dropping any fractions. Anything which
+// isn't a number counts as 0, as it does in a browser.
+func parseCoords(s string) []int {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+	})
+	coords := make([]int, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			v = 0
+		}
+		coords = append(coords, int(v))
+	}
+	return coords
+}
+
+// Write writes the shapes of m as a <map> with an <area> for each, topmost first. Rectangles, circles, ellipses with
+// equal radii and polygons with a single ring can be written, an error is returned for any other shape.
+func Write(w io.Writer, m *spacemap.Map[Area], ops ...shared.Op) error {
+	var name string
+	for _, op := range ops {
+		switch op := op.(type) {
+		case MapName:
+			name = string(op)
+		}
+	}
+	var b strings.Builder
+	b.WriteString(`<map name="` + html.EscapeString(name) + `">` + "\n")
+	for _, shape := range m.Index.All() {
+		value, _ := m.Value(shape)
+		id, kind, coords, err := areaOf(shape, value)
+		if err != nil {
+			return err
+		}
+		b.WriteString(`  <area shape="` + kind + `"`)
+		if coords != nil {
+			strs := make([]string, len(coords))
+			for i, c := range coords {
+				strs[i] = strconv.Itoa(c)
+			}
+			b.WriteString(` coords="` + strings.Join(strs, ",") + `"`)
+		}
+		for _, a := range [][2]string{{"id", id}, {"href", value.Href}, {"alt", value.Alt}} {
+			if a[1] != "" {
+				b.WriteString(" " + a[0] + `="` + html.EscapeString(a[1]) + `"`)
+			}
+		}
+		b.WriteString(">\n")
+	}
+	b.WriteString("</map>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// areaOf returns the id, shape attribute and coordinates an <area> needs to cover shape.
+func areaOf(shape shared.Shape, value Area) (string, string, []int, error) {
+	switch s := shape.(type) {
+	case *shared.Rectangle:
+		if value.Default {
+			return s.Name, "default", nil, nil
+		}
+		return s.Name, "rect", []int{s.Min.X, s.Min.Y, s.Max.X, s.Max.Y}, nil
+	case *shared.Circle:
+		return s.Name, "circle", []int{s.Center.X, s.Center.Y, s.Radius}, nil
+	case *shared.Ellipse:
+		if s.Radii.X == s.Radii.Y {
+			return s.Name, "circle", []int{s.Center.X, s.Center.Y, s.Radii.X}, nil
+		}
+	case *shared.Polygon:
+		if len(s.Rings) == 1 {
+			coords := make([]int, 0, len(s.Rings[0])*2)
+			for _, p := range s.Rings[0] {
+				coords = append(coords, p.X, p.Y)
+			}
+			return s.Name, "poly", coords, nil
+		}
+	}
+	return "", "", nil, fmt.Errorf("imagemap: %s can't be written as an area", shape)
+}
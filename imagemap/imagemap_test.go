@@ -0,0 +1,175 @@
+package imagemap
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/spacepartition"
+	"github.com/google/go-cmp/cmp"
+)
+
+const document = `<!DOCTYPE html>
+<html>
+<body>
+<img src="other.png" usemap="#other">
+<map name="other"><area shape="rect" coords="0,0,5,5" href="/other"></map>
+<img src="planets.png" usemap="#planets" width="200" height="100">
+<MAP NAME="planets">
+  <area shape="circle" coords="50,50,10" href="/sun" alt="Sun &amp; moon" id="sun">
+  <AREA SHAPE=RECT COORDS="90, 90, 10.7, 30" HREF="/box" ALT="Box">
+  <area shape="poly" coords="100,0 150,0 150,50 170" href="/poly" alt="Poly">
+  <area shape="rect" coords="1,2,3" href="/broken">
+  <area shape="star" coords="1,2,3,4" href="/unknown">
+  <area shape="default" href="/elsewhere" alt="Elsewhere">
+</MAP>
+</body>
+</html>`
+
+func read(t *testing.T, doc string, ops ...shared.Op) *spacemap.Map[Area] {
+	t.Helper()
+	m := spacemap.NewMap[Area](spacepartition.New())
+	if err := Read(strings.NewReader(doc), m, ops...); err != nil {
+		t.Fatalf("Read() error %v", err)
+	}
+	return m
+}
+
+func TestRead(t *testing.T) {
+	m := read(t, document, MapName("planets"))
+	for _, test := range []struct {
+		X, Y int
+		Want []Area
+	}{
+		{X: 50, Y: 50, Want: []Area{{Href: "/sun", Alt: "Sun & moon"}, {Href: "/box", Alt: "Box"}, {Href: "/elsewhere", Alt: "Elsewhere", Default: true}}},
+		{X: 15, Y: 35, Want: []Area{{Href: "/box", Alt: "Box"}, {Href: "/elsewhere", Alt: "Elsewhere", Default: true}}},
+		{X: 140, Y: 5, Want: []Area{{Href: "/poly", Alt: "Poly"}, {Href: "/elsewhere", Alt: "Elsewhere", Default: true}}},
+		{X: 120, Y: 80, Want: []Area{{Href: "/elsewhere", Alt: "Elsewhere", Default: true}}},
+		{X: 160, Y: 50, Want: nil},
+		{X: 5, Y: 5, Want: nil},
+	} {
+		var got []Area
+		for _, e := range m.GetStackAt(test.X, test.Y) {
+			got = append(got, e.Value)
+		}
+		if diff := cmp.Diff(got, test.Want); diff != "" {
+			t.Errorf("GetStackAt(%d, %d) = \n%s", test.X, test.Y, diff)
+		}
+	}
+	if got := m.Index.Len(); got != 4 {
+		t.Errorf("Len() = %d want 4", got)
+	}
+	if got, want := m.Index.Bounds(), image.Rect(10, 0, 150, 90); got != want {
+		t.Errorf("Bounds() = %v want %v", got, want)
+	}
+	if s, _ := m.GetAt(50, 50); s.String() != "sun:Circle((50,50), r:10)" {
+		t.Errorf("GetAt(50, 50) = %s want the circle named sun", s)
+	}
+}
+
+func TestRead_Options(t *testing.T) {
+	m := read(t, document)
+	if _, v := m.GetAt(2, 2); v.Href != "/other" {
+		t.Errorf("first map GetAt(2, 2) = %+v want /other", v)
+	}
+	m = read(t, document, MapName("planets"), ImageBounds(image.Rect(0, 0, 200, 100)))
+	if _, v := m.GetAt(190, 95); v.Href != "/elsewhere" {
+		t.Errorf("GetAt(190, 95) with ImageBounds = %+v want /elsewhere", v)
+	}
+	err := Read(strings.NewReader(document), spacemap.NewMap[Area](spacepartition.New()), MapName("missing"))
+	if !errors.Is(err, ErrNoMap) {
+		t.Errorf("Read() of a missing map = %v want %v", err, ErrNoMap)
+	}
+}
+
+// page is the kind of markup around a map in a real page, which isn't well formed XML.
+const page = `<!doctype html>
+<html lang=en>
+<head>
+<meta charset=utf-8>
+<title>Planets & <map name="planets"> in a title</title>
+<script>
+  if (a < b && c > d) { document.write('<map name="planets"><area coords="0,0,9,9" href="/script"></map>'); }
+</script>
+<style>a:hover > b { color: red }</style>
+</head>
+<body>
+<!-- <map name="planets"><area coords="0,0,9,9" href="/comment"></map> -->
+<p>a < b and b > a<br>
+<p>Unclosed paragraphs &nbsp; and <b><i>misnested</b></i> tags
+<img src=planets.png usemap=#planets width=200 height=100>
+<map name=planets id='planets'>
+  <area shape=circle coords=50,50,10 href=/sun?x=1&y=2 alt='Sun & moon'>
+  <area nohref shape="rect" coords="10,10,40,40" alt="Nothing">
+  <area shape="rect" coords="60,60,90,90" href="/q?a=1&amp;b=&quot;2&quot;" />
+  <textarea><area shape="rect" coords="0,0,99,99" href="/textarea"></textarea>
+</map>
+<area shape="rect" coords="0,0,99,99" href="/after">
+</body>
+</html>`
+
+func TestRead_HTML(t *testing.T) {
+	m := read(t, page)
+	var got []Area
+	for _, shape := range m.Index.All() {
+		v, _ := m.Value(shape)
+		got = append(got, v)
+	}
+	want := []Area{
+		{Href: "/sun?x=1&y=2", Alt: "Sun & moon"},
+		{Alt: "Nothing"},
+		{Href: `/q?a=1&b="2"`},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("areas = \n%s", diff)
+	}
+	for _, doc := range []string{"", "<p>a < b</p>", "<script><map name=x></script>", "<map name=", "<!-- <map>"} {
+		err := Read(strings.NewReader(doc), spacemap.NewMap[Area](spacepartition.New()))
+		if !errors.Is(err, ErrNoMap) {
+			t.Errorf("Read(%q) = %v want %v", doc, err, ErrNoMap)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	m := read(t, document, MapName("planets"))
+	var b bytes.Buffer
+	if err := Write(&b, m, MapName("planets & co")); err != nil {
+		t.Fatalf("Write() error %v", err)
+	}
+	want := `<map name="planets &amp; co">
+  <area shape="circle" coords="50,50,10" id="sun" href="/sun" alt="Sun &amp; moon">
+  <area shape="rect" coords="10,30,90,90" href="/box" alt="Box">
+  <area shape="poly" coords="100,0,150,0,150,50" href="/poly" alt="Poly">
+  <area shape="default" href="/elsewhere" alt="Elsewhere">
+</map>
+`
+	if diff := cmp.Diff(b.String(), want); diff != "" {
+		t.Errorf("Write() = \n%s", diff)
+	}
+	again := read(t, b.String())
+	for y := 0; y < 100; y += 5 {
+		for x := 0; x < 200; x += 5 {
+			if diff := cmp.Diff(again.GetStackAt(x, y), m.GetStackAt(x, y)); diff != "" {
+				t.Fatalf("GetStackAt(%d, %d) after writing and reading = \n%s", x, y, diff)
+			}
+		}
+	}
+}
+
+func TestWrite_Unsupported(t *testing.T) {
+	for _, shape := range []shared.Shape{
+		shared.NewEllipse(5, 5, 3, 4),
+		shared.NewPolygon([]image.Point{{0, 0}, {9, 0}, {0, 9}}, shared.Ring{{1, 1}, {2, 1}, {1, 2}}),
+	} {
+		m := spacemap.NewMap[Area](spacepartition.New())
+		m.Add(shape, 0, Area{})
+		if err := Write(&bytes.Buffer{}, m); err == nil {
+			t.Errorf("Write() of %s gave no error", shape)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package imagemap
+
+import (
+	"html"
+	"strings"
+)
+
+// tag is an HTML start or end tag. Its name and the names of its attributes are in lower case and the values of the
+// attributes have had their character references replaced.
+type tag struct {
+	Name  string
+	End   bool
+	Attrs [][2]string
+}
+
+// attr returns the value of the first attribute called name, which must be in lower case, as a browser would.
+func (t tag) attr(name string) string {
+	for _, a := range t.Attrs {
+		if a[0] == name {
+			return a[1]
+		}
+	}
+	return ""
+}
+
+// rawText holds the elements whose content is text up to their end tag, where a < doesn't start a tag.
+var rawText = map[string]bool{
+	"iframe":   true,
+	"noembed":  true,
+	"noframes": true,
+	"noscript": true,
+	"script":   true,
+	"style":    true,
+	"textarea": true,
+	"title":    true,
+	"xmp":      true,
+}
+
+// scanTags calls f with each tag of the HTML document doc in order until it returns false. Like a browser it never
+// fails: a < which can't start a tag is text, comments and the content of raw text elements such as <script> are
+// skipped, attribute values can be quoted with either quote or not at all, and a tag cut short by the end of doc is
+// dropped.
+func scanTags(doc string, f func(t tag) bool) {
+	for {
+		i := strings.IndexByte(doc, '<')
+		if i < 0 || i+1 >= len(doc) {
+			return
+		}
+		doc = doc[i+1:]
+		switch c := doc[0]; {
+		case strings.HasPrefix(doc, "!--"):
+			end := strings.Index(doc[3:], "-->")
+			if end < 0 {
+				return
+			}
+			doc = doc[3+end+3:]
+		case c == '!' || c == '?':
+			doc = skipPast(doc, '>')
+		case c == '/' && len(doc) > 1 && isLetter(doc[1]):
+			var name string
+			name, doc = tagName(doc[1:])
+			doc = skipPast(doc, '>')
+			if !f(tag{Name: name, End: true}) {
+				return
+			}
+		case c == '/':
+			// </> is dropped and </ followed by anything else but a letter is a comment.
+			doc = skipPast(doc, '>')
+		case isLetter(c):
+			var t tag
+			var closed bool
+			t.Name, doc = tagName(doc)
+			t.Attrs, doc, closed = attributes(doc)
+			if !closed || !f(t) {
+				return
+			}
+			if rawText[t.Name] {
+				doc = skipRawText(doc, t.Name)
+			}
+		}
+	}
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// skipPast returns s after the first c, or nothing when there isn't one.
+func skipPast(s string, c byte) string {
+	if i := strings.IndexByte(s, c); i >= 0 {
+		return s[i+1:]
+	}
+	return ""
+}
+
+// tagName reads the name at the start of s, up to a space, / or >, and returns it in lower case with the rest of s.
+func tagName(s string) (string, string) {
+	i := 0
+	for i < len(s) && !isSpace(s[i]) && s[i] != '/' && s[i] != '>' {
+		i++
+	}
+	return strings.ToLower(s[:i]), s[i:]
+}
+
+// attributes reads the attributes of a start tag up to and including its >, closed is false when s ends first.
+func attributes(s string) (attrs [][2]string, rest string, closed bool) {
+	for {
+		for len(s) > 0 && (isSpace(s[0]) || s[0] == '/') {
+			s = s[1:]
+		}
+		if len(s) == 0 {
+			return attrs, s, false
+		}
+		if s[0] == '>' {
+			return attrs, s[1:], true
+		}
+		// A name can start with = but otherwise runs up to a space, /, > or =.
+		i := 1
+		for i < len(s) && !isSpace(s[i]) && s[i] != '/' && s[i] != '>' && s[i] != '=' {
+			i++
+		}
+		name := strings.ToLower(s[:i])
+		s = strings.TrimLeft(s[i:], " \t\n\r\f")
+		value := ""
+		if len(s) > 0 && s[0] == '=' {
+			s = strings.TrimLeft(s[1:], " \t\n\r\f")
+			if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+				end := strings.IndexByte(s[1:], s[0])
+				if end < 0 {
+					return attrs, "", false
+				}
+				value, s = s[1:1+end], s[1+end+1:]
+			} else {
+				j := 0
+				for j < len(s) && !isSpace(s[j]) && s[j] != '>' {
+					j++
+				}
+				value, s = s[:j], s[j:]
+			}
+		}
+		attrs = append(attrs, [2]string{name, html.UnescapeString(value)})
+	}
+}
+
+// skipRawText returns s after the end tag of the raw text element name, which must be in lower case, or nothing when
+// there isn't one.
+func skipRawText(s, name string) string {
+	for {
+		i := strings.Index(s, "</")
+		if i < 0 {
+			return ""
+		}
+		s = s[i+2:]
+		if len(s) >= len(name) && strings.EqualFold(s[:len(name)], name) {
+			if rest := s[len(name):]; rest == "" || isSpace(rest[0]) || rest[0] == '/' || rest[0] == '>' {
+				return "</" + s
+			}
+		}
+	}
+}
@@ -1,10 +1,87 @@
 package spacemap
 
-import "github.com/arran4/spacemap/shared"
+import (
+	"image"
 
+	"github.com/arran4/spacemap/shared"
+)
+
+// Interface is implemented by every map. Stacks are returned topmost first: a shape with a higher z-index is above
+// one with a lower z-index, and of shapes with the same z-index the one added last is above. GetAt returns the
+// topmost shape at a point and GetBottomAt the bottommost, both return nil when there are no shapes there.
+//
+// Len returns the number of shapes, counting a shape added more than once each time, and Contains reports if a shape
+// has been added and not removed. All returns every shape topmost first, and Bounds the smallest rectangle covering
+// them, such as for scrollbars or zooming to fit, ignoring any with empty bounds.
 type Interface interface {
 	Add(shape shared.Shape, zIndex int)
 	Remove(shape shared.Shape)
 	GetStackAt(x int, y int) []shared.Shape
 	GetAt(x int, y int) shared.Shape
+	GetBottomAt(x int, y int) shared.Shape
+	Len() int
+	Contains(shape shared.Shape) bool
+	All() []shared.Shape
+	Bounds() image.Rectangle
+}
+
+// RegionQuerier is implemented by maps which can return every shape matching a rectangular region, in the same
+// order as GetStackAt.
+type RegionQuerier interface {
+	GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape
+}
+
+// ZQuerier is implemented by maps which can return the z-index of each shape in a stack, such as for drawing overlays
+// on the right layer. The stacks are in the same order as GetStackAt and GetStackIn.
+type ZQuerier interface {
+	GetZStackAt(x, y int) []shared.ZShape
+	GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape
+}
+
+// Clearer is implemented by maps which can remove every shape at once, keeping the memory they have allocated where
+// they can so they can be refilled without growing again.
+type Clearer interface {
+	Clear()
+}
+
+// Updater is implemented by maps which can re-index a shape after its bounds have changed without removing and
+// adding it again. Update is for when the shape has already changed and must be given the bounds the shape was
+// indexed with, Move changes the bounds of the shape itself. Every copy of a shape added more than once is moved.
+type Updater interface {
+	Update(shape shared.Shape, oldBounds image.Rectangle)
+	Move(shape shared.Resizable, bounds image.Rectangle)
+}
+
+// ZOrderer is implemented by maps which can change the z-index of an indexed shape in place. A shape given a new
+// z-index is stacked above any others which already have it. Every copy of a shape added more than once is given the
+// z-index, keeping their order, and ZIndexOf returns the z-index of the topmost copy.
+type ZOrderer interface {
+	ZIndexOf(shape shared.Shape) (int, bool)
+	SetZIndex(shape shared.Shape, zIndex int)
+	BringToFront(shape shared.Shape)
+	SendToBack(shape shared.Shape)
+	PlaceAbove(shape shared.Shape, other shared.Shape)
+}
+
+// NearestQuerier is implemented by maps which can find the shapes nearest to a point, measured by shared.Distance.
+// Shapes at the same distance are in the same order as GetStackAt, Nearest returns nil when there are no shapes.
+type NearestQuerier interface {
+	Nearest(x, y int) shared.Shape
+	KNearest(x, y, k int, maxDistance float64) []shared.Shape
+}
+
+// Caster is implemented by maps which can find the shapes crossed by a line, such as for line of sight or a
+// projectile. Hits are in order of first contact and shapes first entered at the same pixel are in the same order as
+// GetStackAt. RayCast stops after maxDistance, which can be +Inf.
+type Caster interface {
+	SegmentCast(x0, y0, x1, y1 int) []shared.Hit
+	RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit
+}
+
+// StackVisitor is implemented by maps which can query a point without allocating, for queries made every frame.
+// VisitStackAt calls f with each shape at the point and its z-index, in the same order as GetStackAt, until f returns
+// false. AppendStackAt appends the stack to dst so a buffer can be reused.
+type StackVisitor interface {
+	VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool)
+	AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape
 }
@@ -0,0 +1,95 @@
+package spacemap
+
+import (
+	"image"
+
+	"github.com/arran4/spacemap/shared"
+)
+
+// Entry is a shape found in a Map and the value it was added with.
+type Entry[T any] struct {
+	Shape shared.Shape
+	Value T
+}
+
+// Map stores a value of type T with each shape, so queries return the value directly rather than needing a
+// separate lookup. A shape has a single value, adding it again replaces the value and restacks it with the new z-index.
+type Map[T any] struct {
+	// Index positions the shapes. It can be used directly for optional interfaces such as Updater and ZOrderer, but
+	// shapes must be added and removed through the Map.
+	Index  Interface
+	values map[shared.Shape]T
+}
+
+// NewMap returns a Map which uses index, any implementation of Interface, to position its shapes.
+func NewMap[T any](index Interface) *Map[T] {
+	return &Map[T]{
+		Index:  index,
+		values: map[shared.Shape]T{},
+	}
+}
+
+func (m *Map[T]) Add(shape shared.Shape, zIndex int, value T) {
+	if _, ok := m.values[shape]; !ok {
+		m.Index.Add(shape, zIndex)
+	} else if z, ok := m.Index.(ZOrderer); ok {
+		z.SetZIndex(shape, zIndex)
+	} else {
+		m.Index.Remove(shape)
+		m.Index.Add(shape, zIndex)
+	}
+	m.values[shape] = value
+}
+
+func (m *Map[T]) Remove(shape shared.Shape) {
+	m.Index.Remove(shape)
+	delete(m.values, shape)
+}
+
+// Value returns the value shape was added with, ok is false if it isn't in the map.
+func (m *Map[T]) Value(shape shared.Shape) (value T, ok bool) {
+	value, ok = m.values[shape]
+	return
+}
+
+// SetValue replaces the value of shape, it does nothing if shape isn't in the map.
+func (m *Map[T]) SetValue(shape shared.Shape, value T) {
+	if _, ok := m.values[shape]; ok {
+		m.values[shape] = value
+	}
+}
+
+func (m *Map[T]) entries(shapes []shared.Shape) []Entry[T] {
+	result := make([]Entry[T], 0, len(shapes))
+	for _, s := range shapes {
+		result = append(result, Entry[T]{Shape: s, Value: m.values[s]})
+	}
+	return result
+}
+
+// GetStackAt returns the entries at x, y topmost first.
+func (m *Map[T]) GetStackAt(x int, y int) []Entry[T] {
+	return m.entries(m.Index.GetStackAt(x, y))
+}
+
+// GetAt returns the topmost shape at x, y and its value, or nil and the zero value when there are none.
+func (m *Map[T]) GetAt(x int, y int) (shared.Shape, T) {
+	s := m.Index.GetAt(x, y)
+	return s, m.values[s]
+}
+
+// GetBottomAt returns the bottommost shape at x, y and its value, or nil and the zero value when there are none.
+func (m *Map[T]) GetBottomAt(x int, y int) (shared.Shape, T) {
+	s := m.Index.GetBottomAt(x, y)
+	return s, m.values[s]
+}
+
+// GetStackIn returns the entries matching r in the same order as GetStackAt. It returns none if Index isn't a
+// RegionQuerier.
+func (m *Map[T]) GetStackIn(r image.Rectangle, mode shared.Containment) []Entry[T] {
+	rq, ok := m.Index.(RegionQuerier)
+	if !ok {
+		return []Entry[T]{}
+	}
+	return m.entries(rq.GetStackIn(r, mode))
+}
@@ -0,0 +1,76 @@
+package spacemap
+
+import (
+	"image"
+	"testing"
+
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/simplearray"
+	"github.com/arran4/spacemap/space2trees"
+	"github.com/arran4/spacemap/spacepartition"
+	"github.com/google/go-cmp/cmp"
+)
+
+type widget struct {
+	Name string
+}
+
+func TestMap(t *testing.T) {
+	indexes := map[string]func() Interface{
+		"simplearray":    func() Interface { return simplearray.New() },
+		"space2trees":    func() Interface { return space2trees.New() },
+		"spacepartition": func() Interface { return spacepartition.New() },
+	}
+	for name, newIndex := range indexes {
+		t.Run(name, func(t *testing.T) {
+			rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+			rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+			window, button := &widget{Name: "window"}, &widget{Name: "button"}
+			m := NewMap[*widget](newIndex())
+			m.Add(rect1, 0, window)
+			m.Add(rect2, 1, button)
+
+			if diff := cmp.Diff([]Entry[*widget]{{rect2, button}, {rect1, window}}, m.GetStackAt(50, 50)); diff != "" {
+				t.Errorf("GetStackAt(50, 50) diff: %s", diff)
+			}
+			if s, w := m.GetAt(50, 50); s != rect2 || w != button {
+				t.Errorf("GetAt(50, 50) = %v, %v want rect2, button", s, w)
+			}
+			if s, w := m.GetBottomAt(50, 50); s != rect1 || w != window {
+				t.Errorf("GetBottomAt(50, 50) = %v, %v want rect1, window", s, w)
+			}
+			if s, w := m.GetAt(0, 0); s != nil || w != nil {
+				t.Errorf("GetAt(0, 0) = %v, %v want nil, nil", s, w)
+			}
+			if diff := cmp.Diff([]Entry[*widget]{{rect2, button}}, m.GetStackIn(image.Rect(30, 30, 70, 70), shared.Within)); diff != "" {
+				t.Errorf("GetStackIn diff: %s", diff)
+			}
+
+			dialog := &widget{Name: "dialog"}
+			m.SetValue(rect2, dialog)
+			if w, ok := m.Value(rect2); !ok || w != dialog {
+				t.Errorf("Value(rect2) = %v, %v want dialog, true", w, ok)
+			}
+			m.Remove(rect2)
+			if w, ok := m.Value(rect2); ok || w != nil {
+				t.Errorf("Value(rect2) = %v, %v after Remove want nil, false", w, ok)
+			}
+			m.SetValue(rect2, dialog)
+			if _, ok := m.Value(rect2); ok {
+				t.Errorf("SetValue added a missing shape")
+			}
+			if diff := cmp.Diff([]Entry[*widget]{{rect1, window}}, m.GetStackAt(50, 50)); diff != "" {
+				t.Errorf("GetStackAt(50, 50) after Remove diff: %s", diff)
+			}
+
+			m.Add(rect2, 1, button)
+			m.Add(rect1, 1, dialog)
+			if diff := cmp.Diff([]Entry[*widget]{{rect1, dialog}, {rect2, button}}, m.GetStackAt(50, 50)); diff != "" {
+				t.Errorf("GetStackAt(50, 50) after adding again diff: %s", diff)
+			}
+			if n := m.Index.Len(); n != 2 {
+				t.Errorf("Index.Len() = %d after adding again want 2", n)
+			}
+		})
+	}
+}
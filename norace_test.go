@@ -0,0 +1,5 @@
+//go:build !race
+
+package spacemap
+
+const raceEnabled = false
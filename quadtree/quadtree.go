@@ -0,0 +1,610 @@
+package quadtree
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/arran4/spacemap/shared"
+)
+
+const (
+	DefaultMaxDepth     = 16
+	DefaultNodeCapacity = 8
+)
+
+// MaxDepth is an option for New limiting how many times the root can be divided.
+type MaxDepth int
+
+// NodeCapacity is an option for New setting how many shapes a leaf holds before it is divided.
+type NodeCapacity int
+
+// Node covers a square Region whose size is a power of two. A shape is stored in the deepest node whose Region contains its bounds, so internal nodes hold the shapes which straddle their
+// children.
+type Node struct {
+	Region   image.Rectangle
+	Points   []*shared.Point
+	Children []*Node
+}
+
+type Struct struct {
+	Root         *Node
+	MaxDepth     int
+	NodeCapacity int
+	// Sequence orders shapes with the same z-index as they are spread over many nodes.
+	Sequence int
+	members  shared.Members
+}
+
+func New(ops ...shared.Op) *Struct {
+	m := &Struct{
+		MaxDepth:     DefaultMaxDepth,
+		NodeCapacity: DefaultNodeCapacity,
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case MaxDepth:
+			m.MaxDepth = int(op)
+		case NodeCapacity:
+			m.NodeCapacity = int(op)
+		}
+	}
+	return m
+}
+
+// Locator returns the rectangle used to position a shape with bounds b in the tree, shapes with empty bounds are
+// positioned at their minimum point.
+func Locator(b image.Rectangle) image.Rectangle {
+	b = b.Canon()
+	if b.Dx() == 0 {
+		b.Max.X = b.Min.X + 1
+	}
+	if b.Dy() == 0 {
+		b.Max.Y = b.Min.Y + 1
+	}
+	return b
+}
+
+// Quadrants returns the four equal squares that make up r.
+func Quadrants(r image.Rectangle) [4]image.Rectangle {
+	h := r.Dx() / 2
+	return [4]image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+h, r.Min.Y+h),
+		image.Rect(r.Min.X+h, r.Min.Y, r.Max.X, r.Min.Y+h),
+		image.Rect(r.Min.X, r.Min.Y+h, r.Min.X+h, r.Max.Y),
+		image.Rect(r.Min.X+h, r.Min.Y+h, r.Max.X, r.Max.Y),
+	}
+}
+
+func (n *Node) Leaf() bool {
+	return n.Children == nil
+}
+
+// Child returns the child whose Region contains loc.
+func (n *Node) Child(loc image.Rectangle) *Node {
+	for _, c := range n.Children {
+		if loc.In(c.Region) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Locate returns the node a shape positioned at loc is or would be stored in.
+func (n *Node) Locate(loc image.Rectangle) *Node {
+	for n != nil && !n.Leaf() {
+		c := n.Child(loc)
+		if c == nil {
+			break
+		}
+		n = c
+	}
+	return n
+}
+
+// Grow doubles the root towards loc until it contains it. The old root becomes one of the quadrants of the new root.
+func (m *Struct) Grow(loc image.Rectangle) {
+	if m.Root == nil {
+		m.Root = &Node{
+			Region: image.Rect(loc.Min.X, loc.Min.Y, loc.Min.X+1, loc.Min.Y+1),
+		}
+	}
+	for !loc.In(m.Root.Region) {
+		size := m.Root.Region.Dx()
+		min := m.Root.Region.Min
+		if loc.Min.X < min.X {
+			min.X -= size
+		}
+		if loc.Min.Y < min.Y {
+			min.Y -= size
+		}
+		root := &Node{
+			Region: image.Rectangle{Min: min, Max: min.Add(image.Pt(size*2, size*2))},
+		}
+		for _, q := range Quadrants(root.Region) {
+			if q == m.Root.Region {
+				root.Children = append(root.Children, m.Root)
+			} else {
+				root.Children = append(root.Children, &Node{Region: q})
+			}
+		}
+		m.Root = root
+	}
+}
+
+// Insert adds p, positioned at loc, to the deepest node which contains it dividing full leaves on the way.
+func (n *Node) Insert(p *shared.Point, loc image.Rectangle, depth int, m *Struct) {
+	for !n.Leaf() {
+		c := n.Child(loc)
+		if c == nil {
+			break
+		}
+		n = c
+		depth++
+	}
+	n.Points = shared.PointArray(n.Points).Insert(p)
+	if n.Leaf() && len(n.Points) > m.NodeCapacity && depth < m.MaxDepth && n.Region.Dx() > 1 {
+		n.Divide(depth, m)
+	}
+}
+
+// Divide turns a leaf into an internal node pushing down every shape that fits into a child.
+func (n *Node) Divide(depth int, m *Struct) {
+	for _, q := range Quadrants(n.Region) {
+		n.Children = append(n.Children, &Node{Region: q})
+	}
+	points := n.Points
+	n.Points = nil
+	for _, p := range points {
+		loc := Locator(p.Bounds())
+		if c := n.Child(loc); c != nil {
+			c.Insert(p, loc, depth+1, m)
+		} else {
+			n.Points = append(n.Points, p)
+		}
+	}
+}
+
+// Count returns the number of points in the node and all its children, it stops counting once limit is exceeded.
+func (n *Node) Count(limit int) int {
+	c := len(n.Points)
+	for _, child := range n.Children {
+		if c > limit {
+			break
+		}
+		c += child.Count(limit - c)
+	}
+	return c
+}
+
+// Collapse merges the children of every node along the path to loc that holds no more than capacity points.
+func (n *Node) Collapse(loc image.Rectangle, capacity int) {
+	if n.Leaf() {
+		return
+	}
+	if c := n.Child(loc); c != nil {
+		c.Collapse(loc, capacity)
+	}
+	if n.Count(capacity) > capacity {
+		return
+	}
+	children := n.Children
+	n.Children = nil
+	for _, c := range children {
+		c.Walk(func(cn *Node) {
+			for _, p := range cn.Points {
+				n.Points = shared.PointArray(n.Points).Insert(p)
+			}
+		})
+	}
+}
+
+// Clone returns a copy of the tree below n, copying its points with points.
+func (n *Node) Clone(points shared.PointCloner) *Node {
+	if n == nil {
+		return nil
+	}
+	c := &Node{
+		Region: n.Region,
+		Points: points.CloneAll(n.Points),
+	}
+	if n.Children != nil {
+		c.Children = make([]*Node, len(n.Children))
+		for i, child := range n.Children {
+			c.Children[i] = child.Clone(points)
+		}
+	}
+	return c
+}
+
+// Walk calls f for the node and all its children.
+func (n *Node) Walk(f func(n *Node)) {
+	f(n)
+	for _, c := range n.Children {
+		c.Walk(f)
+	}
+}
+
+// Visit calls f for every node whose region overlaps r.
+func (n *Node) Visit(r image.Rectangle, f func(n *Node)) {
+	if !n.Region.Overlaps(r) {
+		return
+	}
+	f(n)
+	for _, c := range n.Children {
+		c.Visit(r, f)
+	}
+}
+
+// VisitSegment calls f for every node whose region the line from x0, y0 to x1, y1 passes through.
+func (n *Node) VisitSegment(x0, y0, x1, y1 int, f func(n *Node)) {
+	if !shared.SegmentOverlaps(n.Region, x0, y0, x1, y1) {
+		return
+	}
+	f(n)
+	for _, c := range n.Children {
+		c.VisitSegment(x0, y0, x1, y1, f)
+	}
+}
+
+func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
+	for _, shape := range shapes {
+		m.Add(shape, 0)
+	}
+	return m
+}
+
+func (m *Struct) Add(shape shared.Shape, zIndex int) {
+	m.Sequence++
+	m.insert(&shared.Point{
+		Shape:  shape,
+		ZIndex: zIndex,
+		Order:  m.Sequence,
+	}, shape.Bounds())
+	m.members.Add(shape)
+}
+
+func (m *Struct) insert(p *shared.Point, b image.Rectangle) {
+	loc := Locator(b)
+	m.Grow(loc)
+	m.Root.Insert(p, loc, 0, m)
+}
+
+func (m *Struct) Remove(shape shared.Shape) {
+	m.remove(shape, shape.Bounds())
+	m.members.Remove(shape)
+}
+
+// remove takes shape, which was added with the bounds b, out of the tree.
+func (m *Struct) remove(shape shared.Shape, b image.Rectangle) {
+	if m.Root == nil {
+		return
+	}
+	loc := Locator(b)
+	n := m.Root.Locate(loc)
+	if n == nil {
+		return
+	}
+	points := n.Points[:0]
+	for _, p := range n.Points {
+		if p.Shape != shape {
+			points = append(points, p)
+		}
+	}
+	for i := len(points); i < len(n.Points); i++ {
+		n.Points[i] = nil
+	}
+	n.Points = points
+	m.Root.Collapse(loc, m.NodeCapacity)
+	if m.Root.Leaf() && len(m.Root.Points) == 0 {
+		m.Root = nil
+	}
+}
+
+// FindPoint returns the point for shape which was added with the bounds b.
+func (m *Struct) FindPoint(shape shared.Shape, b image.Rectangle) *shared.Point {
+	if m.Root == nil {
+		return nil
+	}
+	n := m.Root.Locate(Locator(b))
+	if n == nil {
+		return nil
+	}
+	for _, p := range n.Points {
+		if p.Shape == shape {
+			return p
+		}
+	}
+	return nil
+}
+
+// FindPoints returns the point for each time shape was added with the bounds b, bottom first.
+func (m *Struct) FindPoints(shape shared.Shape, b image.Rectangle) (points []*shared.Point) {
+	if m.Root == nil {
+		return nil
+	}
+	n := m.Root.Locate(Locator(b))
+	if n == nil {
+		return nil
+	}
+	for _, p := range n.Points {
+		if p.Shape == shape {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+func (m *Struct) GetStackAt(x int, y int) []shared.Shape {
+	return m.AppendStackAt([]shared.Shape{}, x, y)
+}
+
+// VisitStackAt calls f with each shape at x, y and its z-index, topmost first, until f returns false.
+func (m *Struct) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	shared.VisitStack(func(buf []*shared.Point) []*shared.Point {
+		loc := image.Rect(x, y, x+1, y+1)
+		for n := m.Root; n != nil && loc.In(n.Region); {
+			for _, p := range n.Points {
+				if p.PointIn(x, y) {
+					buf = append(buf, p)
+				}
+			}
+			if n.Leaf() {
+				break
+			}
+			n = n.Child(loc)
+		}
+		return buf
+	}, f)
+}
+
+// AppendStackAt appends the shapes at x, y to dst, topmost first, and returns the extended slice.
+func (m *Struct) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		dst = append(dst, shape)
+		return true
+	})
+	return dst
+}
+
+func (m *Struct) GetAt(x int, y int) (top shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		top = shape
+		return false
+	})
+	return top
+}
+
+func (m *Struct) GetBottomAt(x int, y int) (bottom shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		bottom = shape
+		return true
+	})
+	return bottom
+}
+
+// Len returns the number of shapes.
+func (m *Struct) Len() int {
+	return m.members.Len()
+}
+
+// Contains reports if shape has been added and not removed.
+func (m *Struct) Contains(shape shared.Shape) bool {
+	return m.members.Contains(shape)
+}
+
+// All returns every shape, topmost first.
+func (m *Struct) All() []shared.Shape {
+	return shared.PointArray(m.allPoints()).Shapes()
+}
+
+// allPoints returns the point of every shape, topmost first.
+func (m *Struct) allPoints() []*shared.Point {
+	var points []*shared.Point
+	if m.Root != nil {
+		m.Root.Walk(func(n *Node) {
+			points = append(points, n.Points...)
+		})
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	return points
+}
+
+// Bounds returns the smallest rectangle covering every shape, shapes with empty bounds are ignored. The root's region
+// is larger than the shapes so every shape is checked.
+func (m *Struct) Bounds() (r image.Rectangle) {
+	if m.Root != nil {
+		m.Root.Walk(func(n *Node) {
+			for _, p := range n.Points {
+				if b := p.Bounds(); !b.Empty() {
+					r = r.Union(b)
+				}
+			}
+		})
+	}
+	return r
+}
+
+// Clear removes every shape.
+func (m *Struct) Clear() {
+	m.Root = nil
+	m.Sequence = 0
+	m.members.Clear()
+}
+
+// Clone returns a copy which can be changed independently of m. The shapes themselves are shared.
+func (m *Struct) Clone() *Struct {
+	return &Struct{
+		Root:         m.Root.Clone(shared.PointCloner{}),
+		MaxDepth:     m.MaxDepth,
+		NodeCapacity: m.NodeCapacity,
+		Sequence:     m.Sequence,
+		members:      m.members.Clone(),
+	}
+}
+
+// MarshalJSON encodes every shape with its z-index, the shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalJSON() ([]byte, error) {
+	return shared.MarshalShapes(shared.PointArray(m.allPoints()).ZShapes())
+}
+
+// UnmarshalJSON replaces the shapes of a map created with New with those encoded by MarshalJSON, stacked as they
+// were. Options given to New are kept.
+func (m *Struct) UnmarshalJSON(data []byte) error {
+	shapes, err := shared.UnmarshalShapes(data)
+	if err != nil {
+		return err
+	}
+	m.Clear()
+	for i := len(shapes) - 1; i >= 0; i-- {
+		m.Add(shapes[i].Shape, shapes[i].ZIndex)
+	}
+	return nil
+}
+
+func (m *Struct) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	return shared.PointArray(m.pointsIn(r, mode)).Shapes()
+}
+
+// GetZStackIn is GetStackIn with the z-index of each shape.
+func (m *Struct) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	return shared.PointArray(m.pointsIn(r, mode)).ZShapes()
+}
+
+// GetZStackAt is GetStackAt with the z-index of each shape.
+func (m *Struct) GetZStackAt(x, y int) []shared.ZShape {
+	result := []shared.ZShape{}
+	m.VisitStackAt(x, y, func(shape shared.Shape, zIndex int) bool {
+		result = append(result, shared.ZShape{Shape: shape, ZIndex: zIndex})
+		return true
+	})
+	return result
+}
+
+// pointsIn returns the points of the shapes matching r, topmost first.
+func (m *Struct) pointsIn(r image.Rectangle, mode shared.Containment) []*shared.Point {
+	var found []*shared.Point
+	if m.Root != nil && !r.Empty() {
+		m.Root.Visit(r, func(n *Node) {
+			for _, p := range n.Points {
+				if mode.Match(p.Bounds(), r) {
+					found = append(found, p)
+				}
+			}
+		})
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	return found
+}
+
+// Nearest returns the shape nearest to x, y, or nil when there are none.
+func (m *Struct) Nearest(x, y int) shared.Shape {
+	if s := m.KNearest(x, y, 1, math.Inf(1)); len(s) > 0 {
+		return s[0]
+	}
+	return nil
+}
+
+// KNearest returns up to k shapes no further than maxDistance from x, y, nearest first. Only the nodes around the point are searched.
+func (m *Struct) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	return shared.KNearest(x, y, k, maxDistance, m.extent(), func(r image.Rectangle) []shared.Shape {
+		return m.GetStackIn(r, shared.Intersects)
+	})
+}
+
+// SegmentCast returns the shapes crossed by the line from x0, y0 to x1, y1 in order of first contact. Only the shapes
+// in the nodes along the line are checked.
+func (m *Struct) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	var found []*shared.Point
+	if m.Root != nil {
+		m.Root.VisitSegment(x0, y0, x1, y1, func(n *Node) {
+			for _, p := range n.Points {
+				if shared.SegmentOverlaps(p.Bounds(), x0, y0, x1, y1) {
+					found = append(found, p)
+				}
+			}
+		})
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	candidates := make([]shared.Shape, 0, len(found))
+	for _, p := range found {
+		candidates = append(candidates, p.Shape)
+	}
+	return shared.Cast(x0, y0, x1, y1, candidates)
+}
+
+// RayCast returns the shapes crossed by a ray from x, y in the direction dx, dy, no further than maxDistance which can
+// be +Inf, in order of first contact.
+func (m *Struct) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	return shared.RayCast(x, y, dx, dy, maxDistance, m.extent(), m.SegmentCast)
+}
+
+// extent returns the region of the root node, it is empty when there is none.
+func (m *Struct) extent() image.Rectangle {
+	if m.Root == nil {
+		return image.Rectangle{}
+	}
+	return m.Root.Region
+}
+
+// Update moves shape from oldBounds to its current bounds.
+func (m *Struct) Update(shape shared.Shape, oldBounds image.Rectangle) {
+	b := shape.Bounds()
+	if b == oldBounds {
+		return
+	}
+	points := m.FindPoints(shape, oldBounds)
+	if len(points) == 0 {
+		return
+	}
+	m.remove(shape, oldBounds)
+	for _, p := range points {
+		m.insert(p, b)
+	}
+}
+
+func (m *Struct) Move(shape shared.Resizable, bounds image.Rectangle) {
+	oldBounds := shape.Bounds()
+	shape.SetBounds(bounds)
+	m.Update(shape, oldBounds)
+}
+
+// ZIndexOf returns the z-index of shape, or of its topmost copy when it was added more than once.
+func (m *Struct) ZIndexOf(shape shared.Shape) (int, bool) {
+	if p := shared.PointArray(m.FindPoints(shape, shape.Bounds())).Top(); p != nil {
+		return p.ZIndex, true
+	}
+	return 0, false
+}
+
+// SetZIndex changes the z-index of each of the shape's points, keeping the order of copies of a shape added more
+// than once, and restacks them within their node.
+func (m *Struct) SetZIndex(shape shared.Shape, zIndex int) {
+	points := m.FindPoints(shape, shape.Bounds())
+	if len(points) == 0 {
+		return
+	}
+	n := m.Root.Locate(Locator(shape.Bounds()))
+	for _, p := range points {
+		m.Sequence++
+		p.ZIndex = zIndex
+		p.Order = m.Sequence
+		n.Points = shared.PointArray(shared.PointArray(n.Points).RemovePoint(p)).Insert(p)
+	}
+}
+
+// BringToFront restacks shape above every other shape.
+func (m *Struct) BringToFront(shape shared.Shape) {
+	shared.BringToFront(m, shape)
+}
+
+// SendToBack restacks shape below every other shape.
+func (m *Struct) SendToBack(shape shared.Shape) {
+	shared.SendToBack(m, shape)
+}
+
+// PlaceAbove restacks shape directly above other, even if that lowers it, leaving the order of the other shapes
+// unchanged.
+func (m *Struct) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	shared.PlaceAbove(m, shape, other)
+}
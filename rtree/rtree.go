@@ -0,0 +1,784 @@
+package rtree
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/arran4/spacemap/shared"
+)
+
+const (
+	DefaultMaxEntries = 16
+)
+
+// MaxEntries is an option for New setting how many entries a node holds before it is split.
+type MaxEntries int
+
+// MinEntries is an option for New setting how few entries a node can hold before it is removed and its shapes
+// reinserted. It defaults to 40% of MaxEntries as suggested for the R*-tree.
+type MinEntries int
+
+// Node is a leaf holding Points or an internal node holding Children. Bounds is the minimum bounding rectangle of
+// every entry.
+type Node struct {
+	Bounds   image.Rectangle
+	Leaf     bool
+	Points   []*shared.Point
+	Children []*Node
+}
+
+type Struct struct {
+	Root       *Node
+	MaxEntries int
+	MinEntries int
+	// Sequence orders shapes with the same z-index as they are spread over many nodes.
+	Sequence int
+	members  shared.Members
+}
+
+func New(ops ...shared.Op) *Struct {
+	m := &Struct{
+		MaxEntries: DefaultMaxEntries,
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case MaxEntries:
+			m.MaxEntries = int(op)
+		case MinEntries:
+			m.MinEntries = int(op)
+		}
+	}
+	if m.MaxEntries < 4 {
+		m.MaxEntries = 4
+	}
+	if m.MinEntries <= 0 {
+		m.MinEntries = m.MaxEntries * 2 / 5
+	}
+	if m.MinEntries > m.MaxEntries/2 {
+		m.MinEntries = m.MaxEntries / 2
+	}
+	return m
+}
+
+// Envelope returns the rectangle used to position a shape with bounds b in the tree, shapes with empty bounds are
+// positioned at their minimum point.
+func Envelope(b image.Rectangle) image.Rectangle {
+	b = b.Canon()
+	if b.Dx() == 0 {
+		b.Max.X = b.Min.X + 1
+	}
+	if b.Dy() == 0 {
+		b.Max.Y = b.Min.Y + 1
+	}
+	return b
+}
+
+func area(r image.Rectangle) float64 {
+	return float64(r.Dx()) * float64(r.Dy())
+}
+
+func margin(r image.Rectangle) float64 {
+	return float64(r.Dx()) + float64(r.Dy())
+}
+
+func overlap(a, b image.Rectangle) float64 {
+	return area(a.Intersect(b))
+}
+
+// Entries returns the rectangle of every entry in the node.
+func (n *Node) Entries() []image.Rectangle {
+	var r []image.Rectangle
+	if n.Leaf {
+		r = make([]image.Rectangle, len(n.Points))
+		for i, p := range n.Points {
+			r[i] = Envelope(p.Bounds())
+		}
+	} else {
+		r = make([]image.Rectangle, len(n.Children))
+		for i, c := range n.Children {
+			r[i] = c.Bounds
+		}
+	}
+	return r
+}
+
+func (n *Node) Len() int {
+	if n.Leaf {
+		return len(n.Points)
+	}
+	return len(n.Children)
+}
+
+// Recalculate sets Bounds to the union of the node's entries.
+func (n *Node) Recalculate() {
+	n.Bounds = image.Rectangle{}
+	for i, r := range n.Entries() {
+		if i == 0 {
+			n.Bounds = r
+		} else {
+			n.Bounds = n.Bounds.Union(r)
+		}
+	}
+}
+
+// ChooseSubtree picks the child to insert env into. Children of leaves are chosen by the least overlap enlargement and
+// the rest by the least area enlargement, ties fall back to the smallest area.
+func (n *Node) ChooseSubtree(env image.Rectangle) *Node {
+	var best *Node
+	bestOverlap, bestEnlargement, bestArea := math.Inf(1), math.Inf(1), math.Inf(1)
+	leafLevel := len(n.Children) > 0 && n.Children[0].Leaf
+	for _, c := range n.Children {
+		grown := c.Bounds.Union(env)
+		enlargement := area(grown) - area(c.Bounds)
+		o := 0.0
+		if leafLevel {
+			for _, s := range n.Children {
+				if s != c {
+					o += overlap(grown, s.Bounds) - overlap(c.Bounds, s.Bounds)
+				}
+			}
+		}
+		a := area(c.Bounds)
+		if o < bestOverlap ||
+			o == bestOverlap && enlargement < bestEnlargement ||
+			o == bestOverlap && enlargement == bestEnlargement && a < bestArea {
+			best, bestOverlap, bestEnlargement, bestArea = c, o, enlargement, a
+		}
+	}
+	return best
+}
+
+func union(rects []image.Rectangle, order []int) image.Rectangle {
+	r := rects[order[0]]
+	for _, i := range order[1:] {
+		r = r.Union(rects[i])
+	}
+	return r
+}
+
+// ChooseSplit partitions rects using the R*-tree split. The axis with the smallest total margin over every allowed
+// distribution is used, then the distribution on it with the least overlap, ties going to the smallest area.
+func ChooseSplit(rects []image.Rectangle, min int) ([]int, []int) {
+	var sorts [][]int
+	for _, less := range []func(a, b image.Rectangle) bool{
+		func(a, b image.Rectangle) bool { return a.Min.X < b.Min.X || a.Min.X == b.Min.X && a.Max.X < b.Max.X },
+		func(a, b image.Rectangle) bool { return a.Max.X < b.Max.X || a.Max.X == b.Max.X && a.Min.X < b.Min.X },
+		func(a, b image.Rectangle) bool { return a.Min.Y < b.Min.Y || a.Min.Y == b.Min.Y && a.Max.Y < b.Max.Y },
+		func(a, b image.Rectangle) bool { return a.Max.Y < b.Max.Y || a.Max.Y == b.Max.Y && a.Min.Y < b.Min.Y },
+	} {
+		order := make([]int, len(rects))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return less(rects[order[i]], rects[order[j]])
+		})
+		sorts = append(sorts, order)
+	}
+	bestAxis, bestMargin := 0, math.Inf(1)
+	for axis := 0; axis < 2; axis++ {
+		m := 0.0
+		for _, order := range sorts[axis*2 : axis*2+2] {
+			for k := min; k <= len(rects)-min; k++ {
+				m += margin(union(rects, order[:k])) + margin(union(rects, order[k:]))
+			}
+		}
+		if m < bestMargin {
+			bestAxis, bestMargin = axis, m
+		}
+	}
+	var left, right []int
+	bestOverlap, bestArea := math.Inf(1), math.Inf(1)
+	for _, order := range sorts[bestAxis*2 : bestAxis*2+2] {
+		for k := min; k <= len(rects)-min; k++ {
+			l, r := union(rects, order[:k]), union(rects, order[k:])
+			o, a := overlap(l, r), area(l)+area(r)
+			if o < bestOverlap || o == bestOverlap && a < bestArea {
+				left, right, bestOverlap, bestArea = order[:k], order[k:], o, a
+			}
+		}
+	}
+	return left, right
+}
+
+// Split moves some of the entries of an overflowing node into a new sibling which is returned.
+func (n *Node) Split(min int) *Node {
+	left, right := ChooseSplit(n.Entries(), min)
+	sibling := &Node{Leaf: n.Leaf}
+	if n.Leaf {
+		points := n.Points
+		n.Points = make([]*shared.Point, 0, len(left))
+		for _, i := range left {
+			n.Points = append(n.Points, points[i])
+		}
+		for _, i := range right {
+			sibling.Points = append(sibling.Points, points[i])
+		}
+	} else {
+		children := n.Children
+		n.Children = make([]*Node, 0, len(left))
+		for _, i := range left {
+			n.Children = append(n.Children, children[i])
+		}
+		for _, i := range right {
+			sibling.Children = append(sibling.Children, children[i])
+		}
+	}
+	n.Recalculate()
+	sibling.Recalculate()
+	return sibling
+}
+
+// Insert adds p into the subtree, returning a new sibling if the node had to be split.
+func (n *Node) Insert(p *shared.Point, env image.Rectangle, m *Struct) *Node {
+	if n.Len() == 0 {
+		n.Bounds = env
+	} else {
+		n.Bounds = n.Bounds.Union(env)
+	}
+	if n.Leaf {
+		n.Points = append(n.Points, p)
+	} else if sibling := n.ChooseSubtree(env).Insert(p, env, m); sibling != nil {
+		n.Children = append(n.Children, sibling)
+	}
+	if n.Len() > m.MaxEntries {
+		return n.Split(m.MinEntries)
+	}
+	return nil
+}
+
+// Clone returns a copy of the tree below n, copying its points with points.
+func (n *Node) Clone(points shared.PointCloner) *Node {
+	if n == nil {
+		return nil
+	}
+	c := &Node{
+		Bounds: n.Bounds,
+		Leaf:   n.Leaf,
+		Points: points.CloneAll(n.Points),
+	}
+	if n.Children != nil {
+		c.Children = make([]*Node, len(n.Children))
+		for i, child := range n.Children {
+			c.Children[i] = child.Clone(points)
+		}
+	}
+	return c
+}
+
+// Walk calls f for the node and all its children.
+func (n *Node) Walk(f func(n *Node)) {
+	f(n)
+	for _, c := range n.Children {
+		c.Walk(f)
+	}
+}
+
+// Visit calls f for every leaf whose bounds overlap r.
+func (n *Node) Visit(r image.Rectangle, f func(n *Node)) {
+	if !n.Bounds.Overlaps(r) {
+		return
+	}
+	if n.Leaf {
+		f(n)
+	}
+	for _, c := range n.Children {
+		c.Visit(r, f)
+	}
+}
+
+// VisitSegment calls f for every leaf whose bounds the line from x0, y0 to x1, y1 passes through.
+func (n *Node) VisitSegment(x0, y0, x1, y1 int, f func(n *Node)) {
+	if !shared.SegmentOverlaps(n.Bounds, x0, y0, x1, y1) {
+		return
+	}
+	if n.Leaf {
+		f(n)
+	}
+	for _, c := range n.Children {
+		c.VisitSegment(x0, y0, x1, y1, f)
+	}
+}
+
+// Remove takes every point of shape out of leaves overlapping env. Nodes left with fewer than min entries are
+// dropped with their points returned as orphans for reinsertion.
+func (n *Node) Remove(shape shared.Shape, env image.Rectangle, min int) (removed bool, orphans []*shared.Point) {
+	if !n.Bounds.Overlaps(env) {
+		return false, nil
+	}
+	if n.Leaf {
+		points := n.Points[:0]
+		for _, p := range n.Points {
+			if p.Shape != shape {
+				points = append(points, p)
+			}
+		}
+		removed = len(points) != len(n.Points)
+		for i := len(points); i < len(n.Points); i++ {
+			n.Points[i] = nil
+		}
+		n.Points = points
+	} else {
+		children := n.Children[:0]
+		for _, c := range n.Children {
+			r, o := c.Remove(shape, env, min)
+			removed = removed || r
+			orphans = append(orphans, o...)
+			if r && c.Len() < min {
+				c.Walk(func(cn *Node) {
+					orphans = append(orphans, cn.Points...)
+				})
+				continue
+			}
+			children = append(children, c)
+		}
+		for i := len(children); i < len(n.Children); i++ {
+			n.Children[i] = nil
+		}
+		n.Children = children
+	}
+	if removed {
+		n.Recalculate()
+	}
+	return removed, orphans
+}
+
+// Chunks divides length into as few nearly equal parts of no more than size as it can, returning where each ends.
+func Chunks(length, size int) []int {
+	count := (length + size - 1) / size
+	ends := make([]int, count)
+	for i := range ends {
+		ends[i] = length * (i + 1) / count
+	}
+	return ends
+}
+
+// STR packs entries into parents of up to max entries using Sort-Tile-Recursive: entries are sorted into vertical
+// slices by the centre of their x axis and each slice is packed in order of the centre of its y axis. Slices and
+// parents are kept as even as possible so none fall below the minimum.
+func STR(nodes []*Node, max int) []*Node {
+	leaves := (len(nodes) + max - 1) / max
+	slices := int(math.Ceil(math.Sqrt(float64(leaves))))
+	centre := func(n *Node) image.Point {
+		return n.Bounds.Min.Add(n.Bounds.Max)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return centre(nodes[i]).X < centre(nodes[j]).X
+	})
+	var parents []*Node
+	start := 0
+	for _, end := range Chunks(len(nodes), slices*max) {
+		slice := nodes[start:end]
+		start = end
+		sort.SliceStable(slice, func(i, j int) bool {
+			return centre(slice[i]).Y < centre(slice[j]).Y
+		})
+		i := 0
+		for _, j := range Chunks(len(slice), max) {
+			parent := &Node{Children: append([]*Node{}, slice[i:j]...)}
+			parent.Recalculate()
+			parents = append(parents, parent)
+			i = j
+		}
+	}
+	return parents
+}
+
+// BulkLoad rebuilds the tree from its existing points and points using Sort-Tile-Recursive packing, which produces
+// a far better tree than inserting one at a time.
+func (m *Struct) BulkLoad(points ...*shared.Point) {
+	for _, p := range points {
+		m.members.Add(p.Shape)
+	}
+	if m.Root != nil {
+		var existing []*shared.Point
+		m.Root.Walk(func(n *Node) {
+			existing = append(existing, n.Points...)
+		})
+		points = append(existing, points...)
+	}
+	if len(points) == 0 {
+		m.Root = nil
+		return
+	}
+	nodes := make([]*Node, len(points))
+	for i, p := range points {
+		nodes[i] = &Node{Bounds: Envelope(p.Bounds()), Points: []*shared.Point{p}}
+	}
+	nodes = STR(nodes, m.MaxEntries)
+	for _, n := range nodes {
+		n.Leaf = true
+		n.Points = make([]*shared.Point, 0, len(n.Children))
+		for _, c := range n.Children {
+			n.Points = append(n.Points, c.Points...)
+		}
+		n.Children = nil
+	}
+	for len(nodes) > 1 {
+		nodes = STR(nodes, m.MaxEntries)
+	}
+	m.Root = nodes[0]
+}
+
+// AddAll bulk loads shapes rather than adding them one at a time.
+func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
+	points := make([]*shared.Point, 0, len(shapes))
+	for _, shape := range shapes {
+		m.Sequence++
+		points = append(points, &shared.Point{
+			Shape: shape,
+			Order: m.Sequence,
+		})
+	}
+	m.BulkLoad(points...)
+	return m
+}
+
+func (m *Struct) Add(shape shared.Shape, zIndex int) {
+	m.Sequence++
+	m.insert(&shared.Point{
+		Shape:  shape,
+		ZIndex: zIndex,
+		Order:  m.Sequence,
+	}, shape.Bounds())
+	m.members.Add(shape)
+}
+
+func (m *Struct) insert(p *shared.Point, b image.Rectangle) {
+	if m.Root == nil {
+		m.Root = &Node{Leaf: true}
+	}
+	if sibling := m.Root.Insert(p, Envelope(b), m); sibling != nil {
+		root := &Node{Children: []*Node{m.Root, sibling}}
+		root.Recalculate()
+		m.Root = root
+	}
+}
+
+func (m *Struct) Remove(shape shared.Shape) {
+	m.remove(shape, shape.Bounds())
+	m.members.Remove(shape)
+}
+
+// remove takes shape, which was added with the bounds b, out of the tree.
+func (m *Struct) remove(shape shared.Shape, b image.Rectangle) {
+	if m.Root == nil {
+		return
+	}
+	removed, orphans := m.Root.Remove(shape, Envelope(b), m.MinEntries)
+	if !removed {
+		return
+	}
+	for !m.Root.Leaf && len(m.Root.Children) == 1 {
+		m.Root = m.Root.Children[0]
+	}
+	if m.Root.Len() == 0 {
+		m.Root = nil
+	}
+	for _, p := range orphans {
+		m.insert(p, p.Bounds())
+	}
+}
+
+// FindPoint returns the point for shape which was added with the bounds b.
+func (m *Struct) FindPoint(shape shared.Shape, b image.Rectangle) (found *shared.Point) {
+	if m.Root == nil {
+		return nil
+	}
+	m.Root.Visit(Envelope(b), func(n *Node) {
+		for _, p := range n.Points {
+			if found == nil && p.Shape == shape {
+				found = p
+			}
+		}
+	})
+	return found
+}
+
+// FindPoints returns the point for each time shape was added with the bounds b, in no particular order.
+func (m *Struct) FindPoints(shape shared.Shape, b image.Rectangle) (points []*shared.Point) {
+	if m.Root == nil {
+		return nil
+	}
+	m.Root.Visit(Envelope(b), func(n *Node) {
+		for _, p := range n.Points {
+			if p.Shape == shape {
+				points = append(points, p)
+			}
+		}
+	})
+	return points
+}
+
+func (m *Struct) GetStackAt(x int, y int) []shared.Shape {
+	return m.AppendStackAt([]shared.Shape{}, x, y)
+}
+
+// VisitStackAt calls f with each shape at x, y and its z-index, topmost first, until f returns false.
+func (m *Struct) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	if m.Root == nil {
+		return
+	}
+	shared.VisitStack(func(buf []*shared.Point) []*shared.Point {
+		m.Root.Visit(image.Rect(x, y, x+1, y+1), func(n *Node) {
+			for _, p := range n.Points {
+				if p.PointIn(x, y) {
+					buf = append(buf, p)
+				}
+			}
+		})
+		return buf
+	}, f)
+}
+
+// AppendStackAt appends the shapes at x, y to dst, topmost first, and returns the extended slice.
+func (m *Struct) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		dst = append(dst, shape)
+		return true
+	})
+	return dst
+}
+
+func (m *Struct) GetAt(x int, y int) (top shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		top = shape
+		return false
+	})
+	return top
+}
+
+func (m *Struct) GetBottomAt(x int, y int) (bottom shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		bottom = shape
+		return true
+	})
+	return bottom
+}
+
+// Len returns the number of shapes.
+func (m *Struct) Len() int {
+	return m.members.Len()
+}
+
+// Contains reports if shape has been added and not removed.
+func (m *Struct) Contains(shape shared.Shape) bool {
+	return m.members.Contains(shape)
+}
+
+// All returns every shape, topmost first.
+func (m *Struct) All() []shared.Shape {
+	return shared.PointArray(m.allPoints()).Shapes()
+}
+
+// allPoints returns the point of every shape, topmost first.
+func (m *Struct) allPoints() []*shared.Point {
+	var points []*shared.Point
+	if m.Root != nil {
+		m.Root.Walk(func(n *Node) {
+			if n.Leaf {
+				points = append(points, n.Points...)
+			}
+		})
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	return points
+}
+
+// Bounds returns the smallest rectangle covering every shape, shapes with empty bounds are ignored. The root's bounds
+// include the envelopes of empty shapes so every shape is checked.
+func (m *Struct) Bounds() (r image.Rectangle) {
+	if m.Root != nil {
+		m.Root.Walk(func(n *Node) {
+			if n.Leaf {
+				for _, p := range n.Points {
+					if b := p.Bounds(); !b.Empty() {
+						r = r.Union(b)
+					}
+				}
+			}
+		})
+	}
+	return r
+}
+
+// Clear removes every shape.
+func (m *Struct) Clear() {
+	m.Root = nil
+	m.Sequence = 0
+	m.members.Clear()
+}
+
+// Clone returns a copy which can be changed independently of m. The shapes themselves are shared.
+func (m *Struct) Clone() *Struct {
+	return &Struct{
+		Root:       m.Root.Clone(shared.PointCloner{}),
+		MaxEntries: m.MaxEntries,
+		MinEntries: m.MinEntries,
+		Sequence:   m.Sequence,
+		members:    m.members.Clone(),
+	}
+}
+
+// MarshalJSON encodes every shape with its z-index, the shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalJSON() ([]byte, error) {
+	return shared.MarshalShapes(shared.PointArray(m.allPoints()).ZShapes())
+}
+
+// UnmarshalJSON replaces the shapes of a map created with New with those encoded by MarshalJSON, stacked as they
+// were. Options given to New are kept.
+func (m *Struct) UnmarshalJSON(data []byte) error {
+	shapes, err := shared.UnmarshalShapes(data)
+	if err != nil {
+		return err
+	}
+	m.Clear()
+	for i := len(shapes) - 1; i >= 0; i-- {
+		m.Add(shapes[i].Shape, shapes[i].ZIndex)
+	}
+	return nil
+}
+
+func (m *Struct) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	return shared.PointArray(m.pointsIn(r, mode)).Shapes()
+}
+
+// GetZStackIn is GetStackIn with the z-index of each shape.
+func (m *Struct) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	return shared.PointArray(m.pointsIn(r, mode)).ZShapes()
+}
+
+// GetZStackAt is GetStackAt with the z-index of each shape.
+func (m *Struct) GetZStackAt(x, y int) []shared.ZShape {
+	result := []shared.ZShape{}
+	m.VisitStackAt(x, y, func(shape shared.Shape, zIndex int) bool {
+		result = append(result, shared.ZShape{Shape: shape, ZIndex: zIndex})
+		return true
+	})
+	return result
+}
+
+// pointsIn returns the points of the shapes matching r, topmost first.
+func (m *Struct) pointsIn(r image.Rectangle, mode shared.Containment) []*shared.Point {
+	var found []*shared.Point
+	if m.Root != nil && !r.Empty() {
+		m.Root.Visit(r, func(n *Node) {
+			for _, p := range n.Points {
+				if mode.Match(p.Bounds(), r) {
+					found = append(found, p)
+				}
+			}
+		})
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	return found
+}
+
+// Nearest returns the shape nearest to x, y, or nil when there are none.
+func (m *Struct) Nearest(x, y int) shared.Shape {
+	if s := m.KNearest(x, y, 1, math.Inf(1)); len(s) > 0 {
+		return s[0]
+	}
+	return nil
+}
+
+// KNearest returns up to k shapes no further than maxDistance from x, y, nearest first. Only the nodes around the point are searched.
+func (m *Struct) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	return shared.KNearest(x, y, k, maxDistance, m.extent(), func(r image.Rectangle) []shared.Shape {
+		return m.GetStackIn(r, shared.Intersects)
+	})
+}
+
+// SegmentCast returns the shapes crossed by the line from x0, y0 to x1, y1 in order of first contact. Only the shapes
+// in the leafs along the line are checked.
+func (m *Struct) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	var found []*shared.Point
+	if m.Root != nil {
+		m.Root.VisitSegment(x0, y0, x1, y1, func(n *Node) {
+			for _, p := range n.Points {
+				if shared.SegmentOverlaps(p.Bounds(), x0, y0, x1, y1) {
+					found = append(found, p)
+				}
+			}
+		})
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	candidates := make([]shared.Shape, 0, len(found))
+	for _, p := range found {
+		candidates = append(candidates, p.Shape)
+	}
+	return shared.Cast(x0, y0, x1, y1, candidates)
+}
+
+// RayCast returns the shapes crossed by a ray from x, y in the direction dx, dy, no further than maxDistance which can
+// be +Inf, in order of first contact.
+func (m *Struct) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	return shared.RayCast(x, y, dx, dy, maxDistance, m.extent(), m.SegmentCast)
+}
+
+// extent returns the bounds of the root node, it is empty when there are no shapes.
+func (m *Struct) extent() image.Rectangle {
+	if m.Root == nil {
+		return image.Rectangle{}
+	}
+	return m.Root.Bounds
+}
+
+// Update moves shape from oldBounds to its current bounds.
+func (m *Struct) Update(shape shared.Shape, oldBounds image.Rectangle) {
+	b := shape.Bounds()
+	if b == oldBounds {
+		return
+	}
+	points := m.FindPoints(shape, oldBounds)
+	if len(points) == 0 {
+		return
+	}
+	m.remove(shape, oldBounds)
+	for _, p := range points {
+		m.insert(p, b)
+	}
+}
+
+func (m *Struct) Move(shape shared.Resizable, bounds image.Rectangle) {
+	oldBounds := shape.Bounds()
+	shape.SetBounds(bounds)
+	m.Update(shape, oldBounds)
+}
+
+// ZIndexOf returns the z-index of shape, or of its topmost copy when it was added more than once.
+func (m *Struct) ZIndexOf(shape shared.Shape) (int, bool) {
+	if p := shared.PointArray(m.FindPoints(shape, shape.Bounds())).Top(); p != nil {
+		return p.ZIndex, true
+	}
+	return 0, false
+}
+
+// SetZIndex changes the z-index of each of the shape's points, keeping the order of copies of a shape added more
+// than once. Leaves aren't kept in order so nothing needs to move.
+func (m *Struct) SetZIndex(shape shared.Shape, zIndex int) {
+	points := m.FindPoints(shape, shape.Bounds())
+	sort.Sort(shared.ZSort(points))
+	for _, p := range points {
+		m.Sequence++
+		p.ZIndex = zIndex
+		p.Order = m.Sequence
+	}
+}
+
+// BringToFront restacks shape above every other shape.
+func (m *Struct) BringToFront(shape shared.Shape) {
+	shared.BringToFront(m, shape)
+}
+
+// SendToBack restacks shape below every other shape.
+func (m *Struct) SendToBack(shape shared.Shape) {
+	shared.SendToBack(m, shape)
+}
+
+// PlaceAbove restacks shape directly above other, even if that lowers it, leaving the order of the other shapes
+// unchanged.
+func (m *Struct) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	shared.PlaceAbove(m, shape, other)
+}
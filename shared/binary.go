@@ -0,0 +1,307 @@
+package shared
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+)
+
+var (
+	// ErrCorrupt is returned when decoding binary data which is truncated, has been changed since it was encoded or
+	// wasn't encoded by a BinaryEncoder.
+	ErrCorrupt = errors.New("shared: binary data is corrupt")
+	// ErrVersion is returned when decoding binary data encoded for another format, or another version of it.
+	ErrVersion = errors.New("shared: binary data has an unsupported format or version")
+)
+
+// binaryMagic starts all binary data, followed by the version of the layout described by BinaryEncoder.Encode.
+const (
+	binaryMagic   = "SMAP"
+	binaryLayout  = 1
+	checksumBytes = 4
+)
+
+// BinaryEncoder builds the binary form of a map's index. Numbers are written as varints and shapes as references
+// into a table which is written ahead of them, so a shape found in many places in the index is only stored once.
+type BinaryEncoder struct {
+	body   []byte
+	index  map[Shape]int
+	shapes []Shape
+}
+
+func NewBinaryEncoder() *BinaryEncoder {
+	return &BinaryEncoder{
+		index: map[Shape]int{},
+	}
+}
+
+// Int writes v.
+func (e *BinaryEncoder) Int(v int) {
+	e.body = appendVarint(e.body, v)
+}
+
+// Shape writes a reference to s, adding it to the table of shapes the first time.
+func (e *BinaryEncoder) Shape(s Shape) {
+	i, ok := e.index[s]
+	if !ok {
+		i = len(e.shapes)
+		e.index[s] = i
+		e.shapes = append(e.shapes, s)
+	}
+	e.Int(i)
+}
+
+// Encode returns everything written, marked as version of format and followed by a checksum. Each shape is stored
+// with its kind, as its MarshalBinary method encodes it or as JSON when it has none, so every shape must be registered
+// with RegisterShape.
+func (e *BinaryEncoder) Encode(format string, version int) ([]byte, error) {
+	b := append([]byte(binaryMagic), binaryLayout)
+	b = appendString(b, format)
+	b = appendVarint(b, version)
+	b = appendVarint(b, len(e.shapes))
+	for _, s := range e.shapes {
+		kind, ok := ShapeKind(s)
+		if !ok {
+			return nil, fmt.Errorf("shared: shape %s of type %T is not registered", s, s)
+		}
+		var data []byte
+		var err error
+		if bm, ok := s.(encoding.BinaryMarshaler); ok {
+			data, err = bm.MarshalBinary()
+		} else {
+			data, err = json.Marshal(s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("shared: encoding shape %s: %w", s, err)
+		}
+		b = appendString(b, kind)
+		b = appendString(b, string(data))
+	}
+	b = append(b, e.body...)
+	var checksum [checksumBytes]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(b))
+	return append(b, checksum[:]...), nil
+}
+
+// BinaryDecoder reads what a BinaryEncoder wrote, in the same order. Once anything is wrong every method returns
+// zero values and Finish returns the error, so values can be read without checking each one.
+type BinaryDecoder struct {
+	r      binaryReader
+	shapes []Shape
+}
+
+// NewBinaryDecoder checks data is intact and was encoded as version of format, then decodes its table of shapes.
+func NewBinaryDecoder(data []byte, format string, version int) (*BinaryDecoder, error) {
+	if len(data) < len(binaryMagic)+1+checksumBytes || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, fmt.Errorf("%w: not binary map data", ErrCorrupt)
+	}
+	body, checksum := data[:len(data)-checksumBytes], data[len(data)-checksumBytes:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	if layout := body[len(binaryMagic)]; layout != binaryLayout {
+		return nil, fmt.Errorf("%w: layout %d", ErrVersion, layout)
+	}
+	d := &BinaryDecoder{r: binaryReader{data: body[len(binaryMagic)+1:]}}
+	gotFormat, gotVersion := d.r.string(), d.r.int()
+	if d.r.err != nil {
+		return nil, d.r.err
+	}
+	if gotFormat != format || gotVersion != version {
+		return nil, fmt.Errorf("%w: %s version %d, want %s version %d", ErrVersion, gotFormat, gotVersion, format, version)
+	}
+	d.shapes = make([]Shape, d.r.len())
+	for i := range d.shapes {
+		kind, data := d.r.string(), d.r.string()
+		if d.r.err != nil {
+			return nil, d.r.err
+		}
+		shapeKinds.RLock()
+		newShape, ok := shapeKinds.newShapes[kind]
+		shapeKinds.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("shared: shape %d has unregistered kind %q", i, kind)
+		}
+		s := newShape()
+		var err error
+		if bu, ok := s.(encoding.BinaryUnmarshaler); ok {
+			err = bu.UnmarshalBinary([]byte(data))
+		} else {
+			err = json.Unmarshal([]byte(data), s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("shared: decoding shape %d of kind %s: %w", i, kind, err)
+		}
+		d.shapes[i] = s
+	}
+	return d, nil
+}
+
+// Int reads a number written by BinaryEncoder.Int.
+func (d *BinaryDecoder) Int() int {
+	return d.r.int()
+}
+
+// Len reads the length of something which follows, which must be non-negative and no more than the bytes left, as
+// every element takes at least one.
+func (d *BinaryDecoder) Len() int {
+	return d.r.len()
+}
+
+// Index reads a number which must be from 0 up to n.
+func (d *BinaryDecoder) Index(n int) int {
+	i := d.r.int()
+	if d.r.err == nil && (i < 0 || i >= n) {
+		d.r.fail("index %d out of range %d", i, n)
+		return 0
+	}
+	return i
+}
+
+// Shape reads a reference written by BinaryEncoder.Shape and returns the shape it refers to.
+func (d *BinaryDecoder) Shape() Shape {
+	i := d.Index(len(d.shapes))
+	if d.r.err != nil {
+		return nil
+	}
+	return d.shapes[i]
+}
+
+// Finish returns the first error found while reading, or an error when some of the data wasn't read.
+func (d *BinaryDecoder) Finish() error {
+	return d.r.finish()
+}
+
+// binaryReader reads varints and strings, after the first error it only returns zero values.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: "+format, append([]interface{}{ErrCorrupt}, args...)...)
+	}
+	r.data = nil
+}
+
+// finish returns the first error, or an error when some of the data wasn't read.
+func (r *binaryReader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.fail("%d bytes left over", len(r.data))
+	}
+	return r.err
+}
+
+func (r *binaryReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 || int64(int(v)) != v {
+		r.fail("bad number")
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(v)
+}
+
+func (r *binaryReader) len() int {
+	n := r.int()
+	if r.err == nil && (n < 0 || n > len(r.data)) {
+		r.fail("length %d out of range %d", n, len(r.data))
+		return 0
+	}
+	return n
+}
+
+func (r *binaryReader) string() string {
+	n := r.len()
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binaryReader) point() image.Point {
+	return image.Point{X: r.int(), Y: r.int()}
+}
+
+func appendVarint(b []byte, v int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], int64(v))]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendVarint(b, len(s)), s...)
+}
+
+func appendPoint(b []byte, p image.Point) []byte {
+	return appendVarint(appendVarint(b, p.X), p.Y)
+}
+
+// MarshalBinary encodes the rectangle compactly for BinaryEncoder.
+func (r Rectangle) MarshalBinary() ([]byte, error) {
+	return appendString(appendPoint(appendPoint(nil, r.Min), r.Max), r.Name), nil
+}
+
+// UnmarshalBinary decodes a rectangle encoded by MarshalBinary.
+func (r *Rectangle) UnmarshalBinary(data []byte) error {
+	br := binaryReader{data: data}
+	r.Min, r.Max, r.Name = br.point(), br.point(), br.string()
+	return br.finish()
+}
+
+// MarshalBinary encodes the circle compactly for BinaryEncoder.
+func (c Circle) MarshalBinary() ([]byte, error) {
+	return appendString(appendVarint(appendPoint(nil, c.Center), c.Radius), c.Name), nil
+}
+
+// UnmarshalBinary decodes a circle encoded by MarshalBinary.
+func (c *Circle) UnmarshalBinary(data []byte) error {
+	br := binaryReader{data: data}
+	c.Center, c.Radius, c.Name = br.point(), br.int(), br.string()
+	return br.finish()
+}
+
+// MarshalBinary encodes the ellipse compactly for BinaryEncoder.
+func (e Ellipse) MarshalBinary() ([]byte, error) {
+	return appendString(appendPoint(appendPoint(nil, e.Center), e.Radii), e.Name), nil
+}
+
+// UnmarshalBinary decodes an ellipse encoded by MarshalBinary.
+func (e *Ellipse) UnmarshalBinary(data []byte) error {
+	br := binaryReader{data: data}
+	e.Center, e.Radii, e.Name = br.point(), br.point(), br.string()
+	return br.finish()
+}
+
+// MarshalBinary encodes the polygon compactly for BinaryEncoder.
+func (p Polygon) MarshalBinary() ([]byte, error) {
+	b := appendVarint(appendVarint(nil, int(p.FillRule)), len(p.Rings))
+	for _, ring := range p.Rings {
+		b = appendVarint(b, len(ring))
+		for _, v := range ring {
+			b = appendPoint(b, v)
+		}
+	}
+	return appendString(b, p.Name), nil
+}
+
+// UnmarshalBinary decodes a polygon encoded by MarshalBinary.
+func (p *Polygon) UnmarshalBinary(data []byte) error {
+	br := binaryReader{data: data}
+	p.FillRule = FillRule(br.int())
+	p.Rings = make([]Ring, br.len())
+	for i := range p.Rings {
+		p.Rings[i] = make(Ring, br.len())
+		for j := range p.Rings[i] {
+			p.Rings[i][j] = br.point()
+		}
+	}
+	p.Name = br.string()
+	return br.finish()
+}
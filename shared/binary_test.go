@@ -0,0 +1,105 @@
+package shared
+
+import (
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBinaryEncoder(t *testing.T) {
+	shapes := []Shape{
+		NewRectangle(-1, 2, 3, 4, Name("r")),
+		NewCircle(5, 6, 7, Name("c")),
+		NewEllipse(5, 6, 7, 8),
+		NewPolygon([]image.Point{{0, 0}, {9, 0}, {0, 9}}, Ring{{1, 1}, {2, 1}, {1, 2}}, NonZero, Name("p")),
+		&Cross{Center: image.Pt(-3, 4), Arm: 2},
+	}
+	e := NewBinaryEncoder()
+	e.Int(len(shapes))
+	for i, s := range shapes {
+		e.Shape(s)
+		e.Int(-i)
+		e.Shape(s)
+	}
+	data, err := e.Encode("test", 3)
+	if err != nil {
+		t.Fatalf("Encode() error %v", err)
+	}
+	d, err := NewBinaryDecoder(data, "test", 3)
+	if err != nil {
+		t.Fatalf("NewBinaryDecoder() error %v", err)
+	}
+	got := make([]Shape, d.Len())
+	for i := range got {
+		got[i] = d.Shape()
+		if z := d.Int(); z != -i {
+			t.Errorf("Int() = %d want %d", z, -i)
+		}
+		if again := d.Shape(); again != got[i] {
+			t.Errorf("Shape() = %s want the same %s as before", again, got[i])
+		}
+	}
+	if err := d.Finish(); err != nil {
+		t.Errorf("Finish() error %v", err)
+	}
+	if diff := cmp.Diff(got, shapes); diff != "" {
+		t.Errorf("decoded shapes = \n%s", diff)
+	}
+}
+
+func TestBinaryDecoder_Errors(t *testing.T) {
+	e := NewBinaryEncoder()
+	e.Shape(NewRectangle(0, 0, 1, 1))
+	e.Int(2)
+	data, err := e.Encode("test", 1)
+	if err != nil {
+		t.Fatalf("Encode() error %v", err)
+	}
+	for _, test := range []struct {
+		Name    string
+		Data    []byte
+		Format  string
+		Version int
+		Want    error
+	}{
+		{Name: "Empty", Data: nil, Format: "test", Version: 1, Want: ErrCorrupt},
+		{Name: "Truncated", Data: data[:len(data)-1], Format: "test", Version: 1, Want: ErrCorrupt},
+		{Name: "Changed", Data: append(append([]byte(nil), data[:10]...), append([]byte{data[10] + 1}, data[11:]...)...), Format: "test", Version: 1, Want: ErrCorrupt},
+		{Name: "Other format", Data: data, Format: "other", Version: 1, Want: ErrVersion},
+		{Name: "Other version", Data: data, Format: "test", Version: 2, Want: ErrVersion},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			if _, err := NewBinaryDecoder(test.Data, test.Format, test.Version); !errors.Is(err, test.Want) {
+				t.Errorf("NewBinaryDecoder() = %v want %v", err, test.Want)
+			}
+		})
+	}
+	t.Run("Out of range", func(t *testing.T) {
+		d, err := NewBinaryDecoder(data, "test", 1)
+		if err != nil {
+			t.Fatalf("NewBinaryDecoder() error %v", err)
+		}
+		d.Shape()
+		if i := d.Index(2); i != 0 {
+			t.Errorf("Index(2) = %d want 0", i)
+		}
+		if s := d.Shape(); s != nil {
+			t.Errorf("Shape() after an error = %s want nil", s)
+		}
+		if err := d.Finish(); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Finish() = %v want %v", err, ErrCorrupt)
+		}
+	})
+	t.Run("Left over", func(t *testing.T) {
+		d, err := NewBinaryDecoder(data, "test", 1)
+		if err != nil {
+			t.Fatalf("NewBinaryDecoder() error %v", err)
+		}
+		d.Shape()
+		if err := d.Finish(); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Finish() = %v want %v", err, ErrCorrupt)
+		}
+	})
+}
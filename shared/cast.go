@@ -0,0 +1,346 @@
+package shared
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// Hit is a shape crossed by a cast. Point is the first pixel of the shape the line passes through and Distance how
+// far along the line that pixel is entered.
+type Hit struct {
+	Shape    Shape
+	Point    image.Point
+	Distance float64
+}
+
+// SegmentOverlaps reports if the line between the centres of the pixels x0, y0 and x1, y1 touches the area covered by
+// b, including its edges. Coordinates are doubled so the test is exact.
+func SegmentOverlaps(b image.Rectangle, x0, y0, x1, y1 int) bool {
+	if b.Empty() {
+		return false
+	}
+	ax, ay, bx, by := int64(x0)*2+1, int64(y0)*2+1, int64(x1)*2+1, int64(y1)*2+1
+	minX, minY, maxX, maxY := int64(b.Min.X)*2, int64(b.Min.Y)*2, int64(b.Max.X)*2, int64(b.Max.Y)*2
+	if ax < minX && bx < minX || ax > maxX && bx > maxX || ay < minY && by < minY || ay > maxY && by > maxY {
+		return false
+	}
+	// The line misses the area only when every corner is on the same side of it.
+	sides := 0
+	for _, c := range [][2]int64{{minX, minY}, {maxX, minY}, {minX, maxY}, {maxX, maxY}} {
+		sides |= 1 << (cmpProducts(bx-ax, c[1]-ay, c[0]-ax, by-ay) + 1)
+	}
+	return sides != 1 && sides != 4
+}
+
+// CoverSegment calls f with rectangles which together cover every pixel a cast from x0, y0 to x1, y1 passes through.
+// The line is halved until fine reports the rectangle around a part is small enough or the part is only a couple of
+// pixels long. The rectangles can overlap and include pixels the line doesn't pass through.
+func CoverSegment(x0, y0, x1, y1 int, fine func(r image.Rectangle) bool, f func(r image.Rectangle)) {
+	var cover func(ax, ay, bx, by float64)
+	cover = func(ax, ay, bx, by float64) {
+		r := image.Rect(
+			int(math.Floor(math.Min(ax, bx)))-1, int(math.Floor(math.Min(ay, by)))-1,
+			int(math.Floor(math.Max(ax, bx)))+2, int(math.Floor(math.Max(ay, by)))+2,
+		)
+		if math.Hypot(bx-ax, by-ay) <= 2 || fine(r) {
+			f(r)
+			return
+		}
+		mx, my := (ax+bx)/2, (ay+by)/2
+		cover(ax, ay, mx, my)
+		cover(mx, my, bx, by)
+	}
+	cover(float64(x0)+0.5, float64(y0)+0.5, float64(x1)+0.5, float64(y1)+0.5)
+}
+
+// walkSegment calls f, until it returns false, with every pixel the line between the centres of the pixels x0, y0
+// and x1, y1 passes through in order, and how far along the line the pixel is entered. When the line passes exactly
+// through the corner of a pixel the pixels either side of the corner are visited before the one beyond it.
+func walkSegment(x0, y0, x1, y1 int, f func(x, y int, distance float64) bool) {
+	steps := int64(abs(x1 - x0))
+	if dy := int64(abs(y1 - y0)); dy > steps {
+		steps = dy
+	}
+	walkSpans(x0, y0, x1, y1, []span{{0, steps}}, f)
+}
+
+// span is a run of steps along the major axis of a line, the axis it moves furthest along. Step n is every pixel n
+// pixels from the start along that axis.
+type span struct {
+	First, Last int64
+}
+
+// walkSpans is walkSegment visiting only the pixels in spans, which must be in order and not overlap. The walk jumps
+// over the gaps between them, so it costs the length of the spans rather than the line.
+func walkSpans(x0, y0, x1, y1 int, spans []span, f func(x, y int, distance float64) bool) {
+	sx, sy := 1, 1
+	if x1 < x0 {
+		sx = -1
+	}
+	if y1 < y0 {
+		sy = -1
+	}
+	ax, ay := int64(abs(x1-x0)), int64(abs(y1-y0))
+	// Distances are measured in steps of the line with the common factor of ax and ay removed, so every line in the
+	// same direction gives the same distances to the same pixels.
+	g := gcd(ax, ay)
+	var xStep, yStep float64
+	if ax > 0 {
+		xStep = math.Hypot(float64(ax/g), float64(ay/g)) / float64(2*ax/g)
+	}
+	if ay > 0 {
+		yStep = math.Hypot(float64(ax/g), float64(ay/g)) / float64(2*ay/g)
+	}
+	// The line crosses its i'th vertical pixel edge at (2i+1)/2ax of its length and its j'th horizontal edge at
+	// (2j+1)/2ay.
+	var i, j int64
+	xMajor := ax >= ay
+	major := func() int64 {
+		if xMajor {
+			return i
+		}
+		return j
+	}
+	for n, s := range spans {
+		if jump := s.First - 1; n == 0 || jump > major() {
+			// Every edge crossed before the major axis edge into step jump+1 is skipped. The pixels of step jump after
+			// that are visited but those before it may not be, so they are outside the span.
+			if jump > 0 {
+				if xMajor {
+					i, j = jump, clampSteps(ceilDiv((2*jump+1)*ay-ax, 2*ax), ay)
+				} else {
+					i, j = clampSteps(ceilDiv((2*jump+1)*ax-ay, 2*ay), ax), jump
+				}
+			}
+			d := 0.0
+			switch {
+			case i > 0 && (j == 0 || cmpProducts(2*i-1, ay, 2*j-1, ax) >= 0):
+				d = float64(2*i-1) * xStep
+			case j > 0:
+				d = float64(2*j-1) * yStep
+			}
+			if !f(x0+sx*int(i), y0+sy*int(j), d) {
+				return
+			}
+		}
+		for i < ax || j < ay {
+			var next int
+			switch {
+			case i == ax:
+				next = 1
+			case j == ay:
+				next = -1
+			default:
+				next = cmpProducts(2*i+1, ay, 2*j+1, ax)
+			}
+			if major() >= s.Last && (xMajor && next <= 0 || !xMajor && next >= 0) {
+				break
+			}
+			x, y := x0+sx*int(i), y0+sy*int(j)
+			switch {
+			case next < 0:
+				i++
+				if !f(x+sx, y, float64(2*i-1)*xStep) {
+					return
+				}
+			case next > 0:
+				j++
+				if !f(x, y+sy, float64(2*j-1)*yStep) {
+					return
+				}
+			default:
+				i++
+				j++
+				d := float64(2*i-1) * xStep
+				if !f(x+sx, y, d) || !f(x, y+sy, d) || !f(x+sx, y+sy, d) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ceilDiv divides a by the positive b rounding up.
+func ceilDiv(a, b int64) int64 {
+	q := a / b
+	if a%b > 0 {
+		q++
+	}
+	return q
+}
+
+func clampSteps(v, n int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	if v > n {
+		return n
+	}
+	return v
+}
+
+// stepsWithin returns the first and last steps, of the n a line takes from v0 in the direction s, at which it is
+// between the pixels min and max inclusive. ok is false when it never is.
+func stepsWithin(v0, s int, n int64, min, max int) (first, last int64, ok bool) {
+	first, last = int64(min-v0)*int64(s), int64(max-v0)*int64(s)
+	if s < 0 {
+		first, last = last, first
+	}
+	if first > n || last < 0 || first > last {
+		return 0, 0, false
+	}
+	return clampSteps(first, n), clampSteps(last, n), true
+}
+
+// segmentSpan returns the steps of the line between the centres of the pixels x0, y0 and x1, y1 which can pass
+// through b, measured along its major axis. The steps at which the line is in the rows of b are widened to the steps
+// along the major axis which can be taken in them.
+func segmentSpan(b image.Rectangle, x0, y0, x1, y1 int) (span, bool) {
+	sx, sy := 1, 1
+	if x1 < x0 {
+		sx = -1
+	}
+	if y1 < y0 {
+		sy = -1
+	}
+	ax, ay := int64(abs(x1-x0)), int64(abs(y1-y0))
+	xFirst, xLast, xOK := stepsWithin(x0, sx, ax, b.Min.X, b.Max.X-1)
+	yFirst, yLast, yOK := stepsWithin(y0, sy, ay, b.Min.Y, b.Max.Y-1)
+	if !xOK || !yOK {
+		return span{}, false
+	}
+	major, minor := span{xFirst, xLast}, span{yFirst, yLast}
+	if ay > ax {
+		major, minor = minor, major
+		ax, ay = ay, ax
+	}
+	if ay > 0 {
+		// The major axis step at the point along the line where the minor axis is at step m is within a half of
+		// m*ax/ay, and the pixels of step m run between half a step each side of that point.
+		first := int64(math.Floor(float64((2*minor.First-1)*ax)/float64(2*ay))) - 1
+		last := int64(math.Ceil(float64((2*minor.Last+1)*ax)/float64(2*ay))) + 1
+		if first > major.First {
+			major.First = first
+		}
+		if last < major.Last {
+			major.Last = last
+		}
+	}
+	if major.First > major.Last {
+		return span{}, false
+	}
+	// A pixel of the last step can be the one after a corner, visited as the line moves into the next step.
+	major.Last++
+	return major, true
+}
+
+// Cast returns a Hit for each of candidates the line between the centres of the pixels x0, y0 and x1, y1 passes
+// through, in order of first contact. candidates must be in stacking order, topmost first, which is kept for shapes
+// first entered at the same pixel. Only the pixels of the line which are within the bounds of a candidate are
+// walked, so a cast costs the length of the line through them rather than the whole line.
+func Cast(x0, y0, x1, y1 int, candidates []Shape) []Hit {
+	hits := []Hit{}
+	var shapes []Shape
+	var bounds []image.Rectangle
+	var spans []span
+	seen := map[Shape]struct{}{}
+	for _, s := range candidates {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		b := s.Bounds()
+		if !SegmentOverlaps(b, x0, y0, x1, y1) {
+			continue
+		}
+		if sp, ok := segmentSpan(b, x0, y0, x1, y1); ok {
+			shapes = append(shapes, s)
+			bounds = append(bounds, b)
+			spans = append(spans, sp)
+		}
+	}
+	if len(shapes) == 0 {
+		return hits
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].First < spans[j].First
+	})
+	merged := spans[:1]
+	for _, sp := range spans[1:] {
+		if last := &merged[len(merged)-1]; sp.First <= last.Last+1 {
+			if sp.Last > last.Last {
+				last.Last = sp.Last
+			}
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	hit := make([]bool, len(shapes))
+	walkSpans(x0, y0, x1, y1, merged, func(x, y int, distance float64) bool {
+		p := image.Pt(x, y)
+		for i, s := range shapes {
+			if !hit[i] && p.In(bounds[i]) && s.PointIn(x, y) {
+				hit[i] = true
+				hits = append(hits, Hit{Shape: s, Point: p, Distance: distance})
+			}
+		}
+		return len(hits) < len(shapes)
+	})
+	return hits
+}
+
+// RayPrecision is how many pixels across the direction of a ray is rounded to.
+const RayPrecision = 1024
+
+// RayCast casts a ray from the pixel x, y in the direction dx, dy for maxDistance, which can be +Inf, using
+// segmentCast to cast the line to a pixel beyond the end of the ray. extent must cover every shape, the ray is cut
+// short once it has left it. The direction is rounded to a whole number of pixels, up to RayPrecision, so the same
+// pixels are followed however far the line is cast.
+func RayCast(x, y int, dx, dy, maxDistance float64, extent image.Rectangle, segmentCast func(x0, y0, x1, y1 int) []Hit) []Hit {
+	l := math.Max(math.Abs(dx), math.Abs(dy))
+	if extent.Empty() || maxDistance < 0 || math.IsNaN(l) || math.IsInf(l, 0) {
+		return []Hit{}
+	}
+	if l == 0 {
+		return segmentCast(x, y, x, y)
+	}
+	sx, sy := int64(math.Round(dx/l*RayPrecision)), int64(math.Round(dy/l*RayPrecision))
+	g := gcd(abs64(sx), abs64(sy))
+	sx, sy = sx/g, sy/g
+	length := maxDistance
+	px, py := float64(x)+0.5, float64(y)+0.5
+	far := 0.0
+	for _, c := range []image.Point{extent.Min, extent.Max, {extent.Min.X, extent.Max.Y}, {extent.Max.X, extent.Min.Y}} {
+		far = math.Max(far, math.Hypot(float64(c.X)-px, float64(c.Y)-py))
+	}
+	if far+1 < length {
+		length = far + 1
+	}
+	n := int64(math.Ceil(length / math.Hypot(float64(sx), float64(sy))))
+	hits := segmentCast(x, y, x+int(n*sx), y+int(n*sy))
+	result := hits[:0]
+	for _, h := range hits {
+		if h.Distance <= maxDistance {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return 1
+	}
+	return a
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
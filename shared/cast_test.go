@@ -0,0 +1,191 @@
+package shared
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWalkSegment(t *testing.T) {
+	type step struct {
+		P image.Point
+		D float64
+	}
+	for _, test := range []struct {
+		Name           string
+		X0, Y0, X1, Y1 int
+		Want           []step
+	}{
+		{"Point", 3, 4, 3, 4, []step{{image.Pt(3, 4), 0}}},
+		{"Horizontal", 0, 0, 3, 0, []step{{image.Pt(0, 0), 0}, {image.Pt(1, 0), 0.5}, {image.Pt(2, 0), 1.5}, {image.Pt(3, 0), 2.5}}},
+		{"Up", 0, 0, 0, -2, []step{{image.Pt(0, 0), 0}, {image.Pt(0, -1), 0.5}, {image.Pt(0, -2), 1.5}}},
+		{"Diagonal", 0, 0, 2, 2, []step{
+			{image.Pt(0, 0), 0},
+			{image.Pt(1, 0), math.Sqrt2 / 2}, {image.Pt(0, 1), math.Sqrt2 / 2}, {image.Pt(1, 1), math.Sqrt2 / 2},
+			{image.Pt(2, 1), math.Sqrt2 * 3 / 2}, {image.Pt(1, 2), math.Sqrt2 * 3 / 2}, {image.Pt(2, 2), math.Sqrt2 * 3 / 2},
+		}},
+		{"Shallow", 0, 0, 4, -1, []step{
+			{image.Pt(0, 0), 0}, {image.Pt(1, 0), math.Hypot(4, 1) / 8}, {image.Pt(2, 0), math.Hypot(4, 1) * 3 / 8},
+			{image.Pt(2, -1), math.Hypot(4, 1) / 2}, {image.Pt(3, -1), math.Hypot(4, 1) * 5 / 8}, {image.Pt(4, -1), math.Hypot(4, 1) * 7 / 8},
+		}},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			var got []step
+			walkSegment(test.X0, test.Y0, test.X1, test.Y1, func(x, y int, d float64) bool {
+				got = append(got, step{image.Pt(x, y), d})
+				return true
+			})
+			if diff := cmp.Diff(test.Want, got, cmp.Comparer(func(a, b float64) bool { return math.Abs(a-b) < 1e-9 })); diff != "" {
+				t.Errorf("walkSegment diff: %s", diff)
+			}
+		})
+	}
+}
+
+// TestWalkSegmentCover checks the pixels walked are exactly those SegmentOverlaps reports the line touches, in order
+// of distance.
+func TestWalkSegmentCover(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		x0, y0, x1, y1 := r.Intn(21)-10, r.Intn(21)-10, r.Intn(21)-10, r.Intn(21)-10
+		walked := map[image.Point]bool{}
+		last := 0.0
+		walkSegment(x0, y0, x1, y1, func(x, y int, d float64) bool {
+			if walked[image.Pt(x, y)] {
+				t.Errorf("(%d, %d)-(%d, %d) walked (%d, %d) twice", x0, y0, x1, y1, x, y)
+			}
+			if d < last {
+				t.Errorf("(%d, %d)-(%d, %d) walked (%d, %d) at %v after %v", x0, y0, x1, y1, x, y, d, last)
+			}
+			walked[image.Pt(x, y)] = true
+			last = d
+			return true
+		})
+		for y := -12; y <= 12; y++ {
+			for x := -12; x <= 12; x++ {
+				if touches := SegmentOverlaps(image.Rect(x, y, x+1, y+1), x0, y0, x1, y1); touches != walked[image.Pt(x, y)] {
+					t.Errorf("(%d, %d)-(%d, %d) walked (%d, %d) = %v but SegmentOverlaps = %v", x0, y0, x1, y1, x, y, walked[image.Pt(x, y)], touches)
+				}
+			}
+		}
+	}
+}
+
+func TestSegmentOverlaps(t *testing.T) {
+	b := image.Rect(10, 10, 20, 20)
+	for _, test := range []struct {
+		Name           string
+		X0, Y0, X1, Y1 int
+		Want           bool
+	}{
+		{"Through", 0, 15, 30, 15, true},
+		{"Inside", 12, 12, 13, 17, true},
+		{"Short", 0, 15, 8, 15, false},
+		{"Stops short of edge", 0, 15, 9, 15, false},
+		{"Reaches edge", 0, 15, 10, 15, true},
+		{"Touches min corner", 9, 10, 10, 9, true},
+		{"Beside", 0, 20, 30, 20, false},
+		{"Diagonal miss", 0, 25, 20, 45, false},
+		{"Touches max corner", 19, 20, 20, 19, true},
+		{"Misses corner", 19, 21, 21, 19, false},
+		{"Empty", 15, 15, 15, 15, true},
+	} {
+		if got := SegmentOverlaps(b, test.X0, test.Y0, test.X1, test.Y1); got != test.Want {
+			t.Errorf("%s: SegmentOverlaps(%s, %d, %d, %d, %d) = %v want %v", test.Name, b, test.X0, test.Y0, test.X1, test.Y1, got, test.Want)
+		}
+	}
+	if SegmentOverlaps(image.Rect(10, 10, 10, 20), 0, 15, 30, 15) {
+		t.Errorf("SegmentOverlaps of an empty rectangle = true")
+	}
+}
+
+func TestCast(t *testing.T) {
+	wall := NewRectangle(10, 0, 12, 20, Name("wall"))
+	floor := NewRectangle(0, 5, 40, 6, Name("floor"))
+	circle := NewCircle(30, 5, 3, Name("circle"))
+	hidden := NewRectangle(10, 0, 12, 20, Name("hidden"))
+	got := Cast(0, 5, 40, 5, []Shape{hidden, circle, wall, floor, wall})
+	want := []Hit{
+		{Shape: floor, Point: image.Pt(0, 5), Distance: 0},
+		{Shape: hidden, Point: image.Pt(10, 5), Distance: 9.5},
+		{Shape: wall, Point: image.Pt(10, 5), Distance: 9.5},
+		{Shape: circle, Point: image.Pt(27, 5), Distance: 26.5},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Cast diff: %s", diff)
+	}
+	if got := Cast(0, 0, 5, 0, []Shape{wall}); len(got) != 0 {
+		t.Errorf("Cast missing everything = %v", got)
+	}
+}
+
+// TestCastSpans checks casting only the spans of the line within the bounds of the candidates finds the same hits as
+// walking the whole line.
+func TestCastSpans(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		var shapes []Shape
+		for n := r.Intn(4) + 1; n > 0; n-- {
+			x, y := r.Intn(60)-30, r.Intn(60)-30
+			switch r.Intn(3) {
+			case 0:
+				shapes = append(shapes, NewRectangle(x, y, x+r.Intn(12), y+r.Intn(12)))
+			case 1:
+				shapes = append(shapes, NewCircle(x, y, r.Intn(8)))
+			default:
+				shapes = append(shapes, NewEllipse(x, y, r.Intn(9), r.Intn(5)))
+			}
+		}
+		x0, y0, x1, y1 := r.Intn(400)-200, r.Intn(80)-40, r.Intn(80)-40, r.Intn(400)-200
+		want := []Hit{}
+		hit := map[Shape]bool{}
+		walkSegment(x0, y0, x1, y1, func(x, y int, d float64) bool {
+			for _, s := range shapes {
+				if !hit[s] && s.PointIn(x, y) {
+					hit[s] = true
+					want = append(want, Hit{Shape: s, Point: image.Pt(x, y), Distance: d})
+				}
+			}
+			return true
+		})
+		if diff := cmp.Diff(want, Cast(x0, y0, x1, y1, shapes)); diff != "" {
+			t.Fatalf("Cast(%d, %d, %d, %d, %v) diff: %s", x0, y0, x1, y1, shapes, diff)
+		}
+	}
+}
+
+func TestRayCast(t *testing.T) {
+	wall := NewRectangle(10, 0, 12, 20, Name("wall"))
+	far := NewRectangle(50, 0, 52, 20, Name("far"))
+	extent := image.Rect(0, 0, 52, 20)
+	segmentCast := func(x0, y0, x1, y1 int) []Hit {
+		return Cast(x0, y0, x1, y1, []Shape{wall, far})
+	}
+	for _, test := range []struct {
+		Name        string
+		DX, DY      float64
+		MaxDistance float64
+		Want        []Shape
+	}{
+		{"Unlimited", 1, 0, math.Inf(1), []Shape{wall, far}},
+		{"Limited", 2, 0, 20, []Shape{wall}},
+		{"Exactly", 1, 0, 9.5, []Shape{wall}},
+		{"Short", 1, 0, 9, nil},
+		{"Away", -1, 0, math.Inf(1), nil},
+		{"No direction", 0, 0, math.Inf(1), nil},
+	} {
+		var got []Shape
+		for _, h := range RayCast(0, 10, test.DX, test.DY, test.MaxDistance, extent, segmentCast) {
+			got = append(got, h.Shape)
+		}
+		if diff := cmp.Diff(test.Want, got); diff != "" {
+			t.Errorf("%s: RayCast diff: %s", test.Name, diff)
+		}
+	}
+	if got := RayCast(0, 10, 1, 0, math.Inf(1), image.Rectangle{}, segmentCast); len(got) != 0 {
+		t.Errorf("RayCast with an empty extent = %v", got)
+	}
+}
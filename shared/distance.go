@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// Distancer is implemented by shapes which can measure how far a pixel is from them. Distance returns the distance
+// from the centre of the pixel at x, y to the nearest edge of the shape, 0 when the pixel is within it, and +Inf
+// when the shape is empty. It must never be less than the distance to the shape's bounds.
+type Distancer interface {
+	Distance(x, y int) float64
+}
+
+// Distance returns how far the pixel at x, y is from s. Shapes which aren't a Distancer are measured by their bounds.
+func Distance(s Shape, x, y int) float64 {
+	if d, ok := s.(Distancer); ok {
+		return d.Distance(x, y)
+	}
+	if s.PointIn(x, y) {
+		return 0
+	}
+	return boxDistance(s.Bounds(), x, y)
+}
+
+// boxDistance returns the distance from the centre of the pixel at x, y to the area covered by b.
+func boxDistance(b image.Rectangle, x, y int) float64 {
+	if b.Empty() {
+		return math.Inf(1)
+	}
+	px, py := float64(x)+0.5, float64(y)+0.5
+	dx := math.Max(math.Max(float64(b.Min.X)-px, px-float64(b.Max.X)), 0)
+	dy := math.Max(math.Max(float64(b.Min.Y)-py, py-float64(b.Max.Y)), 0)
+	return math.Hypot(dx, dy)
+}
+
+// segmentDistance returns the distance from p to the line segment a to b.
+func segmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/l))
+	}
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+// ellipseDistance returns the distance from p to the edge of the ellipse with the radii rx and ry centred on the
+// origin, 0 when p is inside. The nearest point to a point outside an ellipse is in the same quadrant and the
+// distance only falls then rises along that quarter, so it is found with a ternary search.
+func ellipseDistance(px, py, rx, ry float64) float64 {
+	px, py = math.Abs(px), math.Abs(py)
+	if (px/rx)*(px/rx)+(py/ry)*(py/ry) <= 1 {
+		return 0
+	}
+	at := func(t float64) float64 {
+		return math.Hypot(px-rx*math.Cos(t), py-ry*math.Sin(t))
+	}
+	lo, hi := 0.0, math.Pi/2
+	for i := 0; i < 100; i++ {
+		a, b := lo+(hi-lo)/3, hi-(hi-lo)/3
+		if at(a) < at(b) {
+			hi = b
+		} else {
+			lo = a
+		}
+	}
+	return at((lo + hi) / 2)
+}
+
+// Nearby is a shape found by KNearest and its Distance from the point searched.
+type Nearby struct {
+	Shape    Shape
+	Distance float64
+}
+
+// KNearest returns up to k shapes no further than maxDistance from the pixel at x, y, nearest first. It searches
+// windows of growing size around the point. query must return the shapes whose bounds intersect a window in stacking
+// order, topmost first, which is kept for shapes at the same distance. extent is the area covering every shape, once
+// a window covers it the search stops.
+func KNearest(x, y, k int, maxDistance float64, extent image.Rectangle, query func(r image.Rectangle) []Shape) []Shape {
+	if k <= 0 || extent.Empty() {
+		return []Shape{}
+	}
+	for r := 1; ; r *= 2 {
+		window := image.Rect(x-r, y-r, x+r+1, y+r+1)
+		found := ByDistance(query(window), x, y, maxDistance)
+		// Every shape outside of the window is more than r away.
+		if len(found) >= k && found[k-1].Distance <= float64(r) || float64(r) >= maxDistance || extent.In(window) {
+			if len(found) > k {
+				found = found[:k]
+			}
+			result := make([]Shape, 0, len(found))
+			for _, n := range found {
+				result = append(result, n.Shape)
+			}
+			return result
+		}
+	}
+}
+
+// ByDistance returns the shapes no further than maxDistance from the pixel at x, y sorted nearest first, keeping the
+// order of shapes at the same distance. Empty shapes are never included.
+func ByDistance(shapes []Shape, x, y int, maxDistance float64) []Nearby {
+	found := make([]Nearby, 0, len(shapes))
+	for _, s := range shapes {
+		if d := Distance(s, x, y); d <= maxDistance && !math.IsInf(d, 1) {
+			found = append(found, Nearby{Shape: s, Distance: d})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Distance < found[j].Distance
+	})
+	return found
+}
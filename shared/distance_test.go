@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	frame := NewPolygon([]image.Point{{0, 0}, {40, 0}, {40, 40}, {0, 40}}, Ring{{10, 10}, {30, 10}, {30, 30}, {10, 30}})
+	for _, test := range []struct {
+		Name  string
+		Shape Shape
+		X, Y  int
+		Want  float64
+	}{
+		{"Rectangle inside", NewRectangle(10, 10, 20, 20), 15, 15, 0},
+		{"Rectangle right edge", NewRectangle(10, 10, 20, 20), 20, 15, 0.5},
+		{"Rectangle left edge", NewRectangle(10, 10, 20, 20), 9, 15, 0.5},
+		{"Rectangle right", NewRectangle(10, 10, 20, 20), 25, 15, 5.5},
+		{"Rectangle corner", NewRectangle(10, 10, 20, 20), 22, 22, math.Hypot(2.5, 2.5)},
+		{"Empty rectangle", NewRectangle(10, 10, 10, 20), 10, 15, math.Inf(1)},
+		{"Circle inside", NewCircle(10, 10, 5), 13, 14, 0},
+		{"Circle right", NewCircle(10, 10, 5), 16, 10, 1},
+		{"Circle above", NewCircle(10, 10, 5), 10, 0, 5},
+		{"Circle corner", NewCircle(10, 10, 5), 14, 14, math.Hypot(4, 4) - 5},
+		{"Negative radius circle", NewCircle(10, 10, -1), 10, 10, math.Inf(1)},
+		{"Ellipse right", NewEllipse(0, 0, 10, 4), 12, 0, 2},
+		{"Ellipse above", NewEllipse(0, 0, 10, 4), 0, -7, 3},
+		{"Flat ellipse end", NewEllipse(0, 0, 3, 0), 5, 0, 2},
+		{"Flat ellipse side", NewEllipse(0, 0, 3, 0), 0, 2, 2},
+		{"Triangle vertex", NewPolygon([]image.Point{{0, 0}, {10, 0}, {0, 10}}), 12, 0, math.Hypot(2.5, 0.5)},
+		{"Polygon hole", frame, 20, 20, 9.5},
+		{"Polygon outside", frame, 45, 20, 5.5},
+		{"Flat polygon", NewPolygon([]image.Point{{0, 0}, {10, 0}, {5, 0}}), 5, 0, math.Inf(1)},
+		{"Empty polygon", NewPolygon(nil), 0, 0, math.Inf(1)},
+		{"Not a Distancer", struct{ Shape }{NewCircle(10, 10, 5)}, 20, 10, 4.5},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			got := Distance(test.Shape, test.X, test.Y)
+			if math.IsInf(test.Want, 1) && !math.IsInf(got, 1) || math.Abs(got-test.Want) > 1e-6 {
+				t.Errorf("Distance(%s, %d, %d) = %v want %v", test.Shape, test.X, test.Y, got, test.Want)
+			}
+		})
+	}
+}
+
+// TestDistanceBounds checks Distance is 0 when the pixel is in the shape and never less than the distance to the
+// bounds, which KNearest relies on. A pixel centred on an edge is 0 away even when it isn't in the shape.
+func TestDistanceBounds(t *testing.T) {
+	for _, s := range []Shape{
+		NewRectangle(-3, 2, 9, 7),
+		NewCircle(5, 5, 7),
+		NewCircle(0, 0, 0),
+		NewEllipse(3, -2, 9, 4),
+		NewEllipse(3, -2, 0, 4),
+		NewPolygon([]image.Point{{0, 0}, {10, 3}, {2, 12}, {6, 4}}),
+		NewPolygon([]image.Point{{0, 0}, {12, 0}, {0, 12}, {12, 12}}, NonZero),
+		NewPolygon([]image.Point{{0, 0}, {10, 0}, {5, 0}}),
+	} {
+		b := s.Bounds()
+		for y := b.Min.Y - 5; y < b.Max.Y+5; y++ {
+			for x := b.Min.X - 5; x < b.Max.X+5; x++ {
+				d := Distance(s, x, y)
+				if s.PointIn(x, y) && d != 0 {
+					t.Errorf("Distance(%s, %d, %d) = %v inside the shape", s, x, y, d)
+				}
+				if bd := boxDistance(b, x, y); d < bd-1e-9 {
+					t.Errorf("Distance(%s, %d, %d) = %v less than the bounds %v", s, x, y, d, bd)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package shared
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// Circle is every pixel whose distance from Center is no more than Radius.
+type Circle struct {
+	Center image.Point
+	Radius int
+	Name   string
+}
+
+func (c Circle) String() string {
+	var n string
+	if len(c.Name) > 0 {
+		n = c.Name + ":"
+	}
+	return n + "Circle(" + c.Center.String() + ", r:" + strconv.Itoa(c.Radius) + ")"
+}
+
+func (c Circle) PointIn(x, y int) bool {
+	if c.Radius < 0 {
+		return false
+	}
+	return inEllipse(x-c.Center.X, y-c.Center.Y, c.Radius, c.Radius)
+}
+
+func (c Circle) Bounds() image.Rectangle {
+	return ellipseBounds(c.Center, c.Radius, c.Radius)
+}
+
+// SetBounds fits the largest circle into b, centred in b.
+func (c *Circle) SetBounds(b image.Rectangle) {
+	d := b.Dx()
+	if b.Dy() < d {
+		d = b.Dy()
+	}
+	c.Center = image.Pt(b.Min.X+(b.Dx()-1)/2, b.Min.Y+(b.Dy()-1)/2)
+	c.Radius = (d - 1) / 2
+}
+
+// Distance measures from the centre of the pixel to the circle of Radius around the centre of the Center pixel, the
+// same circle PointIn uses.
+func (c Circle) Distance(x, y int) float64 {
+	if c.Radius < 0 {
+		return math.Inf(1)
+	}
+	if c.PointIn(x, y) {
+		return 0
+	}
+	return math.Hypot(float64(x-c.Center.X), float64(y-c.Center.Y)) - float64(c.Radius)
+}
+
+var _ Shape = (*Circle)(nil)
+var _ Resizable = (*Circle)(nil)
+var _ Distancer = (*Circle)(nil)
+
+func NewCircle(x, y, radius int, ops ...Op) *Circle {
+	c := &Circle{
+		Center: image.Point{
+			X: x,
+			Y: y,
+		},
+		Radius: radius,
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case Name:
+			c.Name = string(op)
+		}
+	}
+	return c
+}
+
+// Ellipse is every pixel inside the axis aligned ellipse around Center with the radii Radii.X and Radii.Y.
+type Ellipse struct {
+	Center image.Point
+	Radii  image.Point
+	Name   string
+}
+
+func (e Ellipse) String() string {
+	var n string
+	if len(e.Name) > 0 {
+		n = e.Name + ":"
+	}
+	return n + "Ellipse(" + e.Center.String() + ", r:" + e.Radii.String() + ")"
+}
+
+func (e Ellipse) PointIn(x, y int) bool {
+	if e.Radii.X < 0 || e.Radii.Y < 0 {
+		return false
+	}
+	return inEllipse(x-e.Center.X, y-e.Center.Y, e.Radii.X, e.Radii.Y)
+}
+
+func (e Ellipse) Bounds() image.Rectangle {
+	return ellipseBounds(e.Center, e.Radii.X, e.Radii.Y)
+}
+
+// SetBounds fits the ellipse to b.
+func (e *Ellipse) SetBounds(b image.Rectangle) {
+	e.Center = image.Pt(b.Min.X+(b.Dx()-1)/2, b.Min.Y+(b.Dy()-1)/2)
+	e.Radii = image.Pt((b.Dx()-1)/2, (b.Dy()-1)/2)
+}
+
+// Distance measures from the centre of the pixel to the ellipse around the centre of the Center pixel which PointIn
+// uses. With a radius of 0 the ellipse is a line.
+func (e Ellipse) Distance(x, y int) float64 {
+	if e.Radii.X < 0 || e.Radii.Y < 0 {
+		return math.Inf(1)
+	}
+	if e.PointIn(x, y) {
+		return 0
+	}
+	dx, dy, rx, ry := float64(x-e.Center.X), float64(y-e.Center.Y), float64(e.Radii.X), float64(e.Radii.Y)
+	if rx == 0 || ry == 0 {
+		return segmentDistance(dx, dy, -rx, -ry, rx, ry)
+	}
+	return ellipseDistance(dx, dy, rx, ry)
+}
+
+var _ Shape = (*Ellipse)(nil)
+var _ Resizable = (*Ellipse)(nil)
+var _ Distancer = (*Ellipse)(nil)
+
+func NewEllipse(x, y, radiusX, radiusY int, ops ...Op) *Ellipse {
+	e := &Ellipse{
+		Center: image.Point{
+			X: x,
+			Y: y,
+		},
+		Radii: image.Point{
+			X: radiusX,
+			Y: radiusY,
+		},
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case Name:
+			e.Name = string(op)
+		}
+	}
+	return e
+}
+
+func ellipseBounds(c image.Point, rx, ry int) image.Rectangle {
+	if rx < 0 || ry < 0 {
+		return image.Rectangle{Min: c, Max: c}
+	}
+	return image.Rect(c.X-rx, c.Y-ry, c.X+rx+1, c.Y+ry+1)
+}
+
+// inEllipse reports if dx*dx*ry*ry + dy*dy*rx*rx <= rx*rx*ry*ry, using 128 bit arithmetic so it is exact for any
+// offsets and radii that fit in 32 bits.
+func inEllipse(dx, dy, rx, ry int) bool {
+	if rx == 0 || ry == 0 {
+		return abs(dx) <= rx && abs(dy) <= ry
+	}
+	sq := func(v int) uint64 {
+		a := uint64(abs(v))
+		return a * a
+	}
+	ah, al := bits.Mul64(sq(dx), sq(ry))
+	bh, bl := bits.Mul64(sq(dy), sq(rx))
+	ch, cl := bits.Mul64(sq(rx), sq(ry))
+	sl, carry := bits.Add64(al, bl, 0)
+	sh, overflow := bits.Add64(ah, bh, carry)
+	if overflow != 0 {
+		return false
+	}
+	return sh < ch || sh == ch && sl <= cl
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
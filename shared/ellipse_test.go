@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"image"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEllipse_PointIn(t *testing.T) {
+	for _, test := range []struct {
+		Name  string
+		Shape Shape
+		In    []image.Point
+		Out   []image.Point
+	}{
+		{
+			Name:  "Circle",
+			Shape: NewCircle(10, 10, 5),
+			In:    []image.Point{{10, 10}, {15, 10}, {10, 5}, {5, 10}, {10, 15}, {13, 14}, {14, 13}},
+			Out:   []image.Point{{16, 10}, {14, 14}, {5, 5}, {15, 15}, {6, 6}},
+		},
+		{
+			Name:  "Zero radius circle",
+			Shape: NewCircle(1, 2, 0),
+			In:    []image.Point{{1, 2}},
+			Out:   []image.Point{{0, 2}, {2, 2}, {1, 1}, {1, 3}},
+		},
+		{
+			Name:  "Negative radius circle",
+			Shape: NewCircle(1, 2, -1),
+			Out:   []image.Point{{1, 2}},
+		},
+		{
+			Name:  "Ellipse",
+			Shape: NewEllipse(0, 0, 10, 4),
+			In:    []image.Point{{10, 0}, {-10, 0}, {0, 4}, {0, -4}, {8, 2}},
+			Out:   []image.Point{{11, 0}, {0, 5}, {10, 1}, {9, 2}, {-10, -4}},
+		},
+		{
+			Name:  "Flat ellipse",
+			Shape: NewEllipse(0, 0, 3, 0),
+			In:    []image.Point{{-3, 0}, {0, 0}, {3, 0}},
+			Out:   []image.Point{{4, 0}, {0, 1}, {0, -1}},
+		},
+		{
+			Name:  "Huge ellipse",
+			Shape: NewEllipse(0, 0, 1<<30, 1<<29),
+			In:    []image.Point{{1 << 30, 0}, {0, -1 << 29}},
+			Out:   []image.Point{{1<<30 + 1, 0}, {1 << 30, 1}, {1 << 29, 1 << 29}},
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			for _, p := range test.In {
+				if !test.Shape.PointIn(p.X, p.Y) {
+					t.Errorf("%s.PointIn(%d, %d) = false", test.Shape, p.X, p.Y)
+				}
+			}
+			for _, p := range test.Out {
+				if test.Shape.PointIn(p.X, p.Y) {
+					t.Errorf("%s.PointIn(%d, %d) = true", test.Shape, p.X, p.Y)
+				}
+			}
+		})
+	}
+}
+
+func TestEllipse_Bounds(t *testing.T) {
+	for _, shape := range []Resizable{
+		NewCircle(10, 10, 5),
+		NewCircle(-3, 7, 0),
+		NewEllipse(0, 0, 10, 4),
+		NewEllipse(-20, 5, 0, 3),
+	} {
+		b := shape.Bounds()
+		for y := b.Min.Y - 1; y <= b.Max.Y; y++ {
+			for x := b.Min.X - 1; x <= b.Max.X; x++ {
+				if shape.PointIn(x, y) && !image.Pt(x, y).In(b) {
+					t.Errorf("%s.PointIn(%d, %d) is outside of the bounds %s", shape, x, y, b)
+				}
+			}
+		}
+		mid := b.Min.Add(image.Pt(b.Dx()/2, b.Dy()/2))
+		for _, p := range []image.Point{{b.Min.X, mid.Y}, {b.Max.X - 1, mid.Y}, {mid.X, b.Min.Y}, {mid.X, b.Max.Y - 1}} {
+			if !shape.PointIn(p.X, p.Y) {
+				t.Errorf("%s bounds %s are not tight at %s", shape, b, p)
+			}
+		}
+		shape.SetBounds(b)
+		if diff := cmp.Diff(shape.Bounds(), b); diff != "" {
+			t.Errorf("%s.SetBounds(%s) = \n%s", shape, b, diff)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// shapeKinds maps the kinds registered with RegisterShape to the functions creating them, and the types of those shapes
+// back to their kinds.
+var shapeKinds = struct {
+	sync.RWMutex
+	newShapes map[string]func() Shape
+	kinds     map[reflect.Type]string
+}{
+	newShapes: map[string]func() Shape{},
+	kinds:     map[reflect.Type]string{},
+}
+
+func init() {
+	RegisterShape("Rectangle", func() Shape { return &Rectangle{} })
+	RegisterShape("Circle", func() Shape { return &Circle{} })
+	RegisterShape("Ellipse", func() Shape { return &Ellipse{} })
+	RegisterShape("Polygon", func() Shape { return &Polygon{} })
+}
+
+// RegisterShape makes the shapes of the type newShape returns encodable, recording them as kind. newShape must return a
+// new empty shape, usually a pointer, which encoding/json can decode into. The built in shapes are registered already.
+// Registering a kind or a type twice panics.
+func RegisterShape(kind string, newShape func() Shape) {
+	t := reflect.TypeOf(newShape())
+	shapeKinds.Lock()
+	defer shapeKinds.Unlock()
+	if _, ok := shapeKinds.newShapes[kind]; ok {
+		panic("shared: shape kind " + kind + " registered twice")
+	}
+	if k, ok := shapeKinds.kinds[t]; ok {
+		panic("shared: shape type " + t.String() + " already registered as " + k)
+	}
+	shapeKinds.newShapes[kind] = newShape
+	shapeKinds.kinds[t] = kind
+}
+
+// ShapeKind returns the kind shape was registered as. A shape which isn't a pointer has the kind of a pointer to it,
+// so it decodes as that pointer.
+func ShapeKind(shape Shape) (string, bool) {
+	t := reflect.TypeOf(shape)
+	shapeKinds.RLock()
+	defer shapeKinds.RUnlock()
+	k, ok := shapeKinds.kinds[t]
+	if !ok && t != nil && t.Kind() != reflect.Ptr {
+		k, ok = shapeKinds.kinds[reflect.PtrTo(t)]
+	}
+	return k, ok
+}
+
+// encodedShapes is the JSON form of the shapes of a map.
+type encodedShapes struct {
+	Shapes []encodedShape `json:"shapes"`
+}
+
+type encodedShape struct {
+	Kind   string          `json:"kind"`
+	ZIndex int             `json:"zIndex"`
+	Shape  json.RawMessage `json:"shape"`
+}
+
+// MarshalShapes encodes shapes, given topmost first as All returns them, as JSON along with their kinds and z-indexes.
+// Every shape must have been registered with RegisterShape.
+func MarshalShapes(shapes []ZShape) ([]byte, error) {
+	e := encodedShapes{Shapes: make([]encodedShape, 0, len(shapes))}
+	for _, zs := range shapes {
+		kind, ok := ShapeKind(zs.Shape)
+		if !ok {
+			return nil, fmt.Errorf("shared: shape %s of type %T is not registered", zs.Shape, zs.Shape)
+		}
+		b, err := json.Marshal(zs.Shape)
+		if err != nil {
+			return nil, fmt.Errorf("shared: encoding shape %s: %w", zs.Shape, err)
+		}
+		e.Shapes = append(e.Shapes, encodedShape{Kind: kind, ZIndex: zs.ZIndex, Shape: b})
+	}
+	return json.Marshal(e)
+}
+
+// UnmarshalShapes decodes shapes encoded by MarshalShapes, topmost first. Adding them to a map in reverse order
+// stacks them as they were.
+func UnmarshalShapes(data []byte) ([]ZShape, error) {
+	var e encodedShapes
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	shapes := make([]ZShape, 0, len(e.Shapes))
+	for i, es := range e.Shapes {
+		shapeKinds.RLock()
+		newShape, ok := shapeKinds.newShapes[es.Kind]
+		shapeKinds.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("shared: shape %d has unregistered kind %q", i, es.Kind)
+		}
+		s := newShape()
+		if err := json.Unmarshal(es.Shape, s); err != nil {
+			return nil, fmt.Errorf("shared: decoding shape %d of kind %s: %w", i, es.Kind, err)
+		}
+		shapes = append(shapes, ZShape{Shape: s, ZIndex: es.ZIndex})
+	}
+	return shapes, nil
+}
@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"image"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Cross is a user defined shape, a plus sign of Arm pixels either side of Center.
+type Cross struct {
+	Center image.Point
+	Arm    int
+}
+
+func (c *Cross) PointIn(x, y int) bool {
+	dx, dy := abs(x-c.Center.X), abs(y-c.Center.Y)
+	return dx == 0 && dy <= c.Arm || dy == 0 && dx <= c.Arm
+}
+
+func (c *Cross) Bounds() image.Rectangle {
+	return image.Rect(c.Center.X-c.Arm, c.Center.Y-c.Arm, c.Center.X+c.Arm+1, c.Center.Y+c.Arm+1)
+}
+
+func (c *Cross) String() string {
+	return "Cross(" + c.Center.String() + ")"
+}
+
+func init() {
+	RegisterShape("Cross", func() Shape { return &Cross{} })
+}
+
+func TestMarshalShapes(t *testing.T) {
+	shapes := []ZShape{
+		{Shape: NewRectangle(1, 2, 3, 4, Name("r")), ZIndex: 3},
+		{Shape: NewCircle(5, 6, 7, Name("c")), ZIndex: 2},
+		{Shape: NewEllipse(5, 6, 7, 8), ZIndex: 2},
+		{Shape: NewPolygon([]image.Point{{0, 0}, {9, 0}, {0, 9}}, Ring{{1, 1}, {2, 1}, {1, 2}}, NonZero, Name("p")), ZIndex: 1},
+		{Shape: &Cross{Center: image.Pt(-3, 4), Arm: 2}, ZIndex: -1},
+	}
+	data, err := MarshalShapes(shapes)
+	if err != nil {
+		t.Fatalf("MarshalShapes() error %v", err)
+	}
+	got, err := UnmarshalShapes(data)
+	if err != nil {
+		t.Fatalf("UnmarshalShapes(%s) error %v", data, err)
+	}
+	if diff := cmp.Diff(got, shapes); diff != "" {
+		t.Errorf("UnmarshalShapes(%s) = \n%s", data, diff)
+	}
+}
+
+func TestMarshalShapes_Errors(t *testing.T) {
+	if _, err := MarshalShapes([]ZShape{{Shape: unregisteredShape{}}}); err == nil {
+		t.Errorf("MarshalShapes() of an unregistered shape gave no error")
+	}
+	for _, data := range []string{
+		`{"shapes":[{"kind":"Triangle","zIndex":0,"shape":{}}]}`,
+		`{"shapes":[{"kind":"Rectangle","zIndex":0,"shape":[]}]}`,
+		`{"shapes":`,
+	} {
+		if _, err := UnmarshalShapes([]byte(data)); err == nil {
+			t.Errorf("UnmarshalShapes(%s) gave no error", data)
+		}
+	}
+}
+
+type unregisteredShape struct {
+	Rectangle
+}
+
+func TestShapeKind(t *testing.T) {
+	for _, test := range []struct {
+		Shape Shape
+		Kind  string
+		OK    bool
+	}{
+		{Shape: NewRectangle(0, 0, 1, 1), Kind: "Rectangle", OK: true},
+		{Shape: Rectangle{}, Kind: "Rectangle", OK: true},
+		{Shape: Polygon{}, Kind: "Polygon", OK: true},
+		{Shape: &Cross{}, Kind: "Cross", OK: true},
+		{Shape: unregisteredShape{}},
+		{Shape: nil},
+	} {
+		kind, ok := ShapeKind(test.Shape)
+		if kind != test.Kind || ok != test.OK {
+			t.Errorf("ShapeKind(%T) = %q, %v want %q, %v", test.Shape, kind, ok, test.Kind, test.OK)
+		}
+	}
+}
+
+func TestRegisterShape_Twice(t *testing.T) {
+	for name, register := range map[string]func(){
+		"Kind": func() { RegisterShape("Rectangle", func() Shape { return &unregisteredShape{} }) },
+		"Type": func() { RegisterShape("Another rectangle", func() Shape { return &Rectangle{} }) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s registered twice didn't panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
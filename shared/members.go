@@ -0,0 +1,53 @@
+package shared
+
+// Members counts how many times each shape has been added to a map and not removed, for maps which can't count their
+// shapes cheaply. The zero value is empty and ready to use.
+type Members struct {
+	counts map[Shape]int
+	size   int
+}
+
+// Add records shape being added once more.
+func (ms *Members) Add(shape Shape) {
+	if ms.counts == nil {
+		ms.counts = map[Shape]int{}
+	}
+	ms.counts[shape]++
+	ms.size++
+}
+
+// Remove records every addition of shape being removed.
+func (ms *Members) Remove(shape Shape) {
+	ms.size -= ms.counts[shape]
+	delete(ms.counts, shape)
+}
+
+// Len returns the number of shapes, a shape added more than once is counted each time.
+func (ms *Members) Len() int {
+	return ms.size
+}
+
+// Contains reports if shape has been added and not removed.
+func (ms *Members) Contains(shape Shape) bool {
+	return ms.counts[shape] > 0
+}
+
+// Clear forgets every shape, keeping the memory allocated for them.
+func (ms *Members) Clear() {
+	for s := range ms.counts {
+		delete(ms.counts, s)
+	}
+	ms.size = 0
+}
+
+// Clone returns a copy which can be changed independently.
+func (ms *Members) Clone() Members {
+	c := Members{size: ms.size}
+	if ms.counts != nil {
+		c.counts = make(map[Shape]int, len(ms.counts))
+		for s, n := range ms.counts {
+			c.counts[s] = n
+		}
+	}
+	return c
+}
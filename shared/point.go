@@ -4,9 +4,25 @@ import "sort"
 
 type Point struct {
 	ZIndex int
+	// Order breaks ties between points with the same ZIndex, the higher Order is above.
+	Order int
 	Shape
 }
 
+// Below reports if p is stacked below o.
+func (p *Point) Below(o *Point) bool {
+	if p.ZIndex != o.ZIndex {
+		return p.ZIndex < o.ZIndex
+	}
+	return p.Order < o.Order
+}
+
+// ZShape is a shape in a stack with its z-index.
+type ZShape struct {
+	Shape  Shape
+	ZIndex int
+}
+
 type ZSort []*Point
 
 func (Z ZSort) Len() int {
@@ -14,7 +30,7 @@ func (Z ZSort) Len() int {
 }
 
 func (Z ZSort) Less(i, j int) bool {
-	return Z[i].ZIndex < Z[j].ZIndex
+	return Z[i].Below(Z[j])
 }
 
 func (Z ZSort) Swap(i, j int) {
@@ -25,24 +41,94 @@ var _ sort.Interface = ZSort(nil)
 
 type PointArray []*Point
 
+// Shapes returns the shape of each point in the same order.
+func (pa PointArray) Shapes() []Shape {
+	result := make([]Shape, 0, len(pa))
+	for _, p := range pa {
+		result = append(result, p.Shape)
+	}
+	return result
+}
+
+// Top returns the topmost point, or nil when there are none.
+func (pa PointArray) Top() *Point {
+	var top *Point
+	for _, p := range pa {
+		if top == nil || top.Below(p) {
+			top = p
+		}
+	}
+	return top
+}
+
+// ZShapes returns the shape and z-index of each point in the same order.
+func (pa PointArray) ZShapes() []ZShape {
+	result := make([]ZShape, 0, len(pa))
+	for _, p := range pa {
+		result = append(result, ZShape{Shape: p.Shape, ZIndex: p.ZIndex})
+	}
+	return result
+}
+
+// Remove removes every point of shape, keeping the order of the rest of the array.
 func (pa PointArray) Remove(shape Shape) ([]*Point, int) {
-	shrink := 0
-	for i := range pa {
-		for pa[i].Shape == shape && len(pa)-shrink > i {
-			shrink++
-			pa[i] = pa[len(pa)-shrink]
+	result := pa[:0]
+	for _, p := range pa {
+		if p.Shape != shape {
+			result = append(result, p)
 		}
 	}
-	return pa[:len(pa)-shrink], shrink
+	for i := len(result); i < len(pa); i++ {
+		pa[i] = nil
+	}
+	return result, len(pa) - len(result)
 }
 
 func (pa PointArray) Insert(point *Point) []*Point {
 	a := pa
 	p := 0
-	for ; p < len(a) && point.ZIndex >= a[p].ZIndex; p++ {
+	for ; p < len(a) && !point.Below(a[p]); p++ {
 	}
 	a = append(a, nil)
 	copy(a[p+1:], a[p:])
 	a[p] = point
 	return a
 }
+
+// RemovePoint removes point, keeping the order of the rest of the array.
+func (pa PointArray) RemovePoint(point *Point) []*Point {
+	for i := range pa {
+		if pa[i] == point {
+			copy(pa[i:], pa[i+1:])
+			pa[len(pa)-1] = nil
+			return pa[:len(pa)-1]
+		}
+	}
+	return pa
+}
+
+// PointCloner copies points for a cloned map. A point is only copied once, so points shared between cells or nodes
+// are still shared in the clone.
+type PointCloner map[*Point]*Point
+
+// Clone returns the copy of p.
+func (pc PointCloner) Clone(p *Point) *Point {
+	c, ok := pc[p]
+	if !ok {
+		c = &Point{ZIndex: p.ZIndex, Order: p.Order, Shape: p.Shape}
+		pc[p] = c
+	}
+	return c
+}
+
+// CloneAll returns a new slice with the copy of each of points, or nil if there are none.
+func (pc PointCloner) CloneAll(points []*Point) []*Point {
+	if len(points) == 0 {
+		return nil
+	}
+	result := make([]*Point, len(points))
+	for i, p := range points {
+		result[i] = pc.Clone(p)
+	}
+	return result
+}
@@ -0,0 +1,212 @@
+package shared
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// FillRule is an option for NewPolygon selecting how overlapping rings and self intersecting outlines are filled.
+type FillRule int
+
+const (
+	// EvenOdd fills points which are surrounded by an odd number of edges.
+	EvenOdd FillRule = iota
+	// NonZero fills points which the outline winds around at least once, holes must run the opposite way to the ring
+	// they are cut from.
+	NonZero
+)
+
+func (f FillRule) String() string {
+	switch f {
+	case EvenOdd:
+		return "EvenOdd"
+	case NonZero:
+		return "NonZero"
+	}
+	return "Unknown"
+}
+
+// Ring is an option for NewPolygon adding another closed outline to the polygon, such as a hole.
+type Ring []image.Point
+
+// Polygon is made of one or more closed Rings of vertices. A pixel is in the polygon if its centre is filled according
+// to the FillRule, so a polygon with the corners of a Rectangle covers the same pixels as the Rectangle.
+type Polygon struct {
+	Rings    []Ring
+	FillRule FillRule
+	Name     string
+}
+
+func (p Polygon) String() string {
+	var n string
+	if len(p.Name) > 0 {
+		n = p.Name + ":"
+	}
+	rings := make([]string, 0, len(p.Rings))
+	for _, r := range p.Rings {
+		points := make([]string, 0, len(r))
+		for _, v := range r {
+			points = append(points, v.String())
+		}
+		rings = append(rings, "["+strings.Join(points, " ")+"]")
+	}
+	return n + "Polygon(" + strings.Join(rings, ", ") + ")"
+}
+
+// PointIn casts a ray right from the centre of the pixel counting the edges it crosses. Coordinates are doubled so the
+// centre and the vertices are all integers, and the ray can never pass through a vertex.
+func (p Polygon) PointIn(x, y int) bool {
+	px, py := int64(x)*2+1, int64(y)*2+1
+	winding := 0
+	crossings := 0
+	for _, r := range p.Rings {
+		for i := range r {
+			a, b := r[i], r[(i+1)%len(r)]
+			ax, ay, bx, by := int64(a.X)*2, int64(a.Y)*2, int64(b.X)*2, int64(b.Y)*2
+			if (ay < py) == (by < py) {
+				continue
+			}
+			// side is positive when the centre is left of the edge a->b.
+			side := cmpProducts(bx-ax, py-ay, px-ax, by-ay)
+			if ay < py && side > 0 {
+				winding++
+				crossings++
+			} else if ay > py && side < 0 {
+				winding--
+				crossings++
+			}
+		}
+	}
+	if p.FillRule == NonZero {
+		return winding != 0
+	}
+	return crossings%2 == 1
+}
+
+func (p Polygon) Bounds() image.Rectangle {
+	var b image.Rectangle
+	first := true
+	for _, r := range p.Rings {
+		for _, v := range r {
+			if first {
+				b = image.Rectangle{Min: v, Max: v}
+				first = false
+				continue
+			}
+			if v.X < b.Min.X {
+				b.Min.X = v.X
+			}
+			if v.Y < b.Min.Y {
+				b.Min.Y = v.Y
+			}
+			if v.X > b.Max.X {
+				b.Max.X = v.X
+			}
+			if v.Y > b.Max.Y {
+				b.Max.Y = v.Y
+			}
+		}
+	}
+	return b
+}
+
+// SetBounds moves and scales every vertex so the polygon fills b.
+func (p *Polygon) SetBounds(b image.Rectangle) {
+	old := p.Bounds()
+	scale := func(v, oldMin, oldSize, min, size int) int {
+		if oldSize == 0 {
+			return min + v - oldMin
+		}
+		return min + int(int64(v-oldMin)*int64(size)/int64(oldSize))
+	}
+	for _, r := range p.Rings {
+		for i, v := range r {
+			r[i] = image.Point{
+				X: scale(v.X, old.Min.X, old.Dx(), b.Min.X, b.Dx()),
+				Y: scale(v.Y, old.Min.Y, old.Dy(), b.Min.Y, b.Dy()),
+			}
+		}
+	}
+}
+
+// Distance measures from the centre of the pixel to the nearest edge of any ring. A polygon with empty bounds covers
+// nothing so it is infinitely far away, like the other empty shapes.
+func (p Polygon) Distance(x, y int) float64 {
+	if p.Bounds().Empty() {
+		return math.Inf(1)
+	}
+	if p.PointIn(x, y) {
+		return 0
+	}
+	px, py := float64(x)+0.5, float64(y)+0.5
+	d := math.Inf(1)
+	for _, r := range p.Rings {
+		for i := range r {
+			a, b := r[i], r[(i+1)%len(r)]
+			d = math.Min(d, segmentDistance(px, py, float64(a.X), float64(a.Y), float64(b.X), float64(b.Y)))
+		}
+	}
+	return d
+}
+
+var _ Shape = (*Polygon)(nil)
+var _ Resizable = (*Polygon)(nil)
+var _ Distancer = (*Polygon)(nil)
+
+// NewPolygon creates a polygon whose outline joins points, closing back to the first. Holes and extra outlines are
+// added with the Ring option, and the FillRule option chooses how they combine.
+func NewPolygon(points []image.Point, ops ...Op) *Polygon {
+	p := &Polygon{
+		Rings: []Ring{append(Ring(nil), points...)},
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case Name:
+			p.Name = string(op)
+		case FillRule:
+			p.FillRule = op
+		case Ring:
+			p.Rings = append(p.Rings, append(Ring(nil), op...))
+		}
+	}
+	return p
+}
+
+// cmpProducts returns the sign of a*b - c*d without overflowing.
+func cmpProducts(a, b, c, d int64) int {
+	ah, al := mul128(a, b)
+	ch, cl := mul128(c, d)
+	switch {
+	case int64(ah) < int64(ch):
+		return -1
+	case int64(ah) > int64(ch):
+		return 1
+	case al < cl:
+		return -1
+	case al > cl:
+		return 1
+	}
+	return 0
+}
+
+// mul128 returns a*b as a two's complement 128 bit number.
+func mul128(a, b int64) (hi uint64, lo uint64) {
+	ua, ub := uint64(a), uint64(b)
+	if a < 0 {
+		ua = -ua
+	}
+	if b < 0 {
+		ub = -ub
+	}
+	hi, lo = bits.Mul64(ua, ub)
+	if (a < 0) != (b < 0) {
+		lo = ^lo + 1
+		hi = ^hi
+		if lo == 0 {
+			hi++
+		}
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package shared
+
+import (
+	"image"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPolygon_PointIn(t *testing.T) {
+	star := []image.Point{{50, 0}, {80, 100}, {0, 35}, {100, 35}, {20, 100}}
+	square := []image.Point{{0, 0}, {100, 0}, {100, 100}, {0, 100}}
+	for _, test := range []struct {
+		Name  string
+		Shape Shape
+		In    []image.Point
+		Out   []image.Point
+	}{
+		{
+			Name:  "Triangle",
+			Shape: NewPolygon([]image.Point{{0, 0}, {10, 0}, {0, 10}}),
+			In:    []image.Point{{0, 0}, {8, 0}, {0, 8}, {4, 4}},
+			Out:   []image.Point{{10, 0}, {0, 10}, {5, 5}, {-1, 0}, {0, -1}},
+		},
+		{
+			Name:  "Concave",
+			Shape: NewPolygon([]image.Point{{0, 0}, {30, 0}, {30, 30}, {20, 30}, {20, 10}, {10, 10}, {10, 30}, {0, 30}}),
+			In:    []image.Point{{5, 25}, {25, 25}, {15, 5}},
+			Out:   []image.Point{{15, 15}, {15, 29}, {10, 10}},
+		},
+		{
+			Name:  "Self intersecting even-odd",
+			Shape: NewPolygon(star),
+			In:    []image.Point{{50, 10}, {20, 40}},
+			Out:   []image.Point{{50, 50}, {5, 90}},
+		},
+		{
+			Name:  "Self intersecting non-zero",
+			Shape: NewPolygon(star, NonZero),
+			In:    []image.Point{{50, 10}, {20, 40}, {50, 50}},
+			Out:   []image.Point{{5, 90}},
+		},
+		{
+			Name:  "Hole even-odd",
+			Shape: NewPolygon(square, Ring{{25, 25}, {75, 25}, {75, 75}, {25, 75}}),
+			In:    []image.Point{{10, 10}, {24, 50}, {75, 50}},
+			Out:   []image.Point{{25, 25}, {50, 50}, {74, 74}},
+		},
+		{
+			Name:  "Hole non-zero",
+			Shape: NewPolygon(square, Ring{{25, 25}, {25, 75}, {75, 75}, {75, 25}}, NonZero),
+			In:    []image.Point{{10, 10}, {24, 50}, {75, 50}},
+			Out:   []image.Point{{25, 25}, {50, 50}, {74, 74}},
+		},
+		{
+			Name:  "Same direction ring is not a hole with non-zero",
+			Shape: NewPolygon(square, Ring{{25, 25}, {75, 25}, {75, 75}, {25, 75}}, NonZero),
+			In:    []image.Point{{10, 10}, {50, 50}},
+		},
+		{
+			Name:  "Huge",
+			Shape: NewPolygon([]image.Point{{-1 << 60, -1 << 60}, {1 << 60, -1 << 60}, {0, 1 << 60}}),
+			In:    []image.Point{{0, 0}, {-1<<60 + 1, -1 << 60}},
+			Out:   []image.Point{{1 << 60, 0}, {0, 1 << 60}},
+		},
+		{
+			Name:  "Empty",
+			Shape: NewPolygon(nil),
+			Out:   []image.Point{{0, 0}},
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			for _, p := range test.In {
+				if !test.Shape.PointIn(p.X, p.Y) {
+					t.Errorf("%s.PointIn(%d, %d) = false", test.Shape, p.X, p.Y)
+				}
+			}
+			for _, p := range test.Out {
+				if test.Shape.PointIn(p.X, p.Y) {
+					t.Errorf("%s.PointIn(%d, %d) = true", test.Shape, p.X, p.Y)
+				}
+			}
+		})
+	}
+}
+
+func TestPolygon_MatchesRectangle(t *testing.T) {
+	r := NewRectangle(-5, 3, 12, 9)
+	p := NewPolygon([]image.Point{r.Min, {r.Max.X, r.Min.Y}, r.Max, {r.Min.X, r.Max.Y}})
+	if diff := cmp.Diff(p.Bounds(), r.Bounds()); diff != "" {
+		t.Errorf("Bounds() = \n%s", diff)
+	}
+	for y := r.Min.Y - 2; y < r.Max.Y+2; y++ {
+		for x := r.Min.X - 2; x < r.Max.X+2; x++ {
+			if got, want := p.PointIn(x, y), r.PointIn(x, y); got != want {
+				t.Errorf("PointIn(%d, %d) = %v want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestPolygon_SharedEdge(t *testing.T) {
+	a := NewPolygon([]image.Point{{0, 0}, {10, 0}, {0, 10}})
+	b := NewPolygon([]image.Point{{10, 0}, {10, 10}, {0, 10}})
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if a.PointIn(x, y) == b.PointIn(x, y) {
+				t.Errorf("PointIn(%d, %d) = %v for both halves", x, y, a.PointIn(x, y))
+			}
+		}
+	}
+}
+
+func TestPolygon_SetBounds(t *testing.T) {
+	p := NewPolygon([]image.Point{{0, 0}, {10, 0}, {5, 10}}, Ring{{4, 4}, {6, 4}, {5, 6}})
+	p.SetBounds(image.Rect(100, 50, 120, 60))
+	want := []Ring{{{100, 50}, {120, 50}, {110, 60}}, {{108, 54}, {112, 54}, {110, 56}}}
+	if diff := cmp.Diff(p.Rings, want); diff != "" {
+		t.Errorf("SetBounds() = \n%s", diff)
+	}
+}
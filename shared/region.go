@@ -0,0 +1,36 @@
+package shared
+
+import "image"
+
+// Containment selects how a region query matches a shape against the query rectangle.
+type Containment int
+
+const (
+	// Intersects matches shapes whose bounds overlap the region.
+	Intersects Containment = iota
+	// Within matches shapes whose bounds are entirely inside the region.
+	Within
+)
+
+func (c Containment) String() string {
+	switch c {
+	case Intersects:
+		return "Intersects"
+	case Within:
+		return "Within"
+	}
+	return "Unknown"
+}
+
+// Match reports if a shape with bounds b matches region r. Shapes with empty bounds never match.
+func (c Containment) Match(b image.Rectangle, r image.Rectangle) bool {
+	if b.Empty() {
+		return false
+	}
+	switch c {
+	case Within:
+		return b.In(r)
+	default:
+		return b.Overlaps(r)
+	}
+}
@@ -18,6 +18,12 @@ type Shape interface {
 	String() string
 }
 
+// Resizable is a Shape whose bounds can be changed after it has been created.
+type Resizable interface {
+	Shape
+	SetBounds(b image.Rectangle)
+}
+
 type Rectangle struct {
 	image.Rectangle
 	Name string
@@ -39,7 +45,17 @@ func (r Rectangle) Bounds() image.Rectangle {
 	return r.Rectangle
 }
 
+func (r *Rectangle) SetBounds(b image.Rectangle) {
+	r.Rectangle = b
+}
+
+func (r Rectangle) Distance(x, y int) float64 {
+	return boxDistance(r.Rectangle, x, y)
+}
+
 var _ Shape = (*Rectangle)(nil)
+var _ Resizable = (*Rectangle)(nil)
+var _ Distancer = (*Rectangle)(nil)
 
 type Op any
 
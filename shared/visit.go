@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"sort"
+	"sync"
+)
+
+// stackBuffers holds the buffers VisitStack gathers points into so that visiting a stack doesn't allocate.
+var stackBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([]*Point)
+	},
+}
+
+// VisitStack calls collect to append the points of a stack to an empty buffer, then calls f with the shape and z-index
+// of each of them, topmost first, until f returns false. The buffer is reused so once it has grown to fit the stack
+// no memory is allocated. f may visit other stacks but the buffer must not be kept.
+func VisitStack(collect func(buf []*Point) []*Point, f func(shape Shape, zIndex int) bool) {
+	bp := stackBuffers.Get().(*[]*Point)
+	points := collect((*bp)[:0])
+	*bp = points
+	sort.Sort((*topmostFirst)(bp))
+	for _, p := range points {
+		if !f(p.Shape, p.ZIndex) {
+			break
+		}
+	}
+	for i := range points {
+		points[i] = nil
+	}
+	*bp = points[:0]
+	stackBuffers.Put(bp)
+}
+
+// topmostFirst sorts the pooled buffer in place, it is a pointer so giving it to sort.Sort doesn't allocate.
+type topmostFirst []*Point
+
+func (t *topmostFirst) Len() int {
+	return len(*t)
+}
+
+func (t *topmostFirst) Less(i, j int) bool {
+	return (*t)[j].Below((*t)[i])
+}
+
+func (t *topmostFirst) Swap(i, j int) {
+	(*t)[i], (*t)[j] = (*t)[j], (*t)[i]
+}
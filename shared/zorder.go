@@ -0,0 +1,96 @@
+package shared
+
+// Restacker is what BringToFront, SendToBack and PlaceAbove need of a map. SetZIndex must stack a shape above any
+// others which already have the z-index, giving every copy of a shape added more than once the z-index, ZIndexOf must
+// return the z-index of the topmost copy, and All must return every shape topmost first.
+type Restacker interface {
+	ZIndexOf(shape Shape) (int, bool)
+	SetZIndex(shape Shape, zIndex int)
+	All() []Shape
+}
+
+// BringToFront restacks shape above every other shape in m, giving it the z-index of the topmost shape.
+func BringToFront(m Restacker, shape Shape) {
+	if _, ok := m.ZIndexOf(shape); !ok {
+		return
+	}
+	all := m.All()
+	if ahead(all, shape) {
+		return
+	}
+	if zIndex, ok := m.ZIndexOf(all[0]); ok {
+		m.SetZIndex(shape, zIndex)
+	}
+}
+
+// SendToBack restacks shape below every other shape in m, giving it a z-index one below the bottom shape.
+func SendToBack(m Restacker, shape Shape) {
+	if _, ok := m.ZIndexOf(shape); !ok {
+		return
+	}
+	all := m.All()
+	for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+		all[i], all[j] = all[j], all[i]
+	}
+	if ahead(all, shape) {
+		return
+	}
+	// The bottom shape which isn't a copy of shape.
+	bottom := all[0]
+	for _, s := range all {
+		if s != shape {
+			bottom = s
+			break
+		}
+	}
+	if zIndex, ok := m.ZIndexOf(bottom); ok {
+		m.SetZIndex(shape, zIndex-1)
+	}
+}
+
+// ahead reports if every copy of shape in shapes comes before any other shape.
+func ahead(shapes []Shape, shape Shape) bool {
+	i := 0
+	for i < len(shapes) && shapes[i] == shape {
+		i++
+	}
+	for _, s := range shapes[i:] {
+		if s == shape {
+			return false
+		}
+	}
+	return i > 0
+}
+
+// PlaceAbove restacks shape directly above other in m, even if that lowers it. Shape is given the z-index of other
+// and the shapes which shared that z-index and were above other are restacked above shape again, so their order and
+// every other shape's is unchanged.
+func PlaceAbove(m Restacker, shape, other Shape) {
+	if shape == other {
+		return
+	}
+	zIndex, ok := m.ZIndexOf(other)
+	if _, found := m.ZIndexOf(shape); !ok || !found {
+		return
+	}
+	all := m.All()
+	i := 0
+	for i < len(all) && all[i] != other {
+		i++
+	}
+	// Shapes with the same z-index are next to each other in all, those above other come just before it.
+	var above []Shape
+	for j := i - 1; j >= 0; j-- {
+		if all[j] == shape {
+			continue
+		}
+		if z, _ := m.ZIndexOf(all[j]); z != zIndex {
+			break
+		}
+		above = append(above, all[j])
+	}
+	m.SetZIndex(shape, zIndex)
+	for _, s := range above {
+		m.SetZIndex(s, zIndex)
+	}
+}
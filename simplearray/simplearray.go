@@ -2,11 +2,15 @@ package simplearray
 
 import (
 	"github.com/arran4/spacemap/shared"
+	"image"
+	"math"
 	"sort"
 )
 
 type Struct struct {
 	Shapes []*shared.Point
+	// Sequence orders shapes with the same z-index, the array itself isn't kept in order.
+	Sequence int
 }
 
 func New() *Struct {
@@ -23,9 +27,11 @@ func (sm *Struct) AddAll(s ...shared.Shape) *Struct {
 }
 
 func (sm *Struct) Add(shape shared.Shape, zIndex int) {
+	sm.Sequence++
 	sm.Shapes = append(sm.Shapes, &shared.Point{
 		Shape:  shape,
 		ZIndex: zIndex,
+		Order:  sm.Sequence,
 	})
 }
 
@@ -44,25 +50,271 @@ func (sm *Struct) Remove(s shared.Shape) {
 	sm.Shapes = sm.Shapes[:newLen]
 }
 
-func (sm *Struct) GetStackAt(x int, y int) (result []shared.Shape) {
-	var r []*shared.Point
+// Update does nothing as the array keeps no record of the bounds of its shapes.
+func (sm *Struct) Update(shape shared.Shape, oldBounds image.Rectangle) {
+}
+
+func (sm *Struct) Move(shape shared.Resizable, bounds image.Rectangle) {
+	oldBounds := shape.Bounds()
+	shape.SetBounds(bounds)
+	sm.Update(shape, oldBounds)
+}
+
+func (sm *Struct) GetStackAt(x int, y int) []shared.Shape {
+	return sm.AppendStackAt([]shared.Shape{}, x, y)
+}
+
+// VisitStackAt calls f with each shape at x, y and its z-index, topmost first, until f returns false.
+func (sm *Struct) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	shared.VisitStack(func(buf []*shared.Point) []*shared.Point {
+		for _, p := range sm.Shapes {
+			if p.PointIn(x, y) {
+				buf = append(buf, p)
+			}
+		}
+		return buf
+	}, f)
+}
+
+// AppendStackAt appends the shapes at x, y to dst, topmost first, and returns the extended slice.
+func (sm *Struct) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	sm.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		dst = append(dst, shape)
+		return true
+	})
+	return dst
+}
+
+func (sm *Struct) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	return shared.PointArray(sm.pointsIn(r, mode)).Shapes()
+}
+
+// GetZStackIn is GetStackIn with the z-index of each shape.
+func (sm *Struct) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	return shared.PointArray(sm.pointsIn(r, mode)).ZShapes()
+}
+
+// GetZStackAt is GetStackAt with the z-index of each shape.
+func (sm *Struct) GetZStackAt(x, y int) []shared.ZShape {
+	result := []shared.ZShape{}
+	sm.VisitStackAt(x, y, func(shape shared.Shape, zIndex int) bool {
+		result = append(result, shared.ZShape{Shape: shape, ZIndex: zIndex})
+		return true
+	})
+	return result
+}
+
+// pointsIn returns the points of the shapes matching r, topmost first.
+func (sm *Struct) pointsIn(r image.Rectangle, mode shared.Containment) []*shared.Point {
+	var found []*shared.Point
 	for i := range sm.Shapes {
-		if sm.Shapes[i].PointIn(x, y) {
-			r = append(r, sm.Shapes[i])
+		if mode.Match(sm.Shapes[i].Bounds(), r) {
+			found = append(found, sm.Shapes[i])
 		}
 	}
-	sort.Sort(shared.ZSort(r))
-	result = make([]shared.Shape, 0, len(r))
-	for _, e := range r {
-		result = append(result, e.Shape)
-	}
-	return
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	return found
 }
 
-func (sm *Struct) GetAt(x int, y int) shared.Shape {
-	s := sm.GetStackAt(x, y)
-	if len(s) > 0 {
+// Nearest returns the shape nearest to x, y, or nil when there are none.
+func (sm *Struct) Nearest(x, y int) shared.Shape {
+	if s := sm.KNearest(x, y, 1, math.Inf(1)); len(s) > 0 {
 		return s[0]
 	}
 	return nil
 }
+
+// KNearest returns up to k shapes no further than maxDistance from x, y, nearest first. Every shape is measured.
+func (sm *Struct) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	if k <= 0 {
+		return []shared.Shape{}
+	}
+	points := append([]*shared.Point(nil), sm.Shapes...)
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	shapes := make([]shared.Shape, 0, len(points))
+	for _, p := range points {
+		shapes = append(shapes, p.Shape)
+	}
+	found := shared.ByDistance(shapes, x, y, maxDistance)
+	if len(found) > k {
+		found = found[:k]
+	}
+	result := make([]shared.Shape, 0, len(found))
+	for _, n := range found {
+		result = append(result, n.Shape)
+	}
+	return result
+}
+
+// SegmentCast returns the shapes crossed by the line from x0, y0 to x1, y1 in order of first contact. Every shape is
+// checked.
+func (sm *Struct) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	var found []*shared.Point
+	for _, p := range sm.Shapes {
+		if shared.SegmentOverlaps(p.Bounds(), x0, y0, x1, y1) {
+			found = append(found, p)
+		}
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	candidates := make([]shared.Shape, 0, len(found))
+	for _, p := range found {
+		candidates = append(candidates, p.Shape)
+	}
+	return shared.Cast(x0, y0, x1, y1, candidates)
+}
+
+// RayCast returns the shapes crossed by a ray from x, y in the direction dx, dy, no further than maxDistance which can
+// be +Inf, in order of first contact.
+func (sm *Struct) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	return shared.RayCast(x, y, dx, dy, maxDistance, sm.extent(), sm.SegmentCast)
+}
+
+// extent returns the area covered by every shape.
+func (sm *Struct) extent() image.Rectangle {
+	var r image.Rectangle
+	for _, p := range sm.Shapes {
+		if b := p.Bounds(); !b.Empty() {
+			r = r.Union(b)
+		}
+	}
+	return r
+}
+
+// ZIndexOf returns the z-index of shape, or of its topmost copy when it was added more than once.
+func (sm *Struct) ZIndexOf(shape shared.Shape) (int, bool) {
+	if p := shared.PointArray(sm.points(shape)).Top(); p != nil {
+		return p.ZIndex, true
+	}
+	return 0, false
+}
+
+// SetZIndex changes the z-index of shape, stacking it above any others with the same z-index. Copies of a shape
+// added more than once keep their order.
+func (sm *Struct) SetZIndex(shape shared.Shape, zIndex int) {
+	points := sm.points(shape)
+	sort.Sort(shared.ZSort(points))
+	for _, p := range points {
+		sm.Sequence++
+		p.ZIndex = zIndex
+		p.Order = sm.Sequence
+	}
+}
+
+// points returns the point for each time shape was added.
+func (sm *Struct) points(shape shared.Shape) (points []*shared.Point) {
+	for _, p := range sm.Shapes {
+		if p.Shape == shape {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// BringToFront restacks shape above every other shape.
+func (sm *Struct) BringToFront(shape shared.Shape) {
+	shared.BringToFront(sm, shape)
+}
+
+// SendToBack restacks shape below every other shape.
+func (sm *Struct) SendToBack(shape shared.Shape) {
+	shared.SendToBack(sm, shape)
+}
+
+// PlaceAbove restacks shape directly above other, even if that lowers it, leaving the order of the other shapes
+// unchanged.
+func (sm *Struct) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	shared.PlaceAbove(sm, shape, other)
+}
+
+func (sm *Struct) GetAt(x int, y int) (top shared.Shape) {
+	sm.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		top = shape
+		return false
+	})
+	return top
+}
+
+func (sm *Struct) GetBottomAt(x int, y int) (bottom shared.Shape) {
+	sm.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		bottom = shape
+		return true
+	})
+	return bottom
+}
+
+// Len returns the number of shapes.
+func (sm *Struct) Len() int {
+	return len(sm.Shapes)
+}
+
+// Contains reports if shape has been added and not removed. Every shape is checked.
+func (sm *Struct) Contains(shape shared.Shape) bool {
+	for _, p := range sm.Shapes {
+		if p.Shape == shape {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns every shape, topmost first.
+func (sm *Struct) All() []shared.Shape {
+	return shared.PointArray(sm.allPoints()).Shapes()
+}
+
+// allPoints returns the point of every shape, topmost first.
+func (sm *Struct) allPoints() []*shared.Point {
+	points := append([]*shared.Point(nil), sm.Shapes...)
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	return points
+}
+
+// Bounds returns the smallest rectangle covering every shape, shapes with empty bounds are ignored.
+func (sm *Struct) Bounds() (r image.Rectangle) {
+	for _, p := range sm.Shapes {
+		if b := p.Bounds(); !b.Empty() {
+			r = r.Union(b)
+		}
+	}
+	return r
+}
+
+// Clear removes every shape, keeping the array's capacity for the next shapes.
+func (sm *Struct) Clear() {
+	for i := range sm.Shapes {
+		sm.Shapes[i] = nil
+	}
+	sm.Shapes = sm.Shapes[:0]
+	sm.Sequence = 0
+}
+
+// Clone returns a copy which can be changed independently of sm. The shapes themselves are shared.
+func (sm *Struct) Clone() *Struct {
+	shapes := shared.PointCloner{}.CloneAll(sm.Shapes)
+	if shapes == nil {
+		shapes = []*shared.Point{}
+	}
+	return &Struct{
+		Shapes:   shapes,
+		Sequence: sm.Sequence,
+	}
+}
+
+// MarshalJSON encodes every shape with its z-index, the shapes must be registered with shared.RegisterShape.
+func (sm *Struct) MarshalJSON() ([]byte, error) {
+	return shared.MarshalShapes(shared.PointArray(sm.allPoints()).ZShapes())
+}
+
+// UnmarshalJSON replaces the shapes of a map created with New with those encoded by MarshalJSON, stacked as they
+// were. Options given to New are kept.
+func (sm *Struct) UnmarshalJSON(data []byte) error {
+	shapes, err := shared.UnmarshalShapes(data)
+	if err != nil {
+		return err
+	}
+	sm.Clear()
+	for i := len(shapes) - 1; i >= 0; i-- {
+		sm.Add(shapes[i].Shape, shapes[i].ZIndex)
+	}
+	return nil
+}
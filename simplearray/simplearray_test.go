@@ -1,8 +1,12 @@
 package simplearray
 
 import (
+	"fmt"
+	"github.com/arran4/spacemap"
 	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/spacemaptest"
 	"github.com/google/go-cmp/cmp"
+	"image"
 	"testing"
 )
 
@@ -134,46 +138,51 @@ func TestZIndex(t *testing.T) {
 		name        string
 		Constructor func() *Struct
 		want        shared.Shape
+		bottom      shared.Shape
 	}{
 		{
-			name: "r1&2 want r2",
+			name: "r1&2 want r1 above r2",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect1, 1)
 				s.Add(rect2, 0)
 				return s
 			},
-			want: rect2,
+			want:   rect1,
+			bottom: rect2,
 		},
 		{
-			name: "r1&2 want r1",
+			name: "r1&2 want r2 above r1",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect1, 1)
 				s.Add(rect2, 2)
 				return s
 			},
-			want: rect1,
+			want:   rect2,
+			bottom: rect1,
 		},
 		{
-			name: "r2&1 want r2",
+			name: "r2&1 want r1 above r2",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect2, 0)
 				s.Add(rect1, 1)
 				return s
 			},
-			want: rect2,
+			want:   rect1,
+			bottom: rect2,
 		},
 		{
-			name: "r2&1 want r1",
+			name: "r2&1 want r2 above r1",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect2, 2)
 				s.Add(rect1, 1)
 				return s
 			},
-			want: rect1,
+			want:   rect2,
+			bottom: rect1,
 		},
 	}
 	for _, test := range tests {
@@ -183,6 +192,231 @@ func TestZIndex(t *testing.T) {
 			if r != test.want {
 				tt.Errorf("Failed got %s expected %s", r, test.want)
 			}
+			if r := sm.GetBottomAt(50, 50); r != test.bottom {
+				tt.Errorf("Failed got bottom %s expected %s", r, test.bottom)
+			}
+		})
+	}
+}
+
+func TestStruct_Move(t *testing.T) {
+	tests := []struct {
+		name   string
+		Bounds image.Rectangle
+		Update bool
+		Checks map[image.Point][]string
+	}{
+		{
+			name:   "Move outside of the other",
+			Bounds: image.Rect(150, 150, 170, 170),
+			Checks: map[image.Point][]string{
+				{50, 50}:   {"rect1"},
+				{160, 160}: {"rect2"},
+				{169, 150}: {"rect2"},
+			},
+		},
+		{
+			name:   "Move along one axis",
+			Bounds: image.Rect(40, 150, 60, 170),
+			Checks: map[image.Point][]string{
+				{50, 50}:  {"rect1"},
+				{50, 160}: {"rect2"},
+			},
+		},
+		{
+			name:   "Grow to cover the other",
+			Bounds: image.Rect(0, 0, 110, 110),
+			Checks: map[image.Point][]string{
+				{5, 5}:     {"rect2"},
+				{50, 50}:   {"rect2", "rect1"},
+				{105, 105}: {"rect2"},
+			},
+		},
+		{
+			name:   "Update after bounds changed directly",
+			Bounds: image.Rect(150, 150, 170, 170),
+			Update: true,
+			Checks: map[image.Point][]string{
+				{50, 50}:   {"rect1"},
+				{160, 160}: {"rect2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+			rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+			sm := New()
+			sm.Add(rect1, 1)
+			sm.Add(rect2, 2)
+			if tt.Update {
+				oldBounds := rect2.Bounds()
+				rect2.Rectangle = tt.Bounds
+				sm.Update(rect2, oldBounds)
+			} else {
+				sm.Move(rect2, tt.Bounds)
+			}
+			for p, want := range tt.Checks {
+				got := []string{}
+				for _, s := range sm.GetStackAt(p.X, p.Y) {
+					got = append(got, s.(*shared.Rectangle).Name)
+				}
+				if diff := cmp.Diff(got, want); diff != "" {
+					t.Errorf("GetStackAt(%d, %d) = \n%s", p.X, p.Y, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestStruct_SetZIndex(t *testing.T) {
+	rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+	rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+	rect3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("rect3"))
+	rect4 := shared.NewRectangle(50, 50, 150, 150, shared.Name("rect4"))
+	tests := []struct {
+		name   string
+		Change func(s *Struct)
+		want   []shared.Shape
+		ZIndex map[shared.Shape]int
+	}{
+		{
+			name:   "Nothing changed",
+			Change: func(s *Struct) {},
+			want:   []shared.Shape{rect3, rect2, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Set lowest",
+			Change: func(s *Struct) {
+				s.SetZIndex(rect3, 0)
+			},
+			want:   []shared.Shape{rect2, rect1, rect3},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 0},
+		},
+		{
+			name: "Set to an existing z-index goes above",
+			Change: func(s *Struct) {
+				s.SetZIndex(rect1, 2)
+			},
+			want:   []shared.Shape{rect3, rect1, rect2},
+			ZIndex: map[shared.Shape]int{rect1: 2, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Bring to front",
+			Change: func(s *Struct) {
+				s.BringToFront(rect1)
+			},
+			want:   []shared.Shape{rect1, rect3, rect2},
+			ZIndex: map[shared.Shape]int{rect1: 3, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Send to back",
+			Change: func(s *Struct) {
+				s.SendToBack(rect3)
+			},
+			want:   []shared.Shape{rect2, rect1, rect3},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 0},
+		},
+		{
+			name: "Send to back when already at the back",
+			Change: func(s *Struct) {
+				s.SendToBack(rect1)
+			},
+			want:   []shared.Shape{rect3, rect2, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Place above a lower shape",
+			Change: func(s *Struct) {
+				s.PlaceAbove(rect3, rect1)
+			},
+			want:   []shared.Shape{rect2, rect3, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 1},
+		},
+		{
+			name: "Place above a higher shape",
+			Change: func(s *Struct) {
+				s.PlaceAbove(rect1, rect2)
+			},
+			want:   []shared.Shape{rect3, rect1, rect2},
+			ZIndex: map[shared.Shape]int{rect1: 2, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Missing shapes are ignored",
+			Change: func(s *Struct) {
+				s.SetZIndex(rect4, 0)
+				s.BringToFront(rect4)
+				s.PlaceAbove(rect4, rect1)
+				s.PlaceAbove(rect1, rect4)
+			},
+			want:   []shared.Shape{rect3, rect2, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := New()
+			sm.Add(rect1, 1)
+			sm.Add(rect2, 2)
+			sm.Add(rect3, 3)
+			tt.Change(sm)
+			if diff := cmp.Diff(sm.GetStackAt(55, 55), tt.want); diff != "" {
+				t.Errorf("GetStackAt() = \n%s", diff)
+			}
+			if diff := cmp.Diff(sm.GetStackAt(120, 120), []shared.Shape{rect3}); diff != "" {
+				t.Errorf("GetStackAt() = \n%s", diff)
+			}
+			for shape, want := range tt.ZIndex {
+				if got, ok := sm.ZIndexOf(shape); !ok || got != want {
+					t.Errorf("ZIndexOf(%s) = %d, %v want %d", shape, got, ok, want)
+				}
+			}
+			if _, ok := sm.ZIndexOf(rect4); ok {
+				t.Errorf("ZIndexOf(%s) found a missing shape", rect4)
+			}
 		})
 	}
 }
+
+func TestNonRectangularShapes(t *testing.T) {
+	for _, shape := range []shared.Shape{
+		shared.NewCircle(50, 50, 20, shared.Name("circle")),
+		shared.NewCircle(-5, 3, 0, shared.Name("dot")),
+		shared.NewEllipse(50, 50, 30, 10, shared.Name("wide")),
+		shared.NewEllipse(-50, 20, 3, 25, shared.Name("tall")),
+		shared.NewEllipse(0, 0, 7, 0, shared.Name("line")),
+		shared.NewPolygon([]image.Point{{50, 0}, {80, 100}, {0, 35}, {100, 35}, {20, 100}}, shared.Name("star")),
+		shared.NewPolygon([]image.Point{{50, 0}, {80, 100}, {0, 35}, {100, 35}, {20, 100}}, shared.NonZero, shared.Name("filled star")),
+		shared.NewPolygon([]image.Point{{0, 0}, {40, 0}, {40, 40}, {0, 40}}, shared.Ring{{10, 10}, {30, 10}, {30, 30}, {10, 30}}, shared.Name("frame")),
+	} {
+		t.Run(fmt.Sprint(shape), func(t *testing.T) {
+			sm := New()
+			sm.Add(shape, 0)
+			b := shape.Bounds()
+			for y := b.Min.Y - 1; y <= b.Max.Y; y++ {
+				for x := b.Min.X - 1; x <= b.Max.X; x++ {
+					if got, want := sm.GetAt(x, y) != nil, shape.PointIn(x, y); got != want {
+						t.Errorf("GetAt(%d, %d) found %v want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	spacemaptest.Run(t, func() spacemap.Interface { return New() })
+}
+
+func TestClone(t *testing.T) {
+	spacemaptest.Clone(t, func() spacemap.Interface { return New() }, func(m spacemap.Interface) spacemap.Interface {
+		return m.(*Struct).Clone()
+	})
+}
+
+func TestAddAll(t *testing.T) {
+	spacemaptest.AddAll(t, func() spacemap.Interface { return New() }, func(m spacemap.Interface, shapes ...shared.Shape) {
+		m.(*Struct).AddAll(shapes...)
+	})
+}
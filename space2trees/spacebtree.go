@@ -1,6 +1,10 @@
 package space2trees
 
 import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
 	"strconv"
 
 	"github.com/arran4/spacemap/shared"
@@ -29,7 +33,9 @@ func (t Type) String() string {
 type Here struct {
 	Shape  shared.Shape
 	ZIndex int
-	Type   Type
+	// Order breaks ties between shapes with the same ZIndex, the higher Order is above.
+	Order int
+	Type  Type
 }
 
 func (h *Here) String() string {
@@ -40,10 +46,19 @@ func (h *Here) Copy() *Here {
 	return &Here{
 		Shape:  h.Shape,
 		ZIndex: h.ZIndex,
+		Order:  h.Order,
 		Type:   h.Type,
 	}
 }
 
+// Below reports if h is stacked below o.
+func (h *Here) Below(o *Here) bool {
+	if h.ZIndex != o.ZIndex {
+		return h.ZIndex < o.ZIndex
+	}
+	return h.Order < o.Order
+}
+
 // Ensure Here implements the Stringer interface without importing fmt.
 type stringer interface{ String() string }
 
@@ -56,19 +71,24 @@ type Node struct {
 	Children [2]*Node
 }
 
-func (n *Node) AddBetween(from, to int, s shared.Shape, zIndex *int, leftMost, rightMost bool, parent *Node, depth int) *Node {
+func (n *Node) AddBetween(from, to int, s shared.Shape, zIndex *int, order int, leftMost, rightMost bool, parent *Node, depth int) *Node {
+	return n.addBetween(from, to, s, zIndex, order, leftMost, rightMost, parent, depth, nil)
+}
+
+// addBetween is AddBetween taking any new nodes from spare first.
+func (n *Node) addBetween(from, to int, s shared.Shape, zIndex *int, order int, leftMost, rightMost bool, parent *Node, depth int, spare *[]*Node) *Node {
 
 	if n == nil {
 		var r *Node
 		if leftMost || rightMost {
 			if leftMost {
-				r = NewNode(from, s, Begin, zIndex, parent, depth)
+				r = newNode(spare, from, s, Begin, zIndex, order, parent, depth)
 				if rightMost {
 					var nDepth = depth
-					r.Children[1] = r.Children[1].AddBetween(from, to, s, zIndex, false, rightMost, r, nDepth)
+					r.Children[1] = r.Children[1].addBetween(from, to, s, zIndex, order, false, rightMost, r, nDepth, spare)
 				}
 			} else if rightMost {
-				r = NewNode(to, s, End, zIndex, parent, depth)
+				r = newNode(spare, to, s, End, zIndex, order, parent, depth)
 			}
 		}
 		if depth >= 0 {
@@ -78,23 +98,23 @@ func (n *Node) AddBetween(from, to int, s shared.Shape, zIndex *int, leftMost, r
 	}
 
 	if n.Value == from && leftMost {
-		n.InsertHere(zIndex, s, Begin)
+		n.InsertHere(zIndex, order, s, Begin)
 		leftMost = false
 	} else if n.Value == to && rightMost {
-		n.InsertHere(zIndex, s, End)
+		n.InsertHere(zIndex, order, s, End)
 		rightMost = false
 	} else if from < n.Value && n.Value < to {
-		n.InsertHere(zIndex, s, Middle)
+		n.InsertHere(zIndex, order, s, Middle)
 	}
 	var nDepth = depth
 	if depth >= 0 {
 		nDepth = depth + 1
 	}
 	if n.Value > from {
-		n.Children[0] = n.Children[0].AddBetween(from, to, s, zIndex, leftMost, rightMost && n.Value >= to, n, nDepth)
+		n.Children[0] = n.Children[0].addBetween(from, to, s, zIndex, order, leftMost, rightMost && n.Value >= to, n, nDepth, spare)
 	}
 	if n.Value < to {
-		n.Children[1] = n.Children[1].AddBetween(from, to, s, zIndex, leftMost && n.Value <= from, rightMost, n, nDepth)
+		n.Children[1] = n.Children[1].addBetween(from, to, s, zIndex, order, leftMost && n.Value <= from, rightMost, n, nDepth, spare)
 	}
 	r := n
 	if depth >= 0 {
@@ -103,7 +123,9 @@ func (n *Node) AddBetween(from, to int, s shared.Shape, zIndex *int, leftMost, r
 	return r
 }
 
-func (n *Node) InsertHere(zIndex *int, s shared.Shape, t Type) {
+// InsertHere adds s to the node keeping Here in stacking order. Here is already in order so the place is found with a
+// binary search rather than comparing against every entry.
+func (n *Node) InsertHere(zIndex *int, order int, s shared.Shape, t Type) {
 	var zi int
 	if zIndex != nil {
 		zi = *zIndex
@@ -111,11 +133,12 @@ func (n *Node) InsertHere(zIndex *int, s shared.Shape, t Type) {
 	h := &Here{
 		Shape:  s,
 		ZIndex: zi,
+		Order:  order,
 		Type:   t,
 	}
-	p := 0
-	for ; p < len(n.Here) && h.ZIndex >= n.Here[p].ZIndex; p++ {
-	}
+	p := sort.Search(len(n.Here), func(i int) bool {
+		return h.Below(n.Here[i])
+	})
 	n.Here = append(n.Here, nil)
 	copy(n.Here[p+1:], n.Here[p:])
 	n.Here[p] = h
@@ -169,6 +192,184 @@ func (n *Node) Get(v int) (result []shared.Shape) {
 	return
 }
 
+// Stab returns the Here slice of the node at v or if there isn't one the node immediately before it. exact is true
+// when the node is at v, otherwise only entries which aren't of Type End cover v.
+func (n *Node) Stab(v int) (here []*Here, exact bool) {
+	for n != nil {
+		if n.Value == v {
+			return n.Here, true
+		}
+		if n.Value < v {
+			here = n.Here
+			n = n.Children[1]
+		} else {
+			n = n.Children[0]
+		}
+	}
+	return here, false
+}
+
+// Clone returns a copy of the tree below n with copies of every Here.
+func (n *Node) Clone() *Node {
+	if n == nil {
+		return nil
+	}
+	c := &Node{
+		Value:    n.Value,
+		MaxDepth: n.MaxDepth,
+		Children: [2]*Node{n.Children[0].Clone(), n.Children[1].Clone()},
+	}
+	if len(n.Here) > 0 {
+		c.Here = make([]*Here, len(n.Here))
+		for i, h := range n.Here {
+			c.Here[i] = h.Copy()
+		}
+	}
+	return c
+}
+
+// Encode writes the tree below n to e in pre-order, marking where each child is missing.
+func (n *Node) Encode(e *shared.BinaryEncoder) {
+	if n == nil {
+		e.Int(0)
+		return
+	}
+	e.Int(1)
+	e.Int(n.Value)
+	e.Int(n.MaxDepth)
+	e.Int(len(n.Here))
+	for _, h := range n.Here {
+		e.Shape(h.Shape)
+		e.Int(h.ZIndex)
+		e.Int(h.Order)
+		e.Int(int(h.Type))
+	}
+	n.Children[0].Encode(e)
+	n.Children[1].Encode(e)
+}
+
+// DecodeNode reads a tree written by Node.Encode.
+func DecodeNode(d *shared.BinaryDecoder) *Node {
+	if d.Int() != 1 {
+		return nil
+	}
+	n := &Node{
+		Value:    d.Int(),
+		MaxDepth: d.Int(),
+	}
+	if l := d.Len(); l > 0 {
+		n.Here = make([]*Here, l)
+		for i := range n.Here {
+			n.Here[i] = &Here{Shape: d.Shape(), ZIndex: d.Int(), Order: d.Int(), Type: Type(d.Int())}
+		}
+	}
+	n.Children[0] = DecodeNode(d)
+	n.Children[1] = DecodeNode(d)
+	return n
+}
+
+// check returns an error wrapping shared.ErrCorrupt if the tree below n, which is at depth, breaks the invariants the
+// map relies on: Values ordered and strictly between those of the nodes after and before, when they aren't nil, Here in stacking order with known Types and, when
+// balanced, MaxDepth the depth of the deepest node below as RecalculateDepth would set it. It also returns that depth.
+func (n *Node) check(after, before *Node, depth int, balanced bool) (int, error) {
+	if n == nil {
+		return depth - 1, nil
+	}
+	if after != nil && n.Value <= after.Value || before != nil && n.Value >= before.Value {
+		return 0, fmt.Errorf("%w: node %d is out of order", shared.ErrCorrupt, n.Value)
+	}
+	for i, h := range n.Here {
+		if h.Type != Middle && h.Type != Begin && h.Type != End {
+			return 0, fmt.Errorf("%w: node %d has an entry of type %d", shared.ErrCorrupt, n.Value, h.Type)
+		}
+		if i > 0 && !n.Here[i-1].Below(h) {
+			return 0, fmt.Errorf("%w: node %d is out of stacking order at %d", shared.ErrCorrupt, n.Value, i)
+		}
+	}
+	deepest, err := n.Children[0].check(after, n, depth+1, balanced)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.Children[1].check(n, before, depth+1, balanced)
+	if err != nil {
+		return 0, err
+	}
+	if r > deepest {
+		deepest = r
+	}
+	if balanced && n.MaxDepth != deepest {
+		return 0, fmt.Errorf("%w: node %d has depth %d want %d", shared.ErrCorrupt, n.Value, n.MaxDepth, deepest)
+	}
+	return deepest, nil
+}
+
+// First returns the Value of the first node with an entry match accepts, starting from the lowest Value when i is 0 or
+// the highest when i is 1.
+func (n *Node) First(i int, match func(h *Here) bool) (int, bool) {
+	if n == nil {
+		return 0, false
+	}
+	if v, ok := n.Children[i].First(i, match); ok {
+		return v, true
+	}
+	for _, h := range n.Here {
+		if match(h) {
+			return n.Value, true
+		}
+	}
+	return n.Children[1-i].First(i, match)
+}
+
+// Between calls f for every Here of every node with a Value within from and to inclusive.
+func (n *Node) Between(from, to int, f func(h *Here)) {
+	if n == nil {
+		return
+	}
+	if n.Value > from {
+		n.Children[0].Between(from, to, f)
+	}
+	if from <= n.Value && n.Value <= to {
+		for _, h := range n.Here {
+			f(h)
+		}
+	}
+	if n.Value < to {
+		n.Children[1].Between(from, to, f)
+	}
+}
+
+// Overlapping calls f for every Here of a shape which covers any value from to inclusive, shapes can be repeated.
+func (n *Node) Overlapping(from, to int, f func(h *Here)) {
+	here, exact := n.Stab(from)
+	if !exact {
+		for _, h := range here {
+			if h.Type != End {
+				f(h)
+			}
+		}
+	}
+	n.Between(from, to, f)
+}
+
+// CountBetween returns how many nodes have a Value within from and to inclusive, it stops counting once there are
+// more than limit.
+func (n *Node) CountBetween(from, to, limit int) int {
+	if n == nil {
+		return 0
+	}
+	count := 0
+	if from <= n.Value && n.Value <= to {
+		count++
+	}
+	if n.Value > from && count <= limit {
+		count += n.Children[0].CountBetween(from, to, limit-count)
+	}
+	if n.Value < to && count <= limit {
+		count += n.Children[1].CountBetween(from, to, limit-count)
+	}
+	return count
+}
+
 func (n *Node) AvlBalance(depth int) *Node {
 	if n == nil {
 		return nil
@@ -297,8 +498,18 @@ func (n *Node) RecalculateDepth(depth int) int {
 	return n.MaxDepth
 }
 
-func NewNode(p int, s shared.Shape, hType Type, zIndex *int, parent *Node, depth int) *Node {
-	var here []*Here
+func NewNode(p int, s shared.Shape, hType Type, zIndex *int, order int, parent *Node, depth int) *Node {
+	return newNode(nil, p, s, hType, zIndex, order, parent, depth)
+}
+
+// newNode is NewNode reusing the last node of spare, and the capacity of its Here, when there is one.
+func newNode(spare *[]*Node, p int, s shared.Shape, hType Type, zIndex *int, order int, parent *Node, depth int) *Node {
+	nn := &Node{}
+	if spare != nil && len(*spare) > 0 {
+		nn = (*spare)[len(*spare)-1]
+		*spare = (*spare)[:len(*spare)-1]
+	}
+	here := nn.Here[:0]
 	if parent != nil {
 		for _, ph := range parent.Here {
 			if ph.Shape == s {
@@ -320,21 +531,41 @@ func NewNode(p int, s shared.Shape, hType Type, zIndex *int, parent *Node, depth
 			}
 		}
 	}
-	nn := &Node{
-		Value: p,
-		Here:  here,
-	}
+	nn.Value, nn.MaxDepth, nn.Here = p, 0, here
 	if depth >= 0 {
 		nn.MaxDepth = depth + 1
 	}
-	nn.InsertHere(zIndex, s, hType)
+	nn.InsertHere(zIndex, order, s, hType)
 	return nn
 }
 
+// BoundsOnly is an option for New which skips the Shape.PointIn check, so any shape whose bounds contain a point is
+// found there. It is faster when every shape is a rectangle or when the bounds are close enough.
+type BoundsOnly bool
+
 type Struct struct {
-	VTree    *Node
-	HTree    *Node
-	Balanced bool
+	VTree      *Node
+	HTree      *Node
+	Balanced   bool
+	BoundsOnly bool
+	// Sequence orders shapes with the same z-index.
+	Sequence int
+	members  shared.Members
+	// spare holds the emptied nodes of cleared trees for Add to reuse.
+	spare []*Node
+}
+
+// Locator returns the bounds used to position a shape with bounds b in the trees. A range which begins and ends on the
+// same value would need two nodes with that value, so shapes with empty bounds are positioned at their minimum point.
+func Locator(b image.Rectangle) image.Rectangle {
+	b = b.Canon()
+	if b.Dx() == 0 {
+		b.Max.X = b.Min.X + 1
+	}
+	if b.Dy() == 0 {
+		b.Max.Y = b.Min.Y + 1
+	}
+	return b
 }
 
 func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
@@ -345,49 +576,186 @@ func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
 }
 
 func (m *Struct) Add(shape shared.Shape, zIndex int) {
-	b := shape.Bounds()
+	b := Locator(shape.Bounds())
 	var balance = -1
 	if m.Balanced {
 		balance = 0
 	}
-	m.VTree = m.VTree.AddBetween(b.Min.Y, b.Max.Y, shape, &zIndex, true, true, nil, balance)
-	m.HTree = m.HTree.AddBetween(b.Min.X, b.Max.X, shape, &zIndex, true, true, nil, balance)
+	m.Sequence++
+	m.VTree = m.VTree.addBetween(b.Min.Y, b.Max.Y, shape, &zIndex, m.Sequence, true, true, nil, balance, &m.spare)
+	m.HTree = m.HTree.addBetween(b.Min.X, b.Max.X, shape, &zIndex, m.Sequence, true, true, nil, balance, &m.spare)
+	m.members.Add(shape)
+}
+
+// Covers is the final check for a shape found at x, y by both trees. The trees include the shape's maximum edges so
+// the point is checked against the bounds, or the shape itself, again.
+func (m *Struct) Covers(s shared.Shape, x, y int) bool {
+	if m.BoundsOnly {
+		return image.Pt(x, y).In(s.Bounds())
+	}
+	return s.PointIn(x, y)
 }
 
 func (m *Struct) GetStackAt(x int, y int) []shared.Shape {
-	xs := m.HTree.Get(x)
+	return m.AppendStackAt([]shared.Shape{}, x, y)
+}
+
+// VisitStackAt calls f with each shape at x, y and its z-index, topmost first, until f returns false Both trees keep
+// their entries in stacking order, so the shapes over both x and y are found by walking them together from the top.
+func (m *Struct) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	xs, xExact := m.HTree.Stab(x)
+	ys, yExact := m.VTree.Stab(y)
+	i, j := len(xs)-1, len(ys)-1
+	for i >= 0 && j >= 0 {
+		h, v := xs[i], ys[j]
+		switch {
+		case !xExact && h.Type == End:
+			i--
+		case !yExact && v.Type == End:
+			j--
+		case h.Below(v):
+			j--
+		case v.Below(h):
+			i--
+		default:
+			i--
+			j--
+			if h.Shape == v.Shape && m.Covers(v.Shape, x, y) && !f(v.Shape, v.ZIndex) {
+				return
+			}
+		}
+	}
+}
+
+// AppendStackAt appends the shapes at x, y to dst, topmost first, and returns the extended slice.
+func (m *Struct) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		dst = append(dst, shape)
+		return true
+	})
+	return dst
+}
+
+func (m *Struct) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	return shared.PointArray(m.pointsIn(r, mode)).Shapes()
+}
+
+// GetZStackIn is GetStackIn with the z-index of each shape.
+func (m *Struct) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	return shared.PointArray(m.pointsIn(r, mode)).ZShapes()
+}
+
+// GetZStackAt is GetStackAt with the z-index of each shape.
+func (m *Struct) GetZStackAt(x, y int) []shared.ZShape {
+	result := []shared.ZShape{}
+	m.VisitStackAt(x, y, func(shape shared.Shape, zIndex int) bool {
+		result = append(result, shared.ZShape{Shape: shape, ZIndex: zIndex})
+		return true
+	})
+	return result
+}
+
+// pointsIn returns the points of the shapes matching r, topmost first.
+func (m *Struct) pointsIn(r image.Rectangle, mode shared.Containment) []*shared.Point {
+	if r.Empty() {
+		return nil
+	}
+	xs := map[shared.Shape]struct{}{}
+	m.HTree.Overlapping(r.Min.X, r.Max.X-1, func(h *Here) {
+		xs[h.Shape] = struct{}{}
+	})
 	if len(xs) == 0 {
-		return []shared.Shape{}
+		return nil
 	}
-	ys := m.VTree.Get(y)
-	if len(ys) == 0 {
-		return []shared.Shape{}
+	seen := make(map[shared.Shape]struct{}, len(xs))
+	var found []*shared.Point
+	m.VTree.Overlapping(r.Min.Y, r.Max.Y-1, func(h *Here) {
+		if _, ok := xs[h.Shape]; !ok {
+			return
+		}
+		if _, ok := seen[h.Shape]; ok {
+			return
+		}
+		seen[h.Shape] = struct{}{}
+		if mode.Match(h.Shape.Bounds(), r) {
+			found = append(found, &shared.Point{Shape: h.Shape, ZIndex: h.ZIndex, Order: h.Order})
+		}
+	})
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	return found
+}
+
+// Nearest returns the shape nearest to x, y, or nil when there are none.
+func (m *Struct) Nearest(x, y int) shared.Shape {
+	if s := m.KNearest(x, y, 1, math.Inf(1)); len(s) > 0 {
+		return s[0]
 	}
+	return nil
+}
+
+// KNearest returns up to k shapes no further than maxDistance from x, y, nearest first. The trees prune the search to the windows around the point.
+func (m *Struct) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	return shared.KNearest(x, y, k, maxDistance, m.extent(), func(r image.Rectangle) []shared.Shape {
+		return m.GetStackIn(r, shared.Intersects)
+	})
+}
 
-	if len(xs)*len(ys) < 64 {
-		result := make([]shared.Shape, 0, len(ys))
-		for _, yVal := range ys {
-			for _, xVal := range xs {
-				if xVal == yVal {
-					result = append(result, yVal)
-					break
+// SegmentCast returns the shapes crossed by the line from x0, y0 to x1, y1 in order of first contact. The line is
+// followed in pieces which each cross few interval ends, and only the shapes overlapping a piece in both trees are
+// checked.
+func (m *Struct) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	found := map[shared.Shape]*shared.Point{}
+	shared.CoverSegment(x0, y0, x1, y1, func(r image.Rectangle) bool {
+		return m.HTree.CountBetween(r.Min.X, r.Max.X-1, 2) <= 2 && m.VTree.CountBetween(r.Min.Y, r.Max.Y-1, 2) <= 2
+	}, func(r image.Rectangle) {
+		xs := map[shared.Shape]struct{}{}
+		m.HTree.Overlapping(r.Min.X, r.Max.X-1, func(h *Here) {
+			xs[h.Shape] = struct{}{}
+		})
+		m.VTree.Overlapping(r.Min.Y, r.Max.Y-1, func(h *Here) {
+			if _, ok := xs[h.Shape]; !ok {
+				return
+			}
+			// A shape added more than once is stacked where its topmost copy is.
+			if p, ok := found[h.Shape]; ok {
+				if q := (&shared.Point{ZIndex: h.ZIndex, Order: h.Order}); p.Below(q) {
+					p.ZIndex, p.Order = q.ZIndex, q.Order
 				}
+				return
 			}
-		}
-		return result
+			if shared.SegmentOverlaps(h.Shape.Bounds(), x0, y0, x1, y1) {
+				found[h.Shape] = &shared.Point{Shape: h.Shape, ZIndex: h.ZIndex, Order: h.Order}
+			}
+		})
+	})
+	points := make([]*shared.Point, 0, len(found))
+	for _, p := range found {
+		points = append(points, p)
 	}
-
-	seen := make(map[shared.Shape]struct{}, len(xs))
-	for _, e := range xs {
-		seen[e] = struct{}{}
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	candidates := make([]shared.Shape, 0, len(points))
+	for _, p := range points {
+		candidates = append(candidates, p.Shape)
 	}
-	result := make([]shared.Shape, 0, len(ys))
-	for _, e := range ys {
-		if _, ok := seen[e]; ok {
-			result = append(result, e)
-		}
+	return shared.Cast(x0, y0, x1, y1, candidates)
+}
+
+// RayCast returns the shapes crossed by a ray from x, y in the direction dx, dy, no further than maxDistance which can
+// be +Inf, in order of first contact.
+func (m *Struct) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	return shared.RayCast(x, y, dx, dy, maxDistance, m.extent(), m.SegmentCast)
+}
+
+// extent returns the area between the first and last node of each tree, it is empty when there are no shapes.
+func (m *Struct) extent() image.Rectangle {
+	if m.HTree == nil || m.VTree == nil {
+		return image.Rectangle{}
 	}
-	return result
+	minX, _ := m.HTree.Most(0)
+	maxX, _ := m.HTree.Most(1)
+	minY, _ := m.VTree.Most(0)
+	maxY, _ := m.VTree.Most(1)
+	return image.Rect(minX.Value, minY.Value, maxX.Value, maxY.Value)
 }
 
 func (m *Struct) Unbalance() *Struct {
@@ -395,10 +763,17 @@ func (m *Struct) Unbalance() *Struct {
 	return m
 }
 
-func New() *Struct {
-	return &Struct{
+func New(ops ...shared.Op) *Struct {
+	m := &Struct{
 		Balanced: true,
 	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case BoundsOnly:
+			m.BoundsOnly = bool(op)
+		}
+	}
+	return m
 }
 
 func (n *Node) RemoveBetween(from, to int, s shared.Shape, depth int) (*Node, bool) {
@@ -427,7 +802,7 @@ func (n *Node) RemoveBetween(from, to int, s shared.Shape, depth int) (*Node, bo
 	}
 	if r.Value > from {
 		var d bool
-		n.Children[0], d = r.Children[0].RemoveBetween(from, to, s, nDepth)
+		r.Children[0], d = r.Children[0].RemoveBetween(from, to, s, nDepth)
 		deleted = deleted || d
 	}
 	if r.Value < to {
@@ -474,7 +849,7 @@ func (n *Node) DeleteNode() *Node {
 	if np != nil {
 		np.Children[0] = nn.Children[1]
 	} else {
-		n.Children[1] = nil
+		n.Children[1] = nn.Children[1]
 	}
 	nn.Children = n.Children
 	return nn
@@ -495,19 +870,323 @@ func (n *Node) Most(i int) (*Node, *Node) {
 }
 
 func (m *Struct) Remove(shape shared.Shape) {
-	b := shape.Bounds()
+	b := Locator(shape.Bounds())
 	var balance = -1
 	if m.Balanced {
 		balance = 0
 	}
 	m.VTree, _ = m.VTree.RemoveBetween(b.Min.Y, b.Max.Y, shape, balance)
 	m.HTree, _ = m.HTree.RemoveBetween(b.Min.X, b.Max.X, shape, balance)
+	m.members.Remove(shape)
 }
 
-func (m *Struct) GetAt(x int, y int) shared.Shape {
-	s := m.GetStackAt(x, y)
-	if len(s) > 0 {
-		return s[0]
+// Find returns the Here of shape in the node at v.
+func (n *Node) Find(v int, shape shared.Shape) *Here {
+	here, exact := n.Stab(v)
+	if !exact {
+		return nil
+	}
+	for _, h := range here {
+		if h.Shape == shape {
+			return h
+		}
+	}
+	return nil
+}
+
+// FindAll returns the Here for each time shape was added starting at v, bottom first.
+func (n *Node) FindAll(v int, shape shared.Shape) (found []*Here) {
+	here, _ := n.Stab(v)
+	for _, h := range here {
+		if h.Shape == shape && h.Type != End {
+			found = append(found, h)
+		}
+	}
+	return found
+}
+
+// Update moves shape from oldBounds to its current bounds, only the tree for an axis which has changed is modified.
+func (m *Struct) Update(shape shared.Shape, oldBounds image.Rectangle) {
+	b := Locator(shape.Bounds())
+	oldBounds = Locator(oldBounds)
+	if b == oldBounds {
+		return
+	}
+	// A shape added more than once has every copy moved, each keeping its z-index and order.
+	var copies []Here
+	for _, h := range m.VTree.FindAll(oldBounds.Min.Y, shape) {
+		copies = append(copies, *h)
+	}
+	if len(copies) == 0 {
+		return
+	}
+	var balance = -1
+	if m.Balanced {
+		balance = 0
+	}
+	if b.Min.Y != oldBounds.Min.Y || b.Max.Y != oldBounds.Max.Y {
+		m.VTree, _ = m.VTree.RemoveBetween(oldBounds.Min.Y, oldBounds.Max.Y, shape, balance)
+		for _, c := range copies {
+			zIndex := c.ZIndex
+			m.VTree = m.VTree.addBetween(b.Min.Y, b.Max.Y, shape, &zIndex, c.Order, true, true, nil, balance, &m.spare)
+		}
+	}
+	if b.Min.X != oldBounds.Min.X || b.Max.X != oldBounds.Max.X {
+		m.HTree, _ = m.HTree.RemoveBetween(oldBounds.Min.X, oldBounds.Max.X, shape, balance)
+		for _, c := range copies {
+			zIndex := c.ZIndex
+			m.HTree = m.HTree.addBetween(b.Min.X, b.Max.X, shape, &zIndex, c.Order, true, true, nil, balance, &m.spare)
+		}
+	}
+}
+
+func (m *Struct) Move(shape shared.Resizable, bounds image.Rectangle) {
+	oldBounds := shape.Bounds()
+	shape.SetBounds(bounds)
+	m.Update(shape, oldBounds)
+}
+
+// ZIndexOf returns the z-index of shape, or of its topmost copy when it was added more than once.
+func (m *Struct) ZIndexOf(shape shared.Shape) (int, bool) {
+	if found := m.VTree.FindAll(Locator(shape.Bounds()).Min.Y, shape); len(found) > 0 {
+		return found[len(found)-1].ZIndex, true
+	}
+	return 0, false
+}
+
+// Walk calls f for every node in order.
+func (n *Node) Walk(f func(n *Node)) {
+	if n == nil {
+		return
+	}
+	n.Children[0].Walk(f)
+	f(n)
+	n.Children[1].Walk(f)
+}
+
+// ReZIndex moves every Here of s in the nodes from to inclusive to zIndex. The copies of a shape added more than once
+// are given orders counting up from order, keeping their order.
+func (n *Node) ReZIndex(from, to int, s shared.Shape, zIndex int, order int) {
+	if n == nil {
+		return
+	}
+	if n.Value > from {
+		n.Children[0].ReZIndex(from, to, s, zIndex, order)
+	}
+	if n.Value < to {
+		n.Children[1].ReZIndex(from, to, s, zIndex, order)
+	}
+	if n.Value < from || n.Value > to {
+		return
+	}
+	var moved []*Here
+	kept := n.Here[:0]
+	for _, h := range n.Here {
+		if h.Shape == s {
+			moved = append(moved, h)
+		} else {
+			kept = append(kept, h)
+		}
+	}
+	for i := len(kept); i < len(n.Here); i++ {
+		n.Here[i] = nil
+	}
+	n.Here = kept
+	// A copy can have more than one Here in a node, each copy is counted once.
+	copies := -1
+	for i, h := range moved {
+		if i == 0 || h.ZIndex != moved[i-1].ZIndex || h.Order != moved[i-1].Order {
+			copies++
+		}
+		n.InsertHere(&zIndex, order+copies, s, h.Type)
+	}
+}
+
+// SetZIndex changes the z-index of shape, keeping the order of copies of a shape added more than once.
+func (m *Struct) SetZIndex(shape shared.Shape, zIndex int) {
+	b := Locator(shape.Bounds())
+	copies := len(m.VTree.FindAll(b.Min.Y, shape))
+	if copies == 0 {
+		return
+	}
+	m.VTree.ReZIndex(b.Min.Y, b.Max.Y, shape, zIndex, m.Sequence+1)
+	m.HTree.ReZIndex(b.Min.X, b.Max.X, shape, zIndex, m.Sequence+1)
+	m.Sequence += copies
+}
+
+// BringToFront restacks shape above every other shape.
+func (m *Struct) BringToFront(shape shared.Shape) {
+	shared.BringToFront(m, shape)
+}
+
+// SendToBack restacks shape below every other shape.
+func (m *Struct) SendToBack(shape shared.Shape) {
+	shared.SendToBack(m, shape)
+}
+
+// PlaceAbove restacks shape directly above other, even if that lowers it, leaving the order of the other shapes
+// unchanged.
+func (m *Struct) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	shared.PlaceAbove(m, shape, other)
+}
+
+func (m *Struct) GetAt(x int, y int) (top shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		top = shape
+		return false
+	})
+	return top
+}
+
+func (m *Struct) GetBottomAt(x int, y int) (bottom shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		bottom = shape
+		return true
+	})
+	return bottom
+}
+
+// Len returns the number of shapes.
+func (m *Struct) Len() int {
+	return m.members.Len()
+}
+
+// Contains reports if shape has been added and not removed.
+func (m *Struct) Contains(shape shared.Shape) bool {
+	return m.members.Contains(shape)
+}
+
+// All returns every shape, topmost first.
+func (m *Struct) All() []shared.Shape {
+	return shared.PointArray(m.allPoints()).Shapes()
+}
+
+// allPoints returns the point of every shape, topmost first. Each shape begins at exactly one node of HTree.
+func (m *Struct) allPoints() []*shared.Point {
+	var points []*shared.Point
+	m.HTree.Walk(func(n *Node) {
+		for _, h := range n.Here {
+			if h.Type == Begin {
+				points = append(points, &shared.Point{Shape: h.Shape, ZIndex: h.ZIndex, Order: h.Order})
+			}
+		}
+	})
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	return points
+}
+
+// Bounds returns the smallest rectangle covering every shape, shapes with empty bounds are ignored. Each edge is the
+// outermost node of its tree where a shape with non-empty bounds begins or ends.
+func (m *Struct) Bounds() image.Rectangle {
+	edge := func(t Type) func(h *Here) bool {
+		return func(h *Here) bool {
+			return h.Type == t && !h.Shape.Bounds().Empty()
+		}
 	}
+	minX, ok := m.HTree.First(0, edge(Begin))
+	if !ok {
+		return image.Rectangle{}
+	}
+	maxX, _ := m.HTree.First(1, edge(End))
+	minY, _ := m.VTree.First(0, edge(Begin))
+	maxY, _ := m.VTree.First(1, edge(End))
+	return image.Rect(minX, minY, maxX, maxY)
+}
+
+// Clear removes every shape. The nodes of the trees are emptied and kept for Add to reuse, along with the capacity of
+// their Here.
+func (m *Struct) Clear() {
+	for _, tree := range []*Node{m.VTree, m.HTree} {
+		tree.Walk(func(n *Node) {
+			m.spare = append(m.spare, n)
+		})
+	}
+	for _, n := range m.spare {
+		for i := range n.Here {
+			n.Here[i] = nil
+		}
+		n.Here = n.Here[:0]
+		n.Children = [2]*Node{}
+	}
+	m.VTree, m.HTree = nil, nil
+	m.Sequence = 0
+	m.members.Clear()
+}
+
+// Clone returns a copy which can be changed independently of m. The shapes themselves are shared.
+func (m *Struct) Clone() *Struct {
+	return &Struct{
+		VTree:      m.VTree.Clone(),
+		HTree:      m.HTree.Clone(),
+		Balanced:   m.Balanced,
+		BoundsOnly: m.BoundsOnly,
+		Sequence:   m.Sequence,
+		members:    m.members.Clone(),
+	}
+}
+
+// MarshalJSON encodes every shape with its z-index, the shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalJSON() ([]byte, error) {
+	return shared.MarshalShapes(shared.PointArray(m.allPoints()).ZShapes())
+}
+
+// UnmarshalJSON replaces the shapes of a map created with New with those encoded by MarshalJSON, stacked as they
+// were. Options given to New are kept.
+func (m *Struct) UnmarshalJSON(data []byte) error {
+	shapes, err := shared.UnmarshalShapes(data)
+	if err != nil {
+		return err
+	}
+	m.Clear()
+	for i := len(shapes) - 1; i >= 0; i-- {
+		m.Add(shapes[i].Shape, shapes[i].ZIndex)
+	}
+	return nil
+}
+
+// binaryFormat and binaryVersion mark the binary form of the trees, binaryVersion must change whenever it does.
+const (
+	binaryFormat  = "space2trees"
+	binaryVersion = 1
+)
+
+// MarshalBinary encodes both trees as they are, so UnmarshalBinary restores them without adding each shape again. The
+// shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalBinary() ([]byte, error) {
+	e := shared.NewBinaryEncoder()
+	e.Int(m.Sequence)
+	m.VTree.Encode(e)
+	m.HTree.Encode(e)
+	return e.Encode(binaryFormat, binaryVersion)
+}
+
+// UnmarshalBinary replaces the trees with those encoded by MarshalBinary, options given to New are kept. The map is
+// unchanged if data is corrupt, wrapping shared.ErrCorrupt, or from another version, wrapping shared.ErrVersion. Trees
+// which decode but break the invariants of the map are corrupt too, including the depths a balanced map keeps, so
+// trees saved by a map which isn't balanced can only be loaded by another which isn't.
+func (m *Struct) UnmarshalBinary(data []byte) error {
+	d, err := shared.NewBinaryDecoder(data, binaryFormat, binaryVersion)
+	if err != nil {
+		return err
+	}
+	sequence := d.Int()
+	vTree, hTree := DecodeNode(d), DecodeNode(d)
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	for _, tree := range []*Node{vTree, hTree} {
+		if _, err := tree.check(nil, nil, 0, m.Balanced); err != nil {
+			return err
+		}
+	}
+	m.VTree, m.HTree, m.Sequence = vTree, hTree, sequence
+	m.members.Clear()
+	hTree.Walk(func(n *Node) {
+		for _, h := range n.Here {
+			if h.Type == Begin {
+				m.members.Add(h.Shape)
+			}
+		}
+	})
 	return nil
 }
@@ -2,15 +2,28 @@ package space2trees
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"reflect"
+	"strconv"
 	"testing"
 
+	"github.com/arran4/spacemap"
 	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/simplearray"
+	"github.com/arran4/spacemap/spacemaptest"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
+// ignoreOrder leaves the insertion order and the count of shapes out of comparisons of the tree structure.
+var ignoreOrder = cmp.Options{
+	cmpopts.IgnoreFields(Here{}, "Order"),
+	cmpopts.IgnoreFields(Struct{}, "Sequence"),
+	cmpopts.IgnoreUnexported(Struct{}),
+}
+
 func NSMBalanced(shapes ...shared.Shape) func() *Struct {
 	return func() *Struct {
 		return New().AddAll(shapes...)
@@ -294,7 +307,7 @@ func TestSpaceBTreeAdd(t *testing.T) {
 				balancedDepthTest(sm.HTree, 0, t, []int{})
 			}
 			if test.Expected != nil {
-				if s := cmp.Diff(sm, test.Expected); len(s) > 0 {
+				if s := cmp.Diff(sm, test.Expected, ignoreOrder); len(s) > 0 {
 					t.Errorf("Failed stacks differ: %s", s)
 				}
 			}
@@ -405,12 +418,18 @@ func TestSpaceBTreeEndToEnd(t *testing.T) {
 		{
 			Name:     "Hit High Border",
 			Stack:    []shared.Shape{rect1},
+			Position: rect1.Max.Add(image.Pt(-1, -1)),
+			SpaceMap: NSMBalanced(rect1),
+		},
+		{
+			Name:     "Miss High Border",
+			Stack:    []shared.Shape{},
 			Position: rect1.Max,
 			SpaceMap: NSMBalanced(rect1),
 		},
 		{
 			Name:     "Miss -- Near Hit High Border",
-			Stack:    []shared.Shape{rect1},
+			Stack:    []shared.Shape{},
 			Position: rect1.Max.Add(image.Pt(1, 1)),
 			SpaceMap: NSMBalanced(rect1),
 		},
@@ -428,19 +447,19 @@ func TestSpaceBTreeEndToEnd(t *testing.T) {
 		},
 		{
 			Name:     "Hit both with 2 overlapping",
-			Stack:    []shared.Shape{rect1, rect2},
+			Stack:    []shared.Shape{rect2, rect1},
 			Position: image.Point{50, 50},
 			SpaceMap: NSMBalanced(rect1, rect2),
 		},
 		{
 			Name:     "Hit both with 2 overlapping same start",
-			Stack:    []shared.Shape{rect1, rect3},
+			Stack:    []shared.Shape{rect3, rect1},
 			Position: image.Point{20, 20},
 			SpaceMap: NSMBalanced(rect1, rect3),
 		},
 		{
 			Name:     "Hit both with 2 overlapping same end",
-			Stack:    []shared.Shape{rect1, rect4},
+			Stack:    []shared.Shape{rect4, rect1},
 			Position: image.Point{90, 90},
 			SpaceMap: NSMBalanced(rect1, rect4),
 		},
@@ -785,7 +804,7 @@ func TestStruct_Remove(t *testing.T) {
 			var expected *Struct = nil
 			if tt.Expected != nil {
 				expected = tt.Expected()
-				if s := cmp.Diff(sm, expected); len(s) > 0 {
+				if s := cmp.Diff(sm, expected, ignoreOrder); len(s) > 0 {
 					t.Errorf("Failed stacks differ: %s", s)
 				}
 			}
@@ -847,46 +866,51 @@ func TestZIndex(t *testing.T) {
 		name        string
 		Constructor func() *Struct
 		want        shared.Shape
+		bottom      shared.Shape
 	}{
 		{
-			name: "r1&2 want r2",
+			name: "r1&2 want r1 above r2",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect1, 1)
 				s.Add(rect2, 0)
 				return s
 			},
-			want: rect2,
+			want:   rect1,
+			bottom: rect2,
 		},
 		{
-			name: "r1&2 want r1",
+			name: "r1&2 want r2 above r1",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect1, 1)
 				s.Add(rect2, 2)
 				return s
 			},
-			want: rect1,
+			want:   rect2,
+			bottom: rect1,
 		},
 		{
-			name: "r2&1 want r2",
+			name: "r2&1 want r1 above r2",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect2, 0)
 				s.Add(rect1, 1)
 				return s
 			},
-			want: rect2,
+			want:   rect1,
+			bottom: rect2,
 		},
 		{
-			name: "r2&1 want r1",
+			name: "r2&1 want r2 above r1",
 			Constructor: func() *Struct {
 				s := New()
 				s.Add(rect2, 2)
 				s.Add(rect1, 1)
 				return s
 			},
-			want: rect1,
+			want:   rect2,
+			bottom: rect1,
 		},
 	}
 	for _, test := range tests {
@@ -896,6 +920,9 @@ func TestZIndex(t *testing.T) {
 			if r != test.want {
 				tt.Errorf("Failed got %s expected %s", r, test.want)
 			}
+			if r := sm.GetBottomAt(50, 50); r != test.bottom {
+				tt.Errorf("Failed got bottom %s expected %s", r, test.bottom)
+			}
 		})
 	}
 }
@@ -1017,10 +1044,400 @@ func TestNode_InsertHere(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.InsertHere(tt.ZIndex, tt.Shape, tt.Type)
+			tt.InsertHere(tt.ZIndex, 0, tt.Shape, tt.Type)
 			if diff := cmp.Diff(tt.Here, tt.Expected); diff != "" {
 				t.Errorf("Error mismatch with here and expected;\n%s", diff)
 			}
 		})
 	}
 }
+
+func TestStruct_Move(t *testing.T) {
+	tests := []struct {
+		name   string
+		Bounds image.Rectangle
+		Update bool
+		Checks map[image.Point][]string
+	}{
+		{
+			name:   "Move outside of the other",
+			Bounds: image.Rect(150, 150, 170, 170),
+			Checks: map[image.Point][]string{
+				{50, 50}:   {"rect1"},
+				{160, 160}: {"rect2"},
+				{169, 150}: {"rect2"},
+			},
+		},
+		{
+			name:   "Move along one axis",
+			Bounds: image.Rect(40, 150, 60, 170),
+			Checks: map[image.Point][]string{
+				{50, 50}:  {"rect1"},
+				{50, 160}: {"rect2"},
+			},
+		},
+		{
+			name:   "Grow to cover the other",
+			Bounds: image.Rect(0, 0, 110, 110),
+			Checks: map[image.Point][]string{
+				{5, 5}:     {"rect2"},
+				{50, 50}:   {"rect2", "rect1"},
+				{105, 105}: {"rect2"},
+			},
+		},
+		{
+			name:   "Update after bounds changed directly",
+			Bounds: image.Rect(150, 150, 170, 170),
+			Update: true,
+			Checks: map[image.Point][]string{
+				{50, 50}:   {"rect1"},
+				{160, 160}: {"rect2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+			rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+			sm := New()
+			sm.Add(rect1, 1)
+			sm.Add(rect2, 2)
+			if tt.Update {
+				oldBounds := rect2.Bounds()
+				rect2.Rectangle = tt.Bounds
+				sm.Update(rect2, oldBounds)
+			} else {
+				sm.Move(rect2, tt.Bounds)
+			}
+			for p, want := range tt.Checks {
+				got := []string{}
+				for _, s := range sm.GetStackAt(p.X, p.Y) {
+					got = append(got, s.(*shared.Rectangle).Name)
+				}
+				if diff := cmp.Diff(got, want); diff != "" {
+					t.Errorf("GetStackAt(%d, %d) = \n%s", p.X, p.Y, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestStruct_SetZIndex(t *testing.T) {
+	rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+	rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+	rect3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("rect3"))
+	rect4 := shared.NewRectangle(50, 50, 150, 150, shared.Name("rect4"))
+	tests := []struct {
+		name   string
+		Change func(s *Struct)
+		want   []shared.Shape
+		ZIndex map[shared.Shape]int
+	}{
+		{
+			name:   "Nothing changed",
+			Change: func(s *Struct) {},
+			want:   []shared.Shape{rect3, rect2, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Set lowest",
+			Change: func(s *Struct) {
+				s.SetZIndex(rect3, 0)
+			},
+			want:   []shared.Shape{rect2, rect1, rect3},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 0},
+		},
+		{
+			name: "Set to an existing z-index goes above",
+			Change: func(s *Struct) {
+				s.SetZIndex(rect1, 2)
+			},
+			want:   []shared.Shape{rect3, rect1, rect2},
+			ZIndex: map[shared.Shape]int{rect1: 2, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Bring to front",
+			Change: func(s *Struct) {
+				s.BringToFront(rect1)
+			},
+			want:   []shared.Shape{rect1, rect3, rect2},
+			ZIndex: map[shared.Shape]int{rect1: 3, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Send to back",
+			Change: func(s *Struct) {
+				s.SendToBack(rect3)
+			},
+			want:   []shared.Shape{rect2, rect1, rect3},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 0},
+		},
+		{
+			name: "Send to back when already at the back",
+			Change: func(s *Struct) {
+				s.SendToBack(rect1)
+			},
+			want:   []shared.Shape{rect3, rect2, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Place above a lower shape",
+			Change: func(s *Struct) {
+				s.PlaceAbove(rect3, rect1)
+			},
+			want:   []shared.Shape{rect2, rect3, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 1},
+		},
+		{
+			name: "Place above a higher shape",
+			Change: func(s *Struct) {
+				s.PlaceAbove(rect1, rect2)
+			},
+			want:   []shared.Shape{rect3, rect1, rect2},
+			ZIndex: map[shared.Shape]int{rect1: 2, rect2: 2, rect3: 3},
+		},
+		{
+			name: "Missing shapes are ignored",
+			Change: func(s *Struct) {
+				s.SetZIndex(rect4, 0)
+				s.BringToFront(rect4)
+				s.PlaceAbove(rect4, rect1)
+				s.PlaceAbove(rect1, rect4)
+			},
+			want:   []shared.Shape{rect3, rect2, rect1},
+			ZIndex: map[shared.Shape]int{rect1: 1, rect2: 2, rect3: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := New()
+			sm.Add(rect1, 1)
+			sm.Add(rect2, 2)
+			sm.Add(rect3, 3)
+			tt.Change(sm)
+			if diff := cmp.Diff(sm.GetStackAt(55, 55), tt.want); diff != "" {
+				t.Errorf("GetStackAt() = \n%s", diff)
+			}
+			if diff := cmp.Diff(sm.GetStackAt(120, 120), []shared.Shape{rect3}); diff != "" {
+				t.Errorf("GetStackAt() = \n%s", diff)
+			}
+			for shape, want := range tt.ZIndex {
+				if got, ok := sm.ZIndexOf(shape); !ok || got != want {
+					t.Errorf("ZIndexOf(%s) = %d, %v want %d", shape, got, ok, want)
+				}
+			}
+			if _, ok := sm.ZIndexOf(rect4); ok {
+				t.Errorf("ZIndexOf(%s) found a missing shape", rect4)
+			}
+		})
+	}
+}
+
+func TestNonRectangularShapes(t *testing.T) {
+	for _, shape := range []shared.Shape{
+		shared.NewCircle(50, 50, 20, shared.Name("circle")),
+		shared.NewCircle(-5, 3, 0, shared.Name("dot")),
+		shared.NewEllipse(50, 50, 30, 10, shared.Name("wide")),
+		shared.NewEllipse(-50, 20, 3, 25, shared.Name("tall")),
+		shared.NewEllipse(0, 0, 7, 0, shared.Name("line")),
+		shared.NewPolygon([]image.Point{{50, 0}, {80, 100}, {0, 35}, {100, 35}, {20, 100}}, shared.Name("star")),
+		shared.NewPolygon([]image.Point{{50, 0}, {80, 100}, {0, 35}, {100, 35}, {20, 100}}, shared.NonZero, shared.Name("filled star")),
+		shared.NewPolygon([]image.Point{{0, 0}, {40, 0}, {40, 40}, {0, 40}}, shared.Ring{{10, 10}, {30, 10}, {30, 30}, {10, 30}}, shared.Name("frame")),
+	} {
+		t.Run(fmt.Sprint(shape), func(t *testing.T) {
+			sm := New()
+			sm.Add(shape, 0)
+			b := shape.Bounds()
+			for y := b.Min.Y - 1; y <= b.Max.Y; y++ {
+				for x := b.Min.X - 1; x <= b.Max.X; x++ {
+					if got, want := sm.GetAt(x, y) != nil, shape.PointIn(x, y); got != want {
+						t.Errorf("GetAt(%d, %d) found %v want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBoundsOnly(t *testing.T) {
+	circle := shared.NewCircle(50, 50, 20, shared.Name("circle"))
+	rect := shared.NewRectangle(10, 10, 30, 30, shared.Name("rect"))
+	for _, test := range []struct {
+		Name       string
+		BoundsOnly bool
+		Checks     map[image.Point][]shared.Shape
+	}{
+		{
+			Name: "Exact",
+			Checks: map[image.Point][]shared.Shape{
+				{50, 50}: {circle},
+				{31, 31}: {},
+				{70, 50}: {circle},
+				{70, 70}: {},
+				{71, 50}: {},
+				{30, 30}: {},
+				{29, 29}: {rect},
+			},
+		},
+		{
+			Name:       "Bounds only",
+			BoundsOnly: true,
+			Checks: map[image.Point][]shared.Shape{
+				{50, 50}: {circle},
+				{31, 31}: {circle},
+				{70, 50}: {circle},
+				{70, 70}: {circle},
+				{71, 50}: {},
+				{30, 30}: {circle},
+				{29, 29}: {rect},
+			},
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			sm := New(BoundsOnly(test.BoundsOnly)).AddAll(circle, rect)
+			for p, want := range test.Checks {
+				if diff := cmp.Diff(sm.GetStackAt(p.X, p.Y), want); diff != "" {
+					t.Errorf("GetStackAt(%d, %d) = \n%s", p.X, p.Y, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestStruct_UnmarshalBinary_Invalid(t *testing.T) {
+	rect1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("rect1"))
+	rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+	rect3 := shared.NewRectangle(50, 20, 150, 70, shared.Name("rect3"))
+	for _, test := range []struct {
+		Name  string
+		Break func(m *Struct)
+	}{
+		{"Values out of order", func(m *Struct) {
+			m.HTree.Value, m.HTree.Children[0].Value = m.HTree.Children[0].Value, m.HTree.Value
+		}},
+		{"Repeated value", func(m *Struct) {
+			m.VTree.Children[1].Value = m.VTree.Value
+		}},
+		{"Here out of order", func(m *Struct) {
+			here := m.HTree.Here
+			here[0], here[len(here)-1] = here[len(here)-1], here[0]
+		}},
+		{"Unknown type", func(m *Struct) {
+			m.VTree.Here[0].Type = 7
+		}},
+		{"Wrong depth", func(m *Struct) {
+			m.VTree.MaxDepth++
+		}},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			m := New().AddAll(rect1, rect2, rect3)
+			test.Break(m)
+			data, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() error %v", err)
+			}
+			loaded := New().AddAll(rect2)
+			if err := loaded.UnmarshalBinary(data); !errors.Is(err, shared.ErrCorrupt) {
+				t.Errorf("UnmarshalBinary() = %v want a corrupt data error", err)
+			}
+			spacemaptest.CheckContents(t, loaded, rect2)
+		})
+	}
+	data, err := New().Unbalance().AddAll(rect1, rect2, rect3).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error %v", err)
+	}
+	if err := New().Unbalance().UnmarshalBinary(data); err != nil {
+		t.Errorf("UnmarshalBinary() of a tree which isn't balanced into another = %v", err)
+	}
+	if err := New().UnmarshalBinary(data); !errors.Is(err, shared.ErrCorrupt) {
+		t.Errorf("UnmarshalBinary() of a tree which isn't balanced into a balanced map = %v want a corrupt data error", err)
+	}
+}
+
+func TestStruct_Clear(t *testing.T) {
+	for _, balanced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Balanced %v", balanced), func(t *testing.T) {
+			rect1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("rect1"))
+			rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+			rect3 := shared.NewRectangle(50, 20, 150, 70, shared.Name("rect3"))
+			m := New()
+			m.Balanced = balanced
+			m.AddAll(rect1, rect2, rect3)
+			nodes := map[*Node]bool{}
+			for _, tree := range []*Node{m.VTree, m.HTree} {
+				tree.Walk(func(n *Node) {
+					nodes[n] = true
+				})
+			}
+			m.Clear()
+			spacemaptest.CheckContents(t, m)
+			if len(m.spare) != len(nodes) {
+				t.Errorf("Clear() kept %d nodes want %d", len(m.spare), len(nodes))
+			}
+			m.AddAll(rect3, rect2)
+			for _, tree := range []*Node{m.VTree, m.HTree} {
+				tree.Walk(func(n *Node) {
+					if !nodes[n] {
+						t.Errorf("Add() after Clear() made a new node %d", n.Value)
+					}
+				})
+			}
+			spacemaptest.CheckStack(t, m, 55, 55, rect2, rect3)
+			spacemaptest.CheckContents(t, m, rect2, rect3)
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	spacemaptest.Run(t, func() spacemap.Interface { return New() })
+}
+
+func TestClone(t *testing.T) {
+	spacemaptest.Clone(t, func() spacemap.Interface { return New() }, func(m spacemap.Interface) spacemap.Interface {
+		return m.(*Struct).Clone()
+	})
+}
+
+func TestAddAll(t *testing.T) {
+	spacemaptest.AddAll(t, func() spacemap.Interface { return New() }, func(m spacemap.Interface, shapes ...shared.Shape) {
+		m.(*Struct).AddAll(shapes...)
+	})
+}
+
+// regressions are minimised sequences found by FuzzDifferential.
+var regressions = [][]spacemaptest.Step{
+	{
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(24, 24, 32, 24), ZIndex: -1},
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(24, 24, 32, 32), ZIndex: -1},
+		{Action: spacemaptest.QueryAction, Bounds: image.Rect(24, 24, 25, 25)},
+	},
+	{
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(32, 24, 40, 32), ZIndex: -1},
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(24, 24, 33, 32), ZIndex: -1},
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(-18, 24, -10, 32), ZIndex: -1},
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(25, 24, 33, 32), ZIndex: -1},
+		{Action: spacemaptest.AddAction, Bounds: image.Rect(16, 24, 16, 32), ZIndex: -1},
+		{Action: spacemaptest.RemoveAction, Shape: 4},
+	},
+}
+
+func newDifferential() spacemap.Interface {
+	return New()
+}
+
+func TestRegressions(t *testing.T) {
+	for i, steps := range regressions {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			spacemaptest.Differential(t, steps, func() spacemap.Interface { return simplearray.New() }, newDifferential)
+		})
+	}
+}
+
+func FuzzDifferential(f *testing.F) {
+	for _, steps := range regressions {
+		f.Add(spacemaptest.EncodeSteps(steps...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		spacemaptest.Differential(t, spacemaptest.DecodeSteps(data), func() spacemap.Interface { return simplearray.New() }, newDifferential)
+	})
+}
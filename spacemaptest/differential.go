@@ -0,0 +1,224 @@
+package spacemaptest
+
+import (
+	"image"
+	"strconv"
+	"testing"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+)
+
+// Action is what a Step does.
+type Action int
+
+const (
+	// AddAction adds a rectangle with the Step's Bounds and ZIndex.
+	AddAction Action = iota
+	// RemoveAction removes the Shape'th shape added so far, counting removed shapes.
+	RemoveAction
+	// QueryAction compares the stacks at Bounds.Min.
+	QueryAction
+	// MoveAction moves the Shape'th shape added so far to Bounds with Update, unless it was removed.
+	MoveAction
+	// ZIndexAction changes the z-index of the Shape'th shape added so far to ZIndex with SetZIndex, unless it was
+	// removed.
+	ZIndexAction
+)
+
+// actions is the number of actions DecodeSteps chooses from.
+const actions = 5
+
+func (a Action) String() string {
+	switch a {
+	case AddAction:
+		return "Add"
+	case RemoveAction:
+		return "Remove"
+	case QueryAction:
+		return "Query"
+	case MoveAction:
+		return "Move"
+	case ZIndexAction:
+		return "SetZIndex"
+	}
+	return "Unknown"
+}
+
+// Step is a single operation replayed against both maps by Differential.
+type Step struct {
+	Action Action
+	Shape  int
+	Bounds image.Rectangle
+	ZIndex int
+}
+
+func (s Step) String() string {
+	switch s.Action {
+	case AddAction:
+		return "Add(" + s.Bounds.String() + ", " + strconv.Itoa(s.ZIndex) + ")"
+	case RemoveAction:
+		return "Remove(" + strconv.Itoa(s.Shape) + ")"
+	case QueryAction:
+		return "Query(" + s.Bounds.Min.String() + ")"
+	case MoveAction:
+		return "Move(" + strconv.Itoa(s.Shape) + ", " + s.Bounds.String() + ")"
+	case ZIndexAction:
+		return "SetZIndex(" + strconv.Itoa(s.Shape) + ", " + strconv.Itoa(s.ZIndex) + ")"
+	}
+	return "Unknown"
+}
+
+const (
+	// StepSize is the number of bytes DecodeSteps reads for each Step.
+	StepSize = 6
+	// MaxSteps is the most steps DecodeSteps returns, so every input replays quickly.
+	MaxSteps = 128
+)
+
+// DecodeSteps turns fuzzer input into steps. Coordinates are kept small so shapes overlap and share edges often.
+func DecodeSteps(data []byte) []Step {
+	var steps []Step
+	for ; len(data) >= StepSize && len(steps) < MaxSteps; data = data[StepSize:] {
+		x, y := int(int8(data[1]))/2, int(int8(data[2]))/2
+		s := Step{
+			Action: Action(data[0] % actions),
+			Shape:  int(data[1]),
+			ZIndex: int(data[5]%4) - 1,
+		}
+		switch s.Action {
+		case AddAction:
+			s.Bounds = image.Rect(x, y, x+int(data[3]%40), y+int(data[4]%40))
+		case MoveAction:
+			s.Bounds = image.Rect(x, y, x+int(data[3]%40), y+int(data[4]%40))
+			s.Shape = int(data[5])
+		case QueryAction:
+			s.Bounds = image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+1, y+1)}
+		}
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+// EncodeSteps is the reverse of DecodeSteps, for adding steps to a fuzz corpus. Coordinates must be within -64 to 63
+// and sizes less than 40.
+func EncodeSteps(steps ...Step) []byte {
+	var data []byte
+	for _, s := range steps {
+		b := make([]byte, StepSize)
+		b[0] = byte(s.Action)
+		b[1], b[2] = byte(int8(s.Bounds.Min.X*2)), byte(int8(s.Bounds.Min.Y*2))
+		b[3], b[4] = byte(s.Bounds.Dx()), byte(s.Bounds.Dy())
+		b[5] = byte(s.ZIndex + 1)
+		switch s.Action {
+		case RemoveAction, ZIndexAction:
+			b[1] = byte(s.Shape)
+		case MoveAction:
+			b[5] = byte(s.Shape)
+		}
+		data = append(data, b...)
+	}
+	return data
+}
+
+// Differential replays steps against a map from oracle and one from newMap and fails t at the first point where
+// their stacks differ. After every Add and Remove the stacks around the shape's corners are compared, and at the end
+// the stacks around every remaining shape.
+func Differential(t *testing.T, steps []Step, oracle func() spacemap.Interface, newMap func() spacemap.Interface) {
+	t.Helper()
+	want, got := oracle(), newMap()
+	var shapes []*shared.Rectangle
+	removed := map[shared.Shape]bool{}
+	compare := func(i int, r image.Rectangle) bool {
+		t.Helper()
+		for _, p := range []image.Point{r.Min, r.Max, r.Max.Sub(image.Pt(1, 1)), {r.Min.X - 1, r.Max.Y}, {r.Max.X, r.Min.Y - 1}} {
+			w, g := want.GetStackAt(p.X, p.Y), got.GetStackAt(p.X, p.Y)
+			same := len(w) == len(g)
+			for j := 0; same && j < len(w); j++ {
+				same = w[j] == g[j]
+			}
+			if !same {
+				t.Errorf("after step %d of %v GetStackAt(%d, %d) = %s want %s", i, steps[:i+1], p.X, p.Y, names(g), names(w))
+				return false
+			}
+		}
+		if w, g := want.Len(), got.Len(); w != g {
+			t.Errorf("after step %d of %v Len() = %d want %d", i, steps[:i+1], g, w)
+			return false
+		}
+		if w, g := names(want.All()), names(got.All()); w != g {
+			t.Errorf("after step %d of %v All() = %s want %s", i, steps[:i+1], g, w)
+			return false
+		}
+		if w, g := want.Bounds(), got.Bounds(); w != g {
+			t.Errorf("after step %d of %v Bounds() = %s want %s", i, steps[:i+1], g, w)
+			return false
+		}
+		return true
+	}
+	for i, s := range steps {
+		switch s.Action {
+		case AddAction:
+			shape := shared.NewRectangle(s.Bounds.Min.X, s.Bounds.Min.Y, s.Bounds.Max.X, s.Bounds.Max.Y, shared.Name(strconv.Itoa(len(shapes))))
+			shapes = append(shapes, shape)
+			want.Add(shape, s.ZIndex)
+			got.Add(shape, s.ZIndex)
+			if !compare(i, s.Bounds) {
+				return
+			}
+		case RemoveAction:
+			if len(shapes) == 0 {
+				continue
+			}
+			shape := shapes[s.Shape%len(shapes)]
+			removed[shape] = true
+			want.Remove(shape)
+			got.Remove(shape)
+			if !compare(i, shape.Bounds()) {
+				return
+			}
+		case MoveAction:
+			if len(shapes) == 0 {
+				continue
+			}
+			shape := shapes[s.Shape%len(shapes)]
+			wu, wok := want.(spacemap.Updater)
+			gu, gok := got.(spacemap.Updater)
+			if removed[shape] || !wok || !gok {
+				continue
+			}
+			// Both maps hold the same shape, so its bounds are changed once and both are told the old bounds.
+			oldBounds := shape.Bounds()
+			shape.Rectangle = s.Bounds
+			wu.Update(shape, oldBounds)
+			gu.Update(shape, oldBounds)
+			if !compare(i, oldBounds) || !compare(i, s.Bounds) {
+				return
+			}
+		case ZIndexAction:
+			if len(shapes) == 0 {
+				continue
+			}
+			shape := shapes[s.Shape%len(shapes)]
+			wz, wok := want.(spacemap.ZOrderer)
+			gz, gok := got.(spacemap.ZOrderer)
+			if removed[shape] || !wok || !gok {
+				continue
+			}
+			wz.SetZIndex(shape, s.ZIndex)
+			gz.SetZIndex(shape, s.ZIndex)
+			if !compare(i, shape.Bounds()) {
+				return
+			}
+		case QueryAction:
+			if !compare(i, s.Bounds) {
+				return
+			}
+		}
+	}
+	for _, shape := range shapes {
+		if !removed[shape] && !compare(len(steps)-1, shape.Bounds()) {
+			return
+		}
+	}
+}
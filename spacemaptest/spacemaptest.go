@@ -0,0 +1,963 @@
+// Package spacemaptest checks a spacemap.Interface against the behaviour shared by every implementation in this
+// module, so a new or third party implementation can be validated with:
+//
+//	func TestConformance(t *testing.T) {
+//		spacemaptest.Run(t, func() spacemap.Interface { return New() })
+//	}
+package spacemaptest
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+)
+
+// Test is a single conformance test, it is given a new empty map.
+type Test struct {
+	Name string
+	Run  func(t *testing.T, m spacemap.Interface)
+}
+
+// Tests is every conformance test Run runs. Tests for the optional interfaces skip when the map doesn't implement them.
+var Tests = []Test{
+	{"Empty", testEmpty},
+	{"Introspection", testIntrospection},
+	{"AddAndGet", testAddAndGet},
+	{"Borders", testBorders},
+	{"Remove", testRemove},
+	{"RemoveMissing", testRemoveMissing},
+	{"ReAdd", testReAdd},
+	{"ZOrder", testZOrder},
+	{"EqualZIndex", testEqualZIndex},
+	{"Overlap", testOverlap},
+	{"NegativeCoordinates", testNegativeCoordinates},
+	{"Duplicates", testDuplicates},
+	{"EmptyShapes", testEmptyShapes},
+	{"NonRectangular", testNonRectangular},
+	{"RegionQuery", testRegionQuery},
+	{"RegionQueryEdges", testRegionQueryEdges},
+	{"Update", testUpdate},
+	{"UpdateDuplicate", testUpdateDuplicate},
+	{"ZOrderer", testZOrderer},
+	{"ZOrdererDuplicate", testZOrdererDuplicate},
+	{"Nearest", testNearest},
+	{"Cast", testCast},
+	{"StackVisitor", testStackVisitor},
+	{"ZQuerier", testZQuerier},
+	{"Clear", testClear},
+	{"JSON", testJSON},
+	{"Binary", testBinary},
+}
+
+// Run runs every test in Tests as a sub test of t, newMap must return a new empty map each time it is called.
+func Run(t *testing.T, newMap func() spacemap.Interface) {
+	for _, test := range Tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			test.Run(t, newMap())
+		})
+	}
+}
+
+func names(shapes []shared.Shape) string {
+	s := make([]string, 0, len(shapes))
+	for _, shape := range shapes {
+		s = append(s, shape.String())
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+// CheckStack fails t unless the stack at x, y is want, topmost first, and GetAt and GetBottomAt agree with it, as does
+// AppendStackAt when m is a spacemap.StackVisitor.
+func CheckStack(t *testing.T, m spacemap.Interface, x, y int, want ...shared.Shape) {
+	t.Helper()
+	got := m.GetStackAt(x, y)
+	same := len(got) == len(want)
+	for i := 0; same && i < len(got); i++ {
+		same = got[i] == want[i]
+	}
+	if !same {
+		t.Errorf("GetStackAt(%d, %d) = %s want %s", x, y, names(got), names(want))
+	}
+	var top, bottom shared.Shape
+	if len(want) > 0 {
+		top, bottom = want[0], want[len(want)-1]
+	}
+	if got := m.GetAt(x, y); got != top {
+		t.Errorf("GetAt(%d, %d) = %v want %v", x, y, got, top)
+	}
+	if got := m.GetBottomAt(x, y); got != bottom {
+		t.Errorf("GetBottomAt(%d, %d) = %v want %v", x, y, got, bottom)
+	}
+	if v, ok := m.(spacemap.StackVisitor); ok {
+		got := v.AppendStackAt(nil, x, y)
+		same := len(got) == len(want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == want[i]
+		}
+		if !same {
+			t.Errorf("AppendStackAt(nil, %d, %d) = %s want %s", x, y, names(got), names(want))
+		}
+	}
+}
+
+// CheckContents fails t unless m holds exactly want, topmost first, as reported by Len, Contains, All and Bounds.
+func CheckContents(t *testing.T, m spacemap.Interface, want ...shared.Shape) {
+	t.Helper()
+	if got := m.Len(); got != len(want) {
+		t.Errorf("Len() = %d want %d", got, len(want))
+	}
+	var bounds image.Rectangle
+	for _, s := range want {
+		if !m.Contains(s) {
+			t.Errorf("Contains(%s) = false", s)
+		}
+		if b := s.Bounds(); !b.Empty() {
+			bounds = bounds.Union(b)
+		}
+	}
+	if got, want := names(m.All()), names(want); got != want {
+		t.Errorf("All() = %s want %s", got, want)
+	}
+	if got := m.Bounds(); got != bounds {
+		t.Errorf("Bounds() = %s want %s", got, bounds)
+	}
+}
+
+func testEmpty(t *testing.T, m spacemap.Interface) {
+	CheckContents(t, m)
+	CheckStack(t, m, 0, 0)
+	CheckStack(t, m, -10, 25)
+	m.Remove(shared.NewRectangle(0, 0, 10, 10))
+	CheckStack(t, m, 5, 5)
+}
+
+func testAddAndGet(t *testing.T, m spacemap.Interface) {
+	r := shared.NewRectangle(10, 10, 100, 100, shared.Name("r"))
+	m.Add(r, 0)
+	CheckStack(t, m, 10, 10, r)
+	CheckStack(t, m, 50, 50, r)
+	CheckStack(t, m, 99, 99, r)
+	CheckStack(t, m, 5, 50)
+	CheckStack(t, m, 150, 150)
+}
+
+func testBorders(t *testing.T, m spacemap.Interface) {
+	r := shared.NewRectangle(10, 20, 30, 40, shared.Name("r"))
+	m.Add(r, 0)
+	for _, p := range []image.Point{{10, 20}, {29, 20}, {10, 39}, {29, 39}} {
+		CheckStack(t, m, p.X, p.Y, r)
+	}
+	for _, p := range []image.Point{{9, 20}, {10, 19}, {30, 20}, {10, 40}, {30, 40}, {9, 19}} {
+		CheckStack(t, m, p.X, p.Y)
+	}
+}
+
+func testRemove(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("r3"))
+	m.Add(r1, 0)
+	m.Add(r2, 0)
+	m.Add(r3, 0)
+	m.Remove(r2)
+	CheckStack(t, m, 45, 45, r1)
+	CheckStack(t, m, 55, 55, r3, r1)
+	m.Remove(r1)
+	CheckStack(t, m, 20, 20)
+	CheckStack(t, m, 55, 55, r3)
+	m.Remove(r3)
+	CheckStack(t, m, 55, 55)
+	CheckStack(t, m, 120, 120)
+}
+
+func testRemoveMissing(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	m.Add(r1, 0)
+	m.Remove(shared.NewRectangle(10, 10, 100, 100, shared.Name("copy")))
+	m.Remove(shared.NewRectangle(200, 200, 300, 300, shared.Name("elsewhere")))
+	CheckStack(t, m, 50, 50, r1)
+	m.Remove(r1)
+	m.Remove(r1)
+	CheckStack(t, m, 50, 50)
+}
+
+func testReAdd(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r2"))
+	m.Add(r1, 0)
+	m.Add(r2, 0)
+	CheckStack(t, m, 50, 50, r2, r1)
+	m.Remove(r1)
+	m.Add(r1, 0)
+	CheckStack(t, m, 50, 50, r1, r2)
+}
+
+func testZOrder(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(20, 20, 90, 90, shared.Name("r2"))
+	r3 := shared.NewRectangle(30, 30, 80, 80, shared.Name("r3"))
+	m.Add(r2, 5)
+	m.Add(r1, 10)
+	m.Add(r3, -3)
+	CheckStack(t, m, 50, 50, r1, r2, r3)
+	CheckStack(t, m, 25, 25, r1, r2)
+	CheckStack(t, m, 15, 15, r1)
+}
+
+func testEqualZIndex(t *testing.T, m spacemap.Interface) {
+	var shapes []shared.Shape
+	for i := 0; i < 6; i++ {
+		shapes = append(shapes, shared.NewRectangle(i*5, i*5, 100-i*5, 100-i*5, shared.Name("r"+strconv.Itoa(i))))
+	}
+	for _, s := range shapes {
+		m.Add(s, 1)
+	}
+	below := shared.NewRectangle(0, 0, 100, 100, shared.Name("below"))
+	m.Add(below, 0)
+	want := []shared.Shape{}
+	for i := len(shapes) - 1; i >= 0; i-- {
+		want = append(want, shapes[i])
+	}
+	want = append(want, below)
+	CheckStack(t, m, 50, 50, want...)
+	m.Remove(shapes[2])
+	want = append(want[:3], want[4:]...)
+	CheckStack(t, m, 50, 50, want...)
+}
+
+func testOverlap(t *testing.T, m spacemap.Interface) {
+	left := shared.NewRectangle(0, 0, 60, 100, shared.Name("left"))
+	right := shared.NewRectangle(40, 0, 100, 100, shared.Name("right"))
+	top := shared.NewRectangle(0, 0, 100, 30, shared.Name("top"))
+	m.Add(left, 1)
+	m.Add(right, 2)
+	m.Add(top, 0)
+	CheckStack(t, m, 10, 50, left)
+	CheckStack(t, m, 50, 50, right, left)
+	CheckStack(t, m, 90, 50, right)
+	CheckStack(t, m, 50, 10, right, left, top)
+	CheckStack(t, m, 10, 10, left, top)
+	CheckStack(t, m, 90, 10, right, top)
+}
+
+func testNegativeCoordinates(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(-100, -100, -10, -10, shared.Name("r1"))
+	r2 := shared.NewRectangle(-20, -20, 20, 20, shared.Name("r2"))
+	r3 := shared.NewRectangle(-1000000, 5, -999990, 15, shared.Name("r3"))
+	m.Add(r1, 0)
+	m.Add(r2, 1)
+	m.Add(r3, 2)
+	CheckStack(t, m, -50, -50, r1)
+	CheckStack(t, m, -15, -15, r2, r1)
+	CheckStack(t, m, -1, -1, r2)
+	CheckStack(t, m, 0, 0, r2)
+	CheckStack(t, m, -10, -10, r2)
+	CheckStack(t, m, -101, -50)
+	CheckStack(t, m, -999995, 10, r3)
+	CheckStack(t, m, -999990, 10)
+}
+
+func testDuplicates(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(10, 10, 20, 20, shared.Name("same"))
+	r2 := shared.NewRectangle(10, 10, 20, 20, shared.Name("same"))
+	r3 := shared.NewRectangle(10, 10, 20, 20, shared.Name("same"))
+	m.Add(r1, 0)
+	m.Add(r2, 0)
+	m.Add(r3, 0)
+	CheckStack(t, m, 15, 15, r3, r2, r1)
+	m.Remove(r2)
+	CheckStack(t, m, 15, 15, r3, r1)
+	m.Remove(r3)
+	CheckStack(t, m, 15, 15, r1)
+}
+
+func testEmptyShapes(t *testing.T, m spacemap.Interface) {
+	empty := shared.NewRectangle(10, 10, 10, 10, shared.Name("empty"))
+	r := shared.NewRectangle(0, 0, 20, 20, shared.Name("r"))
+	m.Add(empty, 1)
+	m.Add(r, 0)
+	CheckStack(t, m, 10, 10, r)
+	m.Remove(empty)
+	CheckStack(t, m, 10, 10, r)
+	m.Remove(r)
+	CheckStack(t, m, 10, 10)
+}
+
+func testNonRectangular(t *testing.T, m spacemap.Interface) {
+	circle := shared.NewCircle(50, 50, 20, shared.Name("circle"))
+	ring := shared.NewPolygon([]image.Point{{0, 0}, {40, 0}, {40, 40}, {0, 40}}, shared.Ring{{10, 10}, {30, 10}, {30, 30}, {10, 30}}, shared.Name("ring"))
+	m.Add(circle, 0)
+	m.Add(ring, 0)
+	CheckStack(t, m, 50, 50, circle)
+	CheckStack(t, m, 31, 69)
+	CheckStack(t, m, 69, 69)
+	CheckStack(t, m, 39, 39, ring, circle)
+	CheckStack(t, m, 31, 31, ring)
+	CheckStack(t, m, 20, 20)
+	CheckStack(t, m, 5, 5, ring)
+}
+
+func testRegionQuery(t *testing.T, m spacemap.Interface) {
+	q, ok := m.(spacemap.RegionQuerier)
+	if !ok {
+		t.Skip("not a spacemap.RegionQuerier")
+	}
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(-50, -50, -40, -40, shared.Name("r3"))
+	m.Add(r1, 0)
+	m.Add(r2, 1)
+	m.Add(r3, 2)
+	for _, test := range []struct {
+		Region image.Rectangle
+		Mode   shared.Containment
+		Want   []shared.Shape
+	}{
+		{image.Rect(45, 45, 50, 50), shared.Intersects, []shared.Shape{r2, r1}},
+		{image.Rect(-100, -100, 200, 200), shared.Intersects, []shared.Shape{r3, r2, r1}},
+		{image.Rect(100, 100, 110, 110), shared.Intersects, nil},
+		{image.Rect(0, 0, 70, 70), shared.Within, []shared.Shape{r2}},
+		{image.Rect(-50, -50, 100, 100), shared.Within, []shared.Shape{r3, r2, r1}},
+		{image.Rect(50, 50, 50, 50), shared.Intersects, nil},
+	} {
+		got := q.GetStackIn(test.Region, test.Mode)
+		same := len(got) == len(test.Want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == test.Want[i]
+		}
+		if !same {
+			t.Errorf("GetStackIn(%s, %s) = %s want %s", test.Region, test.Mode, names(got), names(test.Want))
+		}
+	}
+}
+
+// testRegionQueryEdges checks the edges of regions and shapes which only touch, each shape ends where another begins.
+func testRegionQueryEdges(t *testing.T, m spacemap.Interface) {
+	q, ok := m.(spacemap.RegionQuerier)
+	if !ok {
+		t.Skip("not a spacemap.RegionQuerier")
+	}
+	rect1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("rect1"))
+	rect2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("rect2"))
+	rect3 := shared.NewRectangle(10, 10, 60, 60, shared.Name("rect3"))
+	rect4 := shared.NewRectangle(60, 60, 100, 100, shared.Name("rect4"))
+	rect5 := shared.NewRectangle(100, 100, 200, 200, shared.Name("rect5"))
+	m.Add(rect5, 5)
+	m.Add(rect1, 1)
+	m.Add(rect4, 4)
+	m.Add(rect2, 2)
+	m.Add(rect3, 3)
+	for _, test := range []struct {
+		Name   string
+		Region image.Rectangle
+		Mode   shared.Containment
+		Want   []shared.Shape
+	}{
+		{"Intersects inside all but the diagonals", image.Rect(45, 45, 50, 50), shared.Intersects, []shared.Shape{rect3, rect2, rect1}},
+		{"Intersects ignores shapes which end at the region", image.Rect(100, 100, 110, 110), shared.Intersects, []shared.Shape{rect5}},
+		{"Intersects everything", image.Rect(0, 0, 300, 300), shared.Intersects, []shared.Shape{rect5, rect4, rect3, rect2, rect1}},
+		{"Intersects a single pixel", image.Rect(99, 99, 100, 100), shared.Intersects, []shared.Shape{rect4, rect1}},
+		{"Intersects nothing", image.Rect(-50, -50, -10, -10), shared.Intersects, nil},
+		{"Within exact fit", image.Rect(10, 10, 60, 60), shared.Within, []shared.Shape{rect3, rect2}},
+		{"Within excludes partially covered", image.Rect(50, 50, 150, 150), shared.Within, []shared.Shape{rect4}},
+		{"Empty region", image.Rect(50, 50, 50, 50), shared.Intersects, nil},
+	} {
+		got := q.GetStackIn(test.Region, test.Mode)
+		same := len(got) == len(test.Want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == test.Want[i]
+		}
+		if !same {
+			t.Errorf("%s: GetStackIn(%s, %s) = %s want %s", test.Name, test.Region, test.Mode, names(got), names(test.Want))
+		}
+	}
+}
+
+func testUpdate(t *testing.T, m spacemap.Interface) {
+	u, ok := m.(spacemap.Updater)
+	if !ok {
+		t.Skip("not a spacemap.Updater")
+	}
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r3"))
+	m.Add(r1, 0)
+	m.Add(r2, 0)
+	m.Add(r3, 0)
+	u.Move(r2, image.Rect(-30, -30, -10, -10))
+	CheckStack(t, m, 50, 50, r3, r1)
+	CheckStack(t, m, -20, -20, r2)
+	u.Move(r2, image.Rect(0, 0, 200, 200))
+	CheckStack(t, m, 50, 50, r3, r2, r1)
+	CheckStack(t, m, 150, 150, r2)
+	CheckStack(t, m, -20, -20)
+	oldBounds := r1.Bounds()
+	r1.Rectangle = image.Rect(150, 150, 160, 160)
+	u.Update(r1, oldBounds)
+	CheckStack(t, m, 50, 50, r3, r2)
+	CheckStack(t, m, 155, 155, r2, r1)
+	m.Remove(r1)
+	CheckStack(t, m, 155, 155, r2)
+}
+
+// testUpdateDuplicate checks every copy of a shape added more than once is moved.
+func testUpdateDuplicate(t *testing.T, m spacemap.Interface) {
+	u, ok := m.(spacemap.Updater)
+	if !ok {
+		t.Skip("not a spacemap.Updater")
+	}
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	m.Add(r2, 0)
+	m.Add(r1, 1)
+	m.Add(r2, 2)
+	u.Move(r2, image.Rect(150, 150, 170, 170))
+	CheckStack(t, m, 50, 50, r1)
+	CheckStack(t, m, 160, 160, r2, r2)
+	CheckContents(t, m, r2, r1, r2)
+	u.Move(r2, image.Rect(0, 0, 200, 200))
+	CheckStack(t, m, 50, 50, r2, r1, r2)
+	CheckStack(t, m, 160, 160, r2, r2)
+	m.Remove(r2)
+	CheckStack(t, m, 50, 50, r1)
+	CheckContents(t, m, r1)
+}
+
+func testZOrderer(t *testing.T, m spacemap.Interface) {
+	z, ok := m.(spacemap.ZOrderer)
+	if !ok {
+		t.Skip("not a spacemap.ZOrderer")
+	}
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("r3"))
+	m.Add(r1, 1)
+	m.Add(r2, 2)
+	m.Add(r3, 3)
+	if got, ok := z.ZIndexOf(r2); !ok || got != 2 {
+		t.Errorf("ZIndexOf(r2) = %d, %v want 2", got, ok)
+	}
+	if _, ok := z.ZIndexOf(shared.NewRectangle(40, 40, 60, 60)); ok {
+		t.Errorf("ZIndexOf found a shape which wasn't added")
+	}
+	z.SetZIndex(r3, 0)
+	CheckStack(t, m, 55, 55, r2, r1, r3)
+	z.SetZIndex(r1, 2)
+	CheckStack(t, m, 55, 55, r1, r2, r3)
+	z.BringToFront(r3)
+	CheckStack(t, m, 55, 55, r3, r1, r2)
+	z.SendToBack(r3)
+	CheckStack(t, m, 55, 55, r1, r2, r3)
+	z.PlaceAbove(r2, r1)
+	CheckStack(t, m, 55, 55, r2, r1, r3)
+	CheckStack(t, m, 120, 120, r3)
+	// PlaceAbove puts a shape directly above the other, below the shapes sharing the other's z-index above it.
+	a := shared.NewRectangle(200, 200, 210, 210, shared.Name("a"))
+	b := shared.NewRectangle(200, 200, 210, 210, shared.Name("b"))
+	c := shared.NewRectangle(200, 200, 210, 210, shared.Name("c"))
+	d := shared.NewRectangle(200, 200, 210, 210, shared.Name("d"))
+	m.Add(a, 5)
+	m.Add(b, 5)
+	m.Add(c, 5)
+	m.Add(d, 4)
+	z.PlaceAbove(d, a)
+	CheckStack(t, m, 205, 205, c, b, d, a)
+	z.PlaceAbove(c, a)
+	CheckStack(t, m, 205, 205, b, d, c, a)
+	z.PlaceAbove(a, b)
+	CheckStack(t, m, 205, 205, a, b, d, c)
+}
+
+// testZOrdererDuplicate checks every copy of a shape added more than once is restacked, keeping their order, and
+// ZIndexOf gives the z-index of the topmost copy.
+func testZOrdererDuplicate(t *testing.T, m spacemap.Interface) {
+	z, ok := m.(spacemap.ZOrderer)
+	if !ok {
+		t.Skip("not a spacemap.ZOrderer")
+	}
+	r1 := shared.NewRectangle(10, 10, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	m.Add(r2, 0)
+	m.Add(r1, 1)
+	m.Add(r2, 2)
+	checkZIndex := func(want int) {
+		t.Helper()
+		if got, ok := z.ZIndexOf(r2); !ok || got != want {
+			t.Errorf("ZIndexOf(r2) = %d, %v want %d", got, ok, want)
+		}
+	}
+	checkZIndex(2)
+	CheckStack(t, m, 50, 50, r2, r1, r2)
+	z.BringToFront(r2)
+	checkZIndex(2)
+	CheckStack(t, m, 50, 50, r2, r2, r1)
+	z.SetZIndex(r2, 1)
+	checkZIndex(1)
+	CheckStack(t, m, 50, 50, r2, r2, r1)
+	if zq, ok := m.(spacemap.ZQuerier); ok {
+		want := []shared.ZShape{{Shape: r2, ZIndex: 1}, {Shape: r2, ZIndex: 1}, {Shape: r1, ZIndex: 1}}
+		got := zq.GetZStackAt(50, 50)
+		same := len(got) == len(want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == want[i]
+		}
+		if !same {
+			t.Errorf("GetZStackAt(50, 50) = %v want %v", got, want)
+		}
+	}
+	z.SendToBack(r2)
+	checkZIndex(0)
+	CheckStack(t, m, 50, 50, r1, r2, r2)
+	z.PlaceAbove(r2, r1)
+	CheckStack(t, m, 50, 50, r2, r2, r1)
+	z.PlaceAbove(r1, r2)
+	CheckStack(t, m, 50, 50, r1, r2, r2)
+	m.Remove(r2)
+	CheckStack(t, m, 50, 50, r1)
+	if _, ok := z.ZIndexOf(r2); ok {
+		t.Errorf("ZIndexOf found a removed shape")
+	}
+}
+
+func testNearest(t *testing.T, m spacemap.Interface) {
+	n, ok := m.(spacemap.NearestQuerier)
+	if !ok {
+		t.Skip("not a spacemap.NearestQuerier")
+	}
+	if got := n.Nearest(0, 0); got != nil {
+		t.Errorf("Nearest(0, 0) = %v on an empty map want nil", got)
+	}
+	line := shared.NewRectangle(0, 50, 200, 51, shared.Name("line"))
+	box := shared.NewRectangle(10, 10, 40, 40, shared.Name("box"))
+	cover := shared.NewRectangle(0, 0, 20, 20, shared.Name("cover"))
+	circle := shared.NewCircle(150, 150, 20, shared.Name("circle"))
+	far := shared.NewRectangle(-1000, -1000, -990, -990, shared.Name("far"))
+	flat := shared.NewPolygon([]image.Point{{-510, -500}, {-490, -500}, {-500, -500}})
+	m.Add(line, 0)
+	m.Add(box, 1)
+	m.Add(cover, 0)
+	m.Add(circle, 0)
+	m.Add(far, 0)
+	m.Add(flat, 0)
+	for _, test := range []struct {
+		X, Y        int
+		K           int
+		MaxDistance float64
+		Want        []shared.Shape
+	}{
+		{100, 48, 1, math.Inf(1), []shared.Shape{line}},
+		{15, 15, 2, math.Inf(1), []shared.Shape{box, cover}},
+		{15, 15, 0, math.Inf(1), nil},
+		{150, 125, 3, 10, []shared.Shape{circle}},
+		{168, 132, 1, math.Inf(1), []shared.Shape{circle}},
+		{45, 45, 3, 10, []shared.Shape{line, box}},
+		{-500, -500, 1, 100, nil},
+		{-500, -500, 1, math.Inf(1), []shared.Shape{far}},
+	} {
+		got := n.KNearest(test.X, test.Y, test.K, test.MaxDistance)
+		same := len(got) == len(test.Want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == test.Want[i]
+		}
+		if !same {
+			t.Errorf("KNearest(%d, %d, %d, %v) = %s want %s", test.X, test.Y, test.K, test.MaxDistance, names(got), names(test.Want))
+		}
+	}
+	if got := n.Nearest(15, 15); got != box {
+		t.Errorf("Nearest(15, 15) = %v want %v", got, box)
+	}
+	m.Remove(box)
+	if got := n.Nearest(15, 15); got != cover {
+		t.Errorf("Nearest(15, 15) = %v after removing box want %v", got, cover)
+	}
+}
+
+func testCast(t *testing.T, m spacemap.Interface) {
+	c, ok := m.(spacemap.Caster)
+	if !ok {
+		t.Skip("not a spacemap.Caster")
+	}
+	if got := c.SegmentCast(0, 0, 100, 100); len(got) != 0 {
+		t.Errorf("SegmentCast on an empty map = %v", got)
+	}
+	wall := shared.NewRectangle(50, 0, 55, 100, shared.Name("wall"))
+	glass := shared.NewRectangle(50, 0, 55, 100, shared.Name("glass"))
+	post := shared.NewCircle(20, 30, 5, shared.Name("post"))
+	beyond := shared.NewRectangle(100, 0, 110, 100, shared.Name("beyond"))
+	m.Add(wall, 0)
+	m.Add(glass, 1)
+	m.Add(post, 0)
+	m.Add(beyond, 0)
+	hitNames := func(hits []shared.Hit) string {
+		shapes := make([]shared.Shape, 0, len(hits))
+		for _, h := range hits {
+			shapes = append(shapes, h.Shape)
+		}
+		return names(shapes)
+	}
+	for _, test := range []struct {
+		X0, Y0, X1, Y1 int
+		Want           []shared.Shape
+	}{
+		{0, 30, 120, 30, []shared.Shape{post, glass, wall, beyond}},
+		{0, 60, 120, 60, []shared.Shape{glass, wall, beyond}},
+		{120, 60, 0, 60, []shared.Shape{beyond, glass, wall}},
+		{0, 60, 49, 60, nil},
+		{52, 10, 52, 90, []shared.Shape{glass, wall}},
+		{0, 0, 60, 90, []shared.Shape{post, glass, wall}},
+	} {
+		if got, want := hitNames(c.SegmentCast(test.X0, test.Y0, test.X1, test.Y1)), names(test.Want); got != want {
+			t.Errorf("SegmentCast(%d, %d, %d, %d) = %s want %s", test.X0, test.Y0, test.X1, test.Y1, got, want)
+		}
+	}
+	if hits := c.SegmentCast(0, 60, 120, 60); len(hits) == 0 || hits[0].Point != image.Pt(50, 60) || hits[0].Distance != 49.5 {
+		t.Errorf("SegmentCast(0, 60, 120, 60) = %v want glass first entered at (50, 60) 49.5 along", hits)
+	}
+	if got, want := hitNames(c.RayCast(0, 60, 1, 0, math.Inf(1))), names([]shared.Shape{glass, wall, beyond}); got != want {
+		t.Errorf("RayCast(0, 60, 1, 0, +Inf) = %s want %s", got, want)
+	}
+	if got, want := hitNames(c.RayCast(0, 60, 1, 0, 60)), names([]shared.Shape{glass, wall}); got != want {
+		t.Errorf("RayCast(0, 60, 1, 0, 60) = %s want %s", got, want)
+	}
+	m.Remove(glass)
+	if got, want := hitNames(c.RayCast(0, 60, 1, 0, 60)), names([]shared.Shape{wall}); got != want {
+		t.Errorf("RayCast(0, 60, 1, 0, 60) = %s after removing glass want %s", got, want)
+	}
+}
+
+func testStackVisitor(t *testing.T, m spacemap.Interface) {
+	v, ok := m.(spacemap.StackVisitor)
+	if !ok {
+		t.Skip("not a spacemap.StackVisitor")
+	}
+	v.VisitStackAt(5, 5, func(shape shared.Shape, zIndex int) bool {
+		t.Errorf("VisitStackAt(5, 5) on an empty map visited %v", shape)
+		return true
+	})
+	r1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(10, 10, 90, 90, shared.Name("r2"))
+	r3 := shared.NewRectangle(20, 20, 80, 80, shared.Name("r3"))
+	m.Add(r1, 2)
+	m.Add(r2, -1)
+	m.Add(r3, 2)
+	type visit struct {
+		Shape  shared.Shape
+		ZIndex int
+	}
+	var got []visit
+	v.VisitStackAt(50, 50, func(shape shared.Shape, zIndex int) bool {
+		got = append(got, visit{shape, zIndex})
+		return true
+	})
+	want := []visit{{r3, 2}, {r1, 2}, {r2, -1}}
+	if len(got) != len(want) {
+		t.Fatalf("VisitStackAt(50, 50) visited %v want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("VisitStackAt(50, 50) visit %d = %v want %v", i, got[i], want[i])
+		}
+	}
+	count := 0
+	v.VisitStackAt(50, 50, func(shape shared.Shape, zIndex int) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Errorf("VisitStackAt(50, 50) visited %d shapes after being stopped at 2", count)
+	}
+	other := shared.NewRectangle(0, 0, 1, 1, shared.Name("other"))
+	buf := make([]shared.Shape, 1, 8)
+	buf[0] = other
+	stack := v.AppendStackAt(buf, 15, 15)
+	if got, want := names(stack), names([]shared.Shape{other, r1, r2}); got != want {
+		t.Errorf("AppendStackAt(%s, 15, 15) = %s want %s", names(buf), got, want)
+	}
+	if got := v.AppendStackAt(buf[:0], 200, 200); len(got) != 0 {
+		t.Errorf("AppendStackAt(buf[:0], 200, 200) = %s want []", names(got))
+	}
+}
+
+func testZQuerier(t *testing.T, m spacemap.Interface) {
+	q, ok := m.(spacemap.ZQuerier)
+	if !ok {
+		t.Skip("not a spacemap.ZQuerier")
+	}
+	check := func(what string, got, want []shared.ZShape) {
+		t.Helper()
+		same := len(got) == len(want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == want[i]
+		}
+		if !same {
+			t.Errorf("%s = %v want %v", what, got, want)
+		}
+	}
+	check("GetZStackAt(5, 5) on an empty map", q.GetZStackAt(5, 5), nil)
+	r1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(10, 10, 90, 90, shared.Name("r2"))
+	r3 := shared.NewRectangle(200, 200, 210, 210, shared.Name("r3"))
+	m.Add(r1, 4)
+	m.Add(r2, -2)
+	m.Add(r3, 4)
+	check("GetZStackAt(50, 50)", q.GetZStackAt(50, 50), []shared.ZShape{{Shape: r1, ZIndex: 4}, {Shape: r2, ZIndex: -2}})
+	check("GetZStackAt(150, 150)", q.GetZStackAt(150, 150), nil)
+	check("GetZStackIn(0, 0, 300, 300)", q.GetZStackIn(image.Rect(0, 0, 300, 300), shared.Intersects), []shared.ZShape{
+		{Shape: r3, ZIndex: 4}, {Shape: r1, ZIndex: 4}, {Shape: r2, ZIndex: -2},
+	})
+	check("GetZStackIn(5, 5, 95, 95) within", q.GetZStackIn(image.Rect(5, 5, 95, 95), shared.Within), []shared.ZShape{{Shape: r2, ZIndex: -2}})
+	if z, ok := m.(spacemap.ZOrderer); ok {
+		z.SetZIndex(r2, 7)
+		check("GetZStackAt(50, 50) after SetZIndex", q.GetZStackAt(50, 50), []shared.ZShape{{Shape: r2, ZIndex: 7}, {Shape: r1, ZIndex: 4}})
+	}
+}
+
+func testIntrospection(t *testing.T, m spacemap.Interface) {
+	r1 := shared.NewRectangle(10, 20, 30, 40, shared.Name("r1"))
+	r2 := shared.NewRectangle(-50, 25, -40, 35, shared.Name("r2"))
+	r3 := shared.NewCircle(100, 100, 10, shared.Name("r3"))
+	empty := shared.NewRectangle(500, 500, 500, 600, shared.Name("empty"))
+	m.Add(r1, 3)
+	m.Add(r2, 0)
+	m.Add(r3, 0)
+	CheckContents(t, m, r1, r3, r2)
+	if m.Contains(shared.NewRectangle(10, 20, 30, 40, shared.Name("r1"))) {
+		t.Errorf("Contains of an equal but different shape = true")
+	}
+	m.Add(empty, 5)
+	CheckContents(t, m, empty, r1, r3, r2)
+	m.Remove(r3)
+	CheckContents(t, m, empty, r1, r2)
+	m.Remove(r3)
+	CheckContents(t, m, empty, r1, r2)
+	if m.Contains(r3) {
+		t.Errorf("Contains(%s) = true after removing it", r3)
+	}
+	m.Remove(r2)
+	m.Remove(empty)
+	CheckContents(t, m, r1)
+	m.Remove(r1)
+	CheckContents(t, m)
+}
+
+func testClear(t *testing.T, m spacemap.Interface) {
+	c, ok := m.(spacemap.Clearer)
+	if !ok {
+		t.Skip("not a spacemap.Clearer")
+	}
+	c.Clear()
+	CheckContents(t, m)
+	r1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("r3"))
+	m.Add(r1, 0)
+	m.Add(r2, 0)
+	m.Add(r3, 1)
+	c.Clear()
+	CheckContents(t, m)
+	CheckStack(t, m, 55, 55)
+	m.Add(r3, 0)
+	m.Add(r2, 0)
+	m.Add(r1, 0)
+	CheckContents(t, m, r1, r2, r3)
+	CheckStack(t, m, 55, 55, r1, r2, r3)
+	CheckStack(t, m, 120, 120, r3)
+}
+
+// Clone checks clone returns a copy of a map which can be changed independently. newMap must return a new empty map.
+func Clone(t *testing.T, newMap func() spacemap.Interface, clone func(m spacemap.Interface) spacemap.Interface) {
+	t.Helper()
+	m := newMap()
+	CheckContents(t, clone(m))
+	r1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("r3"))
+	r4 := shared.NewRectangle(45, 45, 55, 55, shared.Name("r4"))
+	m.Add(r1, 0)
+	m.Add(r2, 1)
+	m.Add(r3, 2)
+	c := clone(m)
+	CheckContents(t, c, r3, r2, r1)
+	m.Remove(r2)
+	c.Add(r4, 5)
+	want := []shared.Shape{r3, r1}
+	if z, ok := m.(spacemap.ZOrderer); ok {
+		z.SetZIndex(r1, 10)
+		want = []shared.Shape{r1, r3}
+	}
+	CheckStack(t, m, 50, 50, want...)
+	CheckContents(t, m, want...)
+	CheckStack(t, c, 50, 50, r4, r3, r2, r1)
+	CheckContents(t, c, r4, r3, r2, r1)
+	if cl, ok := c.(spacemap.Clearer); ok {
+		cl.Clear()
+		CheckContents(t, c)
+		CheckStack(t, m, 50, 50, want...)
+	}
+}
+
+// AddAll checks addAll, which adds shapes to m at z-index 0 in one go such as with an implementation's AddAll, leaves
+// m as if they had been added one at a time. newMap must return a new empty map.
+func AddAll(t *testing.T, newMap func() spacemap.Interface, addAll func(m spacemap.Interface, shapes ...shared.Shape)) {
+	t.Helper()
+	m := newMap()
+	addAll(m)
+	CheckContents(t, m)
+	r1 := shared.NewRectangle(0, 0, 100, 100, shared.Name("r1"))
+	r2 := shared.NewRectangle(40, 40, 60, 60, shared.Name("r2"))
+	r3 := shared.NewRectangle(50, 50, 150, 150, shared.Name("r3"))
+	r4 := shared.NewRectangle(45, 45, 55, 55, shared.Name("r4"))
+	top := shared.NewRectangle(-10, -10, 200, 200, shared.Name("top"))
+	m.Add(top, 1)
+	addAll(m, r1, r2, r3)
+	CheckContents(t, m, top, r3, r2, r1)
+	CheckStack(t, m, 50, 50, top, r3, r2, r1)
+	CheckStack(t, m, 120, 120, top, r3)
+	m.Remove(r2)
+	m.Add(r4, 0)
+	CheckContents(t, m, top, r4, r3, r1)
+	CheckStack(t, m, 50, 50, top, r4, r3, r1)
+	m.Remove(top)
+	CheckStack(t, m, 5, 5, r1)
+	CheckContents(t, m, r4, r3, r1)
+}
+
+// unregistered is a shape which hasn't been registered with shared.RegisterShape.
+type unregistered struct {
+	shared.Rectangle
+}
+
+func testJSON(t *testing.T, m spacemap.Interface) {
+	if _, ok := m.(json.Unmarshaler); !ok {
+		t.Skip("not a json.Unmarshaler")
+	}
+	shapes := []shared.Shape{
+		shared.NewRectangle(0, 0, 100, 100, shared.Name("r1")),
+		shared.NewCircle(50, 50, 20, shared.Name("c1")),
+		shared.NewEllipse(50, 50, 30, 10, shared.Name("e1")),
+		shared.NewPolygon([]image.Point{{20, 20}, {80, 20}, {80, 80}, {20, 80}}, shared.Ring{{40, 40}, {60, 40}, {60, 60}, {40, 60}}, shared.NonZero, shared.Name("p1")),
+		shared.NewRectangle(-20, -20, 10, 10),
+		&shared.Rectangle{Rectangle: image.Rect(45, 45, 55, 55), Name: "r2"},
+		shared.NewRectangle(5, 5, 5, 5, shared.Name("empty")),
+	}
+	for i, s := range shapes {
+		m.Add(s, i%3)
+	}
+	want := map[image.Point]string{}
+	for y := -25; y < 110; y += 5 {
+		for x := -25; x < 110; x += 5 {
+			want[image.Pt(x, y)] = names(m.GetStackAt(x, y))
+		}
+	}
+	wantAll := names(m.All())
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal() error %v", err)
+	}
+	m.Remove(shapes[0])
+	m.Add(shared.NewRectangle(0, 0, 200, 200, shared.Name("replaced")), 9)
+	if err := json.Unmarshal(data, m); err != nil {
+		t.Fatalf("Unmarshal(%s) error %v", data, err)
+	}
+	if got := names(m.All()); got != wantAll {
+		t.Errorf("All() after round trip = %s want %s", got, wantAll)
+	}
+	for p, w := range want {
+		if got := names(m.GetStackAt(p.X, p.Y)); got != w {
+			t.Errorf("GetStackAt(%d, %d) after round trip = %s want %s", p.X, p.Y, got, w)
+		}
+	}
+	m.Add(&unregistered{shared.Rectangle{Rectangle: image.Rect(0, 0, 10, 10)}}, 0)
+	if _, err := json.Marshal(m); err == nil {
+		t.Errorf("Marshal() with an unregistered shape gave no error")
+	}
+	if err := json.Unmarshal([]byte(`{"shapes":[{"kind":"Unknown","zIndex":0,"shape":{}}]}`), m); err == nil {
+		t.Errorf("Unmarshal() of an unregistered kind gave no error")
+	}
+}
+
+func testBinary(t *testing.T, m spacemap.Interface) {
+	bu, ok := m.(encoding.BinaryUnmarshaler)
+	if !ok {
+		t.Skip("not an encoding.BinaryUnmarshaler")
+	}
+	bm := m.(encoding.BinaryMarshaler)
+	shapes := []shared.Shape{
+		shared.NewRectangle(0, 0, 100, 100, shared.Name("r1")),
+		shared.NewCircle(50, 50, 20, shared.Name("c1")),
+		shared.NewEllipse(50, 50, 30, 10, shared.Name("e1")),
+		shared.NewPolygon([]image.Point{{20, 20}, {80, 20}, {80, 80}, {20, 80}}, shared.Ring{{40, 40}, {60, 40}, {60, 60}, {40, 60}}, shared.NonZero, shared.Name("p1")),
+		shared.NewRectangle(-20, -20, 10, 10),
+		shared.NewRectangle(45, 45, 55, 55, shared.Name("r2")),
+		shared.NewRectangle(5, 5, 5, 5, shared.Name("empty")),
+	}
+	for i, s := range shapes {
+		m.Add(s, i%3)
+	}
+	m.Add(shapes[5], 7)
+	m.Remove(shapes[4])
+	want := map[image.Point]string{}
+	for y := -25; y < 110; y += 5 {
+		for x := -25; x < 110; x += 5 {
+			want[image.Pt(x, y)] = names(m.GetStackAt(x, y))
+		}
+	}
+	wantAll, wantLen := names(m.All()), m.Len()
+	data, err := bm.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error %v", err)
+	}
+	check := func(when string) {
+		t.Helper()
+		if got := names(m.All()); got != wantAll {
+			t.Errorf("All() %s = %s want %s", when, got, wantAll)
+		}
+		if got := m.Len(); got != wantLen {
+			t.Errorf("Len() %s = %d want %d", when, got, wantLen)
+		}
+		for p, w := range want {
+			if got := names(m.GetStackAt(p.X, p.Y)); got != w {
+				t.Errorf("GetStackAt(%d, %d) %s = %s want %s", p.X, p.Y, when, got, w)
+			}
+		}
+	}
+	m.Remove(shapes[0])
+	m.Add(shared.NewRectangle(0, 0, 200, 200, shared.Name("replaced")), 9)
+	if err := bu.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error %v", err)
+	}
+	check("after round trip")
+	for i := 0; i < len(data); i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x10
+		if err := bu.UnmarshalBinary(corrupt); !errors.Is(err, shared.ErrCorrupt) && !errors.Is(err, shared.ErrVersion) {
+			t.Fatalf("UnmarshalBinary() with byte %d changed = %v want a corrupt data error", i, err)
+		}
+	}
+	for _, n := range []int{0, 4, len(data) / 2, len(data) - 1} {
+		if err := bu.UnmarshalBinary(data[:n]); !errors.Is(err, shared.ErrCorrupt) {
+			t.Errorf("UnmarshalBinary() of %d of %d bytes = %v want a corrupt data error", n, len(data), err)
+		}
+	}
+	check("after failing to load corrupt data")
+	// The loaded index must take further changes.
+	wantStack := []shared.Shape{shared.NewRectangle(50, 50, 60, 60, shared.Name("r3"))}
+	for _, s := range m.GetStackAt(50, 50) {
+		if strings.HasPrefix(s.String(), "r2:") {
+			m.Remove(s)
+		} else {
+			wantStack = append(wantStack, s)
+		}
+	}
+	m.Add(wantStack[0], 10)
+	CheckStack(t, m, 50, 50, wantStack...)
+}
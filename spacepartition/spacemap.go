@@ -1,7 +1,9 @@
 package spacepartition
 
 import (
+	"fmt"
 	"image"
+	"math"
 	"sort"
 
 	"github.com/arran4/spacemap/shared"
@@ -48,6 +50,9 @@ type Struct struct {
 	VSplits []*Split
 	HSplits []*Split
 	Stacks  map[SplitCoordination][]*shared.Point
+	// Sequence orders shapes with the same z-index as they are spread over many cells.
+	Sequence int
+	members  shared.Members
 }
 
 func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
@@ -58,7 +63,19 @@ func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
 }
 
 func (m *Struct) Add(shape shared.Shape, zIndex int) {
-	b := shape.Bounds()
+	m.Sequence++
+	m.insert(&shared.Point{
+		Shape:  shape,
+		ZIndex: zIndex,
+		Order:  m.Sequence,
+	}, shape.Bounds())
+	m.members.Add(shape)
+}
+
+// insert adds p into every cell within b, creating the splits for b as required. Every cell shares the one point so
+// it can be identified across cells.
+func (m *Struct) insert(p *shared.Point, b image.Rectangle) {
+	shape := p.Shape
 	// Get x and y pos
 	minxi, minyi := m.GetXYPositions(b.Min)
 	maxxi, maxyi := m.GetXYPositions(b.Max)
@@ -198,10 +215,7 @@ func (m *Struct) Add(shape shared.Shape, zIndex int) {
 		for y := minyi; y <= maxyi; y++ {
 			hs := m.HSplits[x]
 			vs := m.VSplits[y]
-			m.Stacks[SC(hs, vs)] = shared.PointArray(m.Stacks[SC(hs, vs)]).Insert(&shared.Point{
-				Shape:  shape,
-				ZIndex: zIndex,
-			})
+			m.Stacks[SC(hs, vs)] = shared.PointArray(m.Stacks[SC(hs, vs)]).Insert(p)
 		}
 	}
 }
@@ -217,6 +231,31 @@ func (m *Struct) GetXYPositions(p image.Point) (int, int) {
 }
 
 func (m *Struct) GetStackAt(x int, y int) []shared.Shape {
+	return m.AppendStackAt([]shared.Shape{}, x, y)
+}
+
+// VisitStackAt calls f with each shape at x, y and its z-index, topmost first, until f returns false The cell's stack is
+// already in stacking order so it is walked from the top.
+func (m *Struct) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	s := m.stackAt(x, y)
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i].PointIn(x, y) && !f(s[i].Shape, s[i].ZIndex) {
+			return
+		}
+	}
+}
+
+// AppendStackAt appends the shapes at x, y to dst, topmost first, and returns the extended slice.
+func (m *Struct) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		dst = append(dst, shape)
+		return true
+	})
+	return dst
+}
+
+// stackAt returns the stack of the cell containing x, y, bottom first. Its shapes may not cover the point itself.
+func (m *Struct) stackAt(x, y int) []*shared.Point {
 	xi, yi := m.GetXYPositions(image.Point{X: x, Y: y})
 	if xi >= 0 && yi >= 0 && xi <= len(m.HSplits) && yi <= len(m.VSplits) {
 		var hs *Split = nil
@@ -234,18 +273,184 @@ func (m *Struct) GetStackAt(x int, y int) []shared.Shape {
 			vs = m.VSplits[yi-1]
 		}
 		if hs != nil && vs != nil && vs.Position <= y && hs.Position <= x {
-			if s, ok := m.Stacks[SC(hs, vs)]; ok && s != nil {
-				var r = make([]shared.Shape, 0, len(s))
-				for _, p := range s {
-					if p.PointIn(x, y) {
-						r = append(r, p.Shape)
-					}
+			return m.Stacks[SC(hs, vs)]
+		}
+	}
+	return nil
+}
+
+// GetCellRange returns the inclusive range of split indexes whose cells overlap r. If no cell overlaps r the max
+// index will be less than the min index.
+func (m *Struct) GetCellRange(r image.Rectangle) (minxi, minyi, maxxi, maxyi int) {
+	if r.Empty() {
+		return 0, 0, -1, -1
+	}
+	minxi = sort.Search(len(m.HSplits), func(i int) bool {
+		return m.HSplits[i].Position > r.Min.X
+	}) - 1
+	minyi = sort.Search(len(m.VSplits), func(i int) bool {
+		return m.VSplits[i].Position > r.Min.Y
+	}) - 1
+	if minxi < 0 {
+		minxi = 0
+	}
+	if minyi < 0 {
+		minyi = 0
+	}
+	maxxi, maxyi = m.GetXYPositions(r.Max)
+	return minxi, minyi, maxxi - 1, maxyi - 1
+}
+
+func (m *Struct) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	return shared.PointArray(m.pointsIn(r, mode)).Shapes()
+}
+
+// GetZStackIn is GetStackIn with the z-index of each shape.
+func (m *Struct) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	return shared.PointArray(m.pointsIn(r, mode)).ZShapes()
+}
+
+// GetZStackAt is GetStackAt with the z-index of each shape.
+func (m *Struct) GetZStackAt(x, y int) []shared.ZShape {
+	result := []shared.ZShape{}
+	m.VisitStackAt(x, y, func(shape shared.Shape, zIndex int) bool {
+		result = append(result, shared.ZShape{Shape: shape, ZIndex: zIndex})
+		return true
+	})
+	return result
+}
+
+// pointsIn returns the points of the shapes matching r, topmost first.
+func (m *Struct) pointsIn(r image.Rectangle, mode shared.Containment) []*shared.Point {
+	minxi, minyi, maxxi, maxyi := m.GetCellRange(r)
+	seen := map[*shared.Point]struct{}{}
+	var found []*shared.Point
+	for x := minxi; x <= maxxi; x++ {
+		for y := minyi; y <= maxyi; y++ {
+			for _, p := range m.Stacks[SC(m.HSplits[x], m.VSplits[y])] {
+				if _, ok := seen[p]; ok {
+					continue
+				}
+				seen[p] = struct{}{}
+				if mode.Match(p.Bounds(), r) {
+					found = append(found, p)
 				}
-				return r
 			}
 		}
 	}
-	return []shared.Shape{}
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	return found
+}
+
+// Nearest returns the shape nearest to x, y, or nil when there are none.
+func (m *Struct) Nearest(x, y int) shared.Shape {
+	if s := m.KNearest(x, y, 1, math.Inf(1)); len(s) > 0 {
+		return s[0]
+	}
+	return nil
+}
+
+// KNearest returns up to k shapes no further than maxDistance from x, y, nearest first. Only the cells of the split grid around the point are searched.
+func (m *Struct) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	return shared.KNearest(x, y, k, maxDistance, m.extent(), func(r image.Rectangle) []shared.Shape {
+		return m.GetStackIn(r, shared.Intersects)
+	})
+}
+
+// SegmentCast returns the shapes crossed by the line from x0, y0 to x1, y1 in order of first contact. The line is
+// followed from cell to cell of the split grid and only the shapes in the cells it passes through are checked.
+func (m *Struct) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	seen := map[*shared.Point]struct{}{}
+	var found []*shared.Point
+	m.visitSegmentCells(x0, y0, x1, y1, func(x, y int) {
+		for _, p := range m.Stacks[SC(m.HSplits[x], m.VSplits[y])] {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			if shared.SegmentOverlaps(p.Bounds(), x0, y0, x1, y1) {
+				found = append(found, p)
+			}
+		}
+	})
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	candidates := make([]shared.Shape, 0, len(found))
+	for _, p := range found {
+		candidates = append(candidates, p.Shape)
+	}
+	return shared.Cast(x0, y0, x1, y1, candidates)
+}
+
+// visitSegmentCells calls f with the indexes of the splits of each cell the line between the centres of the pixels
+// x0, y0 and x1, y1 can pass through. The line is cut where it crosses each split, in order, and the cells around
+// each piece are visited, including those a pixel either side of it so that pixels the line clips are covered. Cells
+// can be visited more than once.
+func (m *Struct) visitSegmentCells(x0, y0, x1, y1 int, f func(x, y int)) {
+	ax, ay := float64(x0)+0.5, float64(y0)+0.5
+	dx, dy := float64(x1-x0), float64(y1-y0)
+	nextX, nextY := splitCrossings(m.HSplits, ax, dx), splitCrossings(m.VSplits, ay, dy)
+	tx, ty := nextX(), nextY()
+	for from := 0.0; from < 1; {
+		to := math.Min(math.Min(tx, ty), 1)
+		fx, fy, tox, toy := ax+dx*from, ay+dy*from, ax+dx*to, ay+dy*to
+		minxi, minyi, maxxi, maxyi := m.GetCellRange(image.Rect(
+			int(math.Floor(math.Min(fx, tox)))-1, int(math.Floor(math.Min(fy, toy)))-1,
+			int(math.Floor(math.Max(fx, tox)))+2, int(math.Floor(math.Max(fy, toy)))+2,
+		))
+		for x := minxi; x <= maxxi; x++ {
+			for y := minyi; y <= maxyi; y++ {
+				f(x, y)
+			}
+		}
+		if tx == to {
+			tx = nextX()
+		}
+		if ty == to {
+			ty = nextY()
+		}
+		from = to
+	}
+}
+
+// splitCrossings returns a function which gives, in order, how far along a line starting at a and moving d it crosses
+// each of splits, as a fraction of d, and +Inf once there are no more.
+func splitCrossings(splits []*Split, a, d float64) func() float64 {
+	i, step := 0, 1
+	switch {
+	case d > 0:
+		i = sort.Search(len(splits), func(i int) bool {
+			return float64(splits[i].Position) > a
+		})
+	case d < 0:
+		i = sort.Search(len(splits), func(i int) bool {
+			return float64(splits[i].Position) >= a
+		}) - 1
+		step = -1
+	default:
+		i = -1
+	}
+	return func() float64 {
+		if i < 0 || i >= len(splits) {
+			return math.Inf(1)
+		}
+		t := (float64(splits[i].Position) - a) / d
+		i += step
+		return t
+	}
+}
+
+// RayCast returns the shapes crossed by a ray from x, y in the direction dx, dy, no further than maxDistance which can
+// be +Inf, in order of first contact.
+func (m *Struct) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	return shared.RayCast(x, y, dx, dy, maxDistance, m.extent(), m.SegmentCast)
+}
+
+// extent returns the area between the first and last splits, it is empty when there are no shapes.
+func (m *Struct) extent() image.Rectangle {
+	if len(m.HSplits) == 0 || len(m.VSplits) == 0 {
+		return image.Rectangle{}
+	}
+	return image.Rect(m.HSplits[0].Position, m.VSplits[0].Position, m.HSplits[len(m.HSplits)-1].Position, m.VSplits[len(m.VSplits)-1].Position)
 }
 
 func New() *Struct {
@@ -272,16 +477,21 @@ func (a ShapeArray) Remove(shape shared.Shape) ([]shared.Shape, int) {
 type SplitArray []*Split
 
 func (sa SplitArray) Remove(shape shared.Shape) ([]*Split, []*Split) {
+	return sa.RemoveBounds(shape, shape.Bounds())
+}
+
+// RemoveBounds is Remove for a shape which was added with the bounds b.
+func (sa SplitArray) RemoveBounds(shape shared.Shape, b image.Rectangle) ([]*Split, []*Split) {
 	shrink := 0
 	var removedFrom []*Split
 	in := false
 	for sai := range sa {
 		var removeCount int
 		sa[sai].BecauseOf, removeCount = ShapeArray(sa[sai].BecauseOf).Remove(shape)
-		min, max := shape.Bounds().Min.Y, shape.Bounds().Max.Y
+		min, max := b.Min.Y, b.Max.Y
 		switch sa[sai].Alignment {
 		case Horizontal:
-			min, max = shape.Bounds().Min.X, shape.Bounds().Max.X
+			min, max = b.Min.X, b.Max.X
 		}
 		if !in {
 			in = min <= sa[sai].Position
@@ -300,10 +510,66 @@ func (sa SplitArray) Remove(shape shared.Shape) ([]*Split, []*Split) {
 }
 
 func (m *Struct) Remove(shape shared.Shape) {
+	m.remove(shape, shape.Bounds())
+	m.members.Remove(shape)
+}
+
+// scrub takes shape, which was added with the bounds b, out of every cell holding it.
+func (m *Struct) scrub(shape shared.Shape, b image.Rectangle) {
+	for _, k := range m.cellsHolding(shape, b) {
+		m.Stacks[k], _ = shared.PointArray(m.Stacks[k]).Remove(shape)
+	}
+}
+
+// cellsHolding returns the key of every cell whose stack holds shape, which was added with the bounds b. A new split
+// copies the stack of its neighbouring cell, which can copy shape into cells outside of b, so starting from the cells
+// under b it spreads to each neighbour shape is in.
+func (m *Struct) cellsHolding(shape shared.Shape, b image.Rectangle) []SplitCoordination {
+	type cell struct{ x, y int }
+	var queue []cell
+	var keys []SplitCoordination
+	seen := map[cell]struct{}{}
+	minxi, minyi := m.GetXYPositions(b.Min)
+	maxxi, maxyi := m.GetXYPositions(b.Max)
+	for x := minxi; x <= maxxi && x < len(m.HSplits); x++ {
+		for y := minyi; y <= maxyi && y < len(m.VSplits); y++ {
+			queue = append(queue, cell{x, y})
+			seen[cell{x, y}] = struct{}{}
+		}
+	}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		k := SC(m.HSplits[c.x], m.VSplits[c.y])
+		holds := false
+		for _, p := range m.Stacks[k] {
+			if p.Shape == shape {
+				holds = true
+				break
+			}
+		}
+		if !holds {
+			continue
+		}
+		keys = append(keys, k)
+		for _, n := range []cell{{c.x - 1, c.y}, {c.x + 1, c.y}, {c.x, c.y - 1}, {c.x, c.y + 1}} {
+			if _, ok := seen[n]; ok || n.x < 0 || n.y < 0 || n.x >= len(m.HSplits) || n.y >= len(m.VSplits) {
+				continue
+			}
+			seen[n] = struct{}{}
+			queue = append(queue, n)
+		}
+	}
+	return keys
+}
+
+// remove takes shape, which was added with the bounds b, out of every split and cell.
+func (m *Struct) remove(shape shared.Shape, b image.Rectangle) {
+	m.scrub(shape, b)
 	var vRemovedFrom []*Split
 	var hRemovedFrom []*Split
-	m.VSplits, vRemovedFrom = SplitArray(m.VSplits).Remove(shape)
-	m.HSplits, hRemovedFrom = SplitArray(m.HSplits).Remove(shape)
+	m.VSplits, vRemovedFrom = SplitArray(m.VSplits).RemoveBounds(shape, b)
+	m.HSplits, hRemovedFrom = SplitArray(m.HSplits).RemoveBounds(shape, b)
 	var i int
 	ks := map[SplitCoordination]struct{}{}
 	for _, v := range vRemovedFrom {
@@ -340,10 +606,428 @@ func (m *Struct) Remove(shape shared.Shape) {
 	}
 }
 
-func (m *Struct) GetAt(x int, y int) shared.Shape {
-	s := m.GetStackAt(x, y)
-	if len(s) > 0 {
-		return s[0]
+// FindPoint returns the point for shape which was added with the bounds b.
+func (m *Struct) FindPoint(shape shared.Shape, b image.Rectangle) *shared.Point {
+	xi, yi := m.GetXYPositions(b.Min)
+	if xi >= len(m.HSplits) || yi >= len(m.VSplits) {
+		return nil
+	}
+	for _, p := range m.Stacks[SC(m.HSplits[xi], m.VSplits[yi])] {
+		if p.Shape == shape {
+			return p
+		}
+	}
+	return nil
+}
+
+// FindPoints returns the point for each time shape was added with the bounds b, bottom first.
+func (m *Struct) FindPoints(shape shared.Shape, b image.Rectangle) (points []*shared.Point) {
+	xi, yi := m.GetXYPositions(b.Min)
+	if xi >= len(m.HSplits) || yi >= len(m.VSplits) {
+		return nil
+	}
+	for _, p := range m.Stacks[SC(m.HSplits[xi], m.VSplits[yi])] {
+		if p.Shape == shape {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// Update moves shape from oldBounds to its current bounds. When every edge of shape has a split of its own which moves
+// no further than the splits either side of it, as it does while a shape is dragged a little at a time, the splits are
+// moved and no cell changes. Otherwise it costs as much as Remove and Add, shape is taken out of its splits and cells
+// and inserted again, keeping its z-index and place in the stacks. A shape added more than once has every copy moved.
+func (m *Struct) Update(shape shared.Shape, oldBounds image.Rectangle) {
+	b := shape.Bounds()
+	if b == oldBounds {
+		return
+	}
+	points := m.FindPoints(shape, oldBounds)
+	if len(points) == 0 {
+		return
+	}
+	if m.slide(shape, oldBounds, b) {
+		return
+	}
+	m.remove(shape, oldBounds)
+	for _, p := range points {
+		m.insert(p, b)
+	}
+}
+
+// slide moves the splits at the edges of oldBounds to the edges of b, if they are only there because of shape and each
+// stays between its neighbours. No other shape has an edge between those neighbours so every cell keeps the same
+// stack. It reports whether the splits were moved.
+func (m *Struct) slide(shape shared.Shape, oldBounds, b image.Rectangle) bool {
+	if oldBounds.Empty() || b.Empty() {
+		return false
+	}
+	minxi, minyi := m.GetXYPositions(oldBounds.Min)
+	maxxi, maxyi := m.GetXYPositions(oldBounds.Max)
+	moves := []struct {
+		splits   []*Split
+		i        int
+		from, to int
+	}{
+		{m.HSplits, minxi, oldBounds.Min.X, b.Min.X},
+		{m.HSplits, maxxi, oldBounds.Max.X, b.Max.X},
+		{m.VSplits, minyi, oldBounds.Min.Y, b.Min.Y},
+		{m.VSplits, maxyi, oldBounds.Max.Y, b.Max.Y},
+	}
+	for _, mv := range moves {
+		if mv.i >= len(mv.splits) {
+			return false
+		}
+		s := mv.splits[mv.i]
+		if s.Position != mv.from || len(s.BecauseOf) != 1 || s.BecauseOf[0] != shape {
+			return false
+		}
+		if mv.i > 0 && mv.splits[mv.i-1].Position >= mv.to || mv.i+1 < len(mv.splits) && mv.splits[mv.i+1].Position <= mv.to {
+			return false
+		}
+	}
+	for _, mv := range moves {
+		mv.splits[mv.i].Position = mv.to
+	}
+	return true
+}
+
+func (m *Struct) Move(shape shared.Resizable, bounds image.Rectangle) {
+	oldBounds := shape.Bounds()
+	shape.SetBounds(bounds)
+	m.Update(shape, oldBounds)
+}
+
+// ZIndexOf returns the z-index of shape, or of its topmost copy when it was added more than once.
+func (m *Struct) ZIndexOf(shape shared.Shape) (int, bool) {
+	if p := shared.PointArray(m.FindPoints(shape, shape.Bounds())).Top(); p != nil {
+		return p.ZIndex, true
+	}
+	return 0, false
+}
+
+// SetZIndex changes the z-index of each of the shape's points, keeping the order of copies of a shape added more
+// than once, and restacks them in every cell holding them, including those a split copied them into outside of
+// their bounds, so every stack stays in order for insert.
+func (m *Struct) SetZIndex(shape shared.Shape, zIndex int) {
+	b := shape.Bounds()
+	points := m.FindPoints(shape, b)
+	if len(points) == 0 {
+		return
+	}
+	keys := m.cellsHolding(shape, b)
+	for _, p := range points {
+		m.Sequence++
+		p.ZIndex = zIndex
+		p.Order = m.Sequence
+		for _, k := range keys {
+			m.Stacks[k] = shared.PointArray(shared.PointArray(m.Stacks[k]).RemovePoint(p)).Insert(p)
+		}
+	}
+}
+
+// BringToFront restacks shape above every other shape.
+func (m *Struct) BringToFront(shape shared.Shape) {
+	shared.BringToFront(m, shape)
+}
+
+// SendToBack restacks shape below every other shape.
+func (m *Struct) SendToBack(shape shared.Shape) {
+	shared.SendToBack(m, shape)
+}
+
+// PlaceAbove restacks shape directly above other, even if that lowers it, leaving the order of the other shapes
+// unchanged.
+func (m *Struct) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	shared.PlaceAbove(m, shape, other)
+}
+
+func (m *Struct) GetAt(x int, y int) (top shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		top = shape
+		return false
+	})
+	return top
+}
+
+func (m *Struct) GetBottomAt(x int, y int) (bottom shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		bottom = shape
+		return true
+	})
+	return bottom
+}
+
+// Len returns the number of shapes.
+func (m *Struct) Len() int {
+	return m.members.Len()
+}
+
+// Contains reports if shape has been added and not removed.
+func (m *Struct) Contains(shape shared.Shape) bool {
+	return m.members.Contains(shape)
+}
+
+// All returns every shape, topmost first.
+func (m *Struct) All() []shared.Shape {
+	return shared.PointArray(m.allPoints()).Shapes()
+}
+
+// allPoints returns the point of every shape, topmost first.
+func (m *Struct) allPoints() []*shared.Point {
+	seen := map[*shared.Point]struct{}{}
+	var points []*shared.Point
+	for _, stack := range m.Stacks {
+		for _, p := range stack {
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				points = append(points, p)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	return points
+}
+
+// Bounds returns the smallest rectangle covering every shape, shapes with empty bounds are ignored. Each edge is the
+// outermost split made by the edge of a shape with non-empty bounds.
+func (m *Struct) Bounds() image.Rectangle {
+	minX, ok := edge(m.HSplits, true, func(b image.Rectangle) int { return b.Min.X })
+	if !ok {
+		return image.Rectangle{}
+	}
+	maxX, _ := edge(m.HSplits, false, func(b image.Rectangle) int { return b.Max.X })
+	minY, _ := edge(m.VSplits, true, func(b image.Rectangle) int { return b.Min.Y })
+	maxY, _ := edge(m.VSplits, false, func(b image.Rectangle) int { return b.Max.Y })
+	return image.Rect(minX, minY, maxX, maxY)
+}
+
+// Clear removes every shape, keeping the capacity of the splits and stacks for the next shapes.
+func (m *Struct) Clear() {
+	for i := range m.HSplits {
+		m.HSplits[i] = nil
+	}
+	for i := range m.VSplits {
+		m.VSplits[i] = nil
+	}
+	m.HSplits, m.VSplits = m.HSplits[:0], m.VSplits[:0]
+	for k := range m.Stacks {
+		delete(m.Stacks, k)
+	}
+	m.Sequence = 0
+	m.members.Clear()
+}
+
+// Clone returns a copy which can be changed independently of m. The shapes themselves are shared. Stacks are keyed by
+// pairs of splits and share points between cells, so the copies are found through maps from the originals.
+func (m *Struct) Clone() *Struct {
+	splits := map[*Split]*Split{}
+	cloneSplits := func(ss []*Split) []*Split {
+		result := make([]*Split, len(ss))
+		for i, s := range ss {
+			result[i] = &Split{
+				Position:  s.Position,
+				BecauseOf: append([]shared.Shape(nil), s.BecauseOf...),
+				Alignment: s.Alignment,
+			}
+			splits[s] = result[i]
+		}
+		return result
+	}
+	c := &Struct{
+		HSplits:  cloneSplits(m.HSplits),
+		VSplits:  cloneSplits(m.VSplits),
+		Stacks:   make(map[SplitCoordination][]*shared.Point, len(m.Stacks)),
+		Sequence: m.Sequence,
+		members:  m.members.Clone(),
+	}
+	points := shared.PointCloner{}
+	for k, stack := range m.Stacks {
+		hs, hok := splits[k.HSplit]
+		vs, vok := splits[k.VSplit]
+		if hok && vok {
+			c.Stacks[SC(hs, vs)] = points.CloneAll(stack)
+		}
+	}
+	return c
+}
+
+// MarshalJSON encodes every shape with its z-index, the shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalJSON() ([]byte, error) {
+	return shared.MarshalShapes(shared.PointArray(m.allPoints()).ZShapes())
+}
+
+// UnmarshalJSON replaces the shapes of a map created with New with those encoded by MarshalJSON, stacked as they
+// were. Options given to New are kept.
+func (m *Struct) UnmarshalJSON(data []byte) error {
+	shapes, err := shared.UnmarshalShapes(data)
+	if err != nil {
+		return err
+	}
+	m.Clear()
+	for i := len(shapes) - 1; i >= 0; i-- {
+		m.Add(shapes[i].Shape, shapes[i].ZIndex)
 	}
 	return nil
 }
+
+// binaryFormat and binaryVersion mark the binary form of the index, binaryVersion must change whenever it does.
+const (
+	binaryFormat  = "spacepartition"
+	binaryVersion = 1
+)
+
+// MarshalBinary encodes the index itself, its splits and the stacks of its cells, so UnmarshalBinary restores it
+// without adding each shape again. The shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalBinary() ([]byte, error) {
+	e := shared.NewBinaryEncoder()
+	e.Int(m.Sequence)
+	points := m.allPoints()
+	pointIndex := make(map[*shared.Point]int, len(points))
+	e.Int(len(points))
+	for i, p := range points {
+		pointIndex[p] = i
+		e.Shape(p.Shape)
+		e.Int(p.ZIndex)
+		e.Int(p.Order)
+	}
+	encodeSplits := func(splits []*Split) map[*Split]int {
+		index := make(map[*Split]int, len(splits))
+		e.Int(len(splits))
+		for i, s := range splits {
+			index[s] = i
+			e.Int(s.Position)
+			e.Int(int(s.Alignment))
+			e.Int(len(s.BecauseOf))
+			for _, shape := range s.BecauseOf {
+				e.Shape(shape)
+			}
+		}
+		return index
+	}
+	hIndex, vIndex := encodeSplits(m.HSplits), encodeSplits(m.VSplits)
+	type cell struct {
+		h, v  int
+		stack []*shared.Point
+	}
+	cells := make([]cell, 0, len(m.Stacks))
+	for k, stack := range m.Stacks {
+		h, hok := hIndex[k.HSplit]
+		v, vok := vIndex[k.VSplit]
+		if hok && vok {
+			cells = append(cells, cell{h, v, stack})
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].h != cells[j].h {
+			return cells[i].h < cells[j].h
+		}
+		return cells[i].v < cells[j].v
+	})
+	e.Int(len(cells))
+	for _, c := range cells {
+		e.Int(c.h)
+		e.Int(c.v)
+		e.Int(len(c.stack))
+		for _, p := range c.stack {
+			e.Int(pointIndex[p])
+		}
+	}
+	return e.Encode(binaryFormat, binaryVersion)
+}
+
+// UnmarshalBinary replaces the map with an index encoded by MarshalBinary. The map is unchanged if data is corrupt,
+// wrapping shared.ErrCorrupt, or from another version, wrapping shared.ErrVersion. Data which decodes but breaks the
+// invariants of the index, such as splits out of order or stacks out of stacking order, is corrupt too.
+func (m *Struct) UnmarshalBinary(data []byte) error {
+	d, err := shared.NewBinaryDecoder(data, binaryFormat, binaryVersion)
+	if err != nil {
+		return err
+	}
+	// invalid is the first invariant found broken, the checksum only shows data is as it was encoded.
+	var invalid error
+	corrupt := func(format string, args ...interface{}) {
+		if invalid == nil {
+			invalid = fmt.Errorf("%w: "+format, append([]interface{}{shared.ErrCorrupt}, args...)...)
+		}
+	}
+	sequence := d.Int()
+	var members shared.Members
+	points := make([]*shared.Point, d.Len())
+	for i := range points {
+		points[i] = &shared.Point{Shape: d.Shape(), ZIndex: d.Int(), Order: d.Int()}
+		members.Add(points[i].Shape)
+	}
+	decodeSplits := func(alignment Alignment) []*Split {
+		splits := make([]*Split, d.Len())
+		for i := range splits {
+			splits[i] = &Split{Position: d.Int(), Alignment: Alignment(d.Int())}
+			if n := d.Len(); n > 0 {
+				splits[i].BecauseOf = make([]shared.Shape, n)
+				for j := range splits[i].BecauseOf {
+					splits[i].BecauseOf[j] = d.Shape()
+				}
+			}
+			if splits[i].Alignment != alignment {
+				corrupt("split %d has alignment %d want %d", i, splits[i].Alignment, alignment)
+			}
+			if i > 0 && splits[i].Position <= splits[i-1].Position {
+				corrupt("split %d at %d is not after %d", i, splits[i].Position, splits[i-1].Position)
+			}
+		}
+		return splits
+	}
+	hSplits, vSplits := decodeSplits(Horizontal), decodeSplits(Vertical)
+	// Index reads 0 once data is found to be corrupt, which is out of range of an empty slice.
+	split := func(splits []*Split) *Split {
+		if i := d.Index(len(splits)); i < len(splits) {
+			return splits[i]
+		}
+		return nil
+	}
+	cells := d.Len()
+	stacks := make(map[SplitCoordination][]*shared.Point, cells)
+	for i := 0; i < cells; i++ {
+		k := SC(split(hSplits), split(vSplits))
+		if _, ok := stacks[k]; ok && k.HSplit != nil && k.VSplit != nil {
+			corrupt("cell %d repeats the splits at %d, %d", i, k.HSplit.Position, k.VSplit.Position)
+		}
+		stack := make([]*shared.Point, d.Len())
+		for j := range stack {
+			if p := d.Index(len(points)); p < len(points) {
+				stack[j] = points[p]
+			}
+			if j > 0 && stack[j] != nil && stack[j-1] != nil && !stack[j-1].Below(stack[j]) {
+				corrupt("cell %d is out of stacking order at %d", i, j)
+			}
+		}
+		stacks[k] = stack
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+	if invalid != nil {
+		return invalid
+	}
+	m.HSplits, m.VSplits, m.Stacks = hSplits, vSplits, stacks
+	m.Sequence, m.members = sequence, members
+	return nil
+}
+
+// edge returns the position of the first split, from the start or the end of splits, made by a shape with non-empty
+// bounds whose position is at that split.
+func edge(splits []*Split, fromStart bool, position func(b image.Rectangle) int) (int, bool) {
+	for i := range splits {
+		s := splits[i]
+		if !fromStart {
+			s = splits[len(splits)-1-i]
+		}
+		for _, shape := range s.BecauseOf {
+			if b := shape.Bounds(); !b.Empty() && position(b) == s.Position {
+				return s.Position, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,572 @@
+package spatialhash
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/arran4/spacemap/shared"
+)
+
+const (
+	DefaultCellSize = 64
+	DefaultMaxCells = 1024
+)
+
+// CellSize is an option for New setting the width and height of each cell.
+type CellSize int
+
+// MaxCells is an option for New setting how many cells a shape can cover before it is kept in the Large list which is
+// checked by every query instead.
+type MaxCells int
+
+// Struct hashes shapes into square cells keyed by the cell coordinate, each shape is in every cell its bounds cover.
+// Every cell holds its points in stacking order.
+type Struct struct {
+	CellSize int
+	MaxCells int
+	Cells    map[image.Point][]*shared.Point
+	Large    []*shared.Point
+	// Sequence orders shapes with the same z-index as they are spread over many cells.
+	Sequence int
+	members  shared.Members
+}
+
+func New(ops ...shared.Op) *Struct {
+	m := &Struct{
+		CellSize: DefaultCellSize,
+		MaxCells: DefaultMaxCells,
+		Cells:    map[image.Point][]*shared.Point{},
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case CellSize:
+			m.CellSize = int(op)
+		case MaxCells:
+			m.MaxCells = int(op)
+		}
+	}
+	if m.CellSize < 1 {
+		m.CellSize = 1
+	}
+	return m
+}
+
+// Envelope returns the rectangle used to position a shape with bounds b in the map, shapes with empty bounds are
+// positioned at their minimum point.
+func Envelope(b image.Rectangle) image.Rectangle {
+	b = b.Canon()
+	if b.Dx() == 0 {
+		b.Max.X = b.Min.X + 1
+	}
+	if b.Dy() == 0 {
+		b.Max.Y = b.Min.Y + 1
+	}
+	return b
+}
+
+// floorDiv divides rounding towards negative infinity so cells either side of zero are the same size.
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// Cell returns the coordinate of the cell containing x, y.
+func (m *Struct) Cell(x, y int) image.Point {
+	return image.Pt(floorDiv(x, m.CellSize), floorDiv(y, m.CellSize))
+}
+
+// CellRange returns the coordinates of the cells covered by r as a rectangle, Max being exclusive.
+func (m *Struct) CellRange(r image.Rectangle) image.Rectangle {
+	return image.Rectangle{
+		Min: m.Cell(r.Min.X, r.Min.Y),
+		Max: m.Cell(r.Max.X-1, r.Max.Y-1).Add(image.Pt(1, 1)),
+	}
+}
+
+// IsLarge reports if the shape with bounds b covers too many cells to be hashed.
+func (m *Struct) IsLarge(b image.Rectangle) bool {
+	cells := m.CellRange(Envelope(b))
+	return int64(cells.Dx())*int64(cells.Dy()) > int64(m.MaxCells)
+}
+
+func (m *Struct) AddAll(shapes ...shared.Shape) *Struct {
+	for _, shape := range shapes {
+		m.Add(shape, 0)
+	}
+	return m
+}
+
+func (m *Struct) Add(shape shared.Shape, zIndex int) {
+	m.Sequence++
+	m.insert(&shared.Point{
+		Shape:  shape,
+		ZIndex: zIndex,
+		Order:  m.Sequence,
+	}, shape.Bounds())
+	m.members.Add(shape)
+}
+
+// insert adds p to every cell within b, or to the Large list if there are too many.
+func (m *Struct) insert(p *shared.Point, b image.Rectangle) {
+	if m.IsLarge(b) {
+		m.Large = shared.PointArray(m.Large).Insert(p)
+		return
+	}
+	cells := m.CellRange(Envelope(b))
+	for y := cells.Min.Y; y < cells.Max.Y; y++ {
+		for x := cells.Min.X; x < cells.Max.X; x++ {
+			c := image.Pt(x, y)
+			m.Cells[c] = shared.PointArray(m.Cells[c]).Insert(p)
+		}
+	}
+}
+
+// without returns points without any for shape, keeping their order.
+func without(points []*shared.Point, shape shared.Shape) []*shared.Point {
+	result := points[:0]
+	for _, p := range points {
+		if p.Shape != shape {
+			result = append(result, p)
+		}
+	}
+	for i := len(result); i < len(points); i++ {
+		points[i] = nil
+	}
+	return result
+}
+
+func (m *Struct) Remove(shape shared.Shape) {
+	m.remove(shape, shape.Bounds())
+	m.members.Remove(shape)
+}
+
+// remove takes shape, which was added with the bounds b, out of every cell.
+func (m *Struct) remove(shape shared.Shape, b image.Rectangle) {
+	if m.IsLarge(b) {
+		m.Large = without(m.Large, shape)
+		return
+	}
+	cells := m.CellRange(Envelope(b))
+	for y := cells.Min.Y; y < cells.Max.Y; y++ {
+		for x := cells.Min.X; x < cells.Max.X; x++ {
+			m.removeFromCell(image.Pt(x, y), shape)
+		}
+	}
+}
+
+func (m *Struct) removeFromCell(c image.Point, shape shared.Shape) {
+	points, ok := m.Cells[c]
+	if !ok {
+		return
+	}
+	if points = without(points, shape); len(points) == 0 {
+		delete(m.Cells, c)
+	} else {
+		m.Cells[c] = points
+	}
+}
+
+// FindPoint returns the point for shape which was added with the bounds b.
+func (m *Struct) FindPoint(shape shared.Shape, b image.Rectangle) *shared.Point {
+	points := m.Large
+	if !m.IsLarge(b) {
+		env := Envelope(b)
+		points = m.Cells[m.Cell(env.Min.X, env.Min.Y)]
+	}
+	for _, p := range points {
+		if p.Shape == shape {
+			return p
+		}
+	}
+	return nil
+}
+
+// FindPoints returns the point for each time shape was added with the bounds b, bottom first.
+func (m *Struct) FindPoints(shape shared.Shape, b image.Rectangle) (found []*shared.Point) {
+	points := m.Large
+	if !m.IsLarge(b) {
+		env := Envelope(b)
+		points = m.Cells[m.Cell(env.Min.X, env.Min.Y)]
+	}
+	for _, p := range points {
+		if p.Shape == shape {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func (m *Struct) GetStackAt(x int, y int) []shared.Shape {
+	return m.AppendStackAt([]shared.Shape{}, x, y)
+}
+
+// VisitStackAt calls f with each shape at x, y and its z-index, topmost first, until f returns false The cell and the large
+// shapes are each in stacking order so they are walked together from the top.
+func (m *Struct) VisitStackAt(x, y int, f func(shape shared.Shape, zIndex int) bool) {
+	cell, large := m.Cells[m.Cell(x, y)], m.Large
+	i, j := len(cell)-1, len(large)-1
+	for i >= 0 || j >= 0 {
+		var p *shared.Point
+		if j < 0 || i >= 0 && large[j].Below(cell[i]) {
+			p, i = cell[i], i-1
+		} else {
+			p, j = large[j], j-1
+		}
+		if p.PointIn(x, y) && !f(p.Shape, p.ZIndex) {
+			return
+		}
+	}
+}
+
+// AppendStackAt appends the shapes at x, y to dst, topmost first, and returns the extended slice.
+func (m *Struct) AppendStackAt(dst []shared.Shape, x, y int) []shared.Shape {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		dst = append(dst, shape)
+		return true
+	})
+	return dst
+}
+
+func (m *Struct) GetAt(x int, y int) (top shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		top = shape
+		return false
+	})
+	return top
+}
+
+func (m *Struct) GetBottomAt(x int, y int) (bottom shared.Shape) {
+	m.VisitStackAt(x, y, func(shape shared.Shape, _ int) bool {
+		bottom = shape
+		return true
+	})
+	return bottom
+}
+
+// Len returns the number of shapes.
+func (m *Struct) Len() int {
+	return m.members.Len()
+}
+
+// Contains reports if shape has been added and not removed.
+func (m *Struct) Contains(shape shared.Shape) bool {
+	return m.members.Contains(shape)
+}
+
+// All returns every shape, topmost first.
+func (m *Struct) All() []shared.Shape {
+	return shared.PointArray(m.allPoints()).Shapes()
+}
+
+// allPoints returns the point of every shape, topmost first.
+func (m *Struct) allPoints() []*shared.Point {
+	points := append([]*shared.Point(nil), m.Large...)
+	seen := map[*shared.Point]struct{}{}
+	for _, cell := range m.Cells {
+		for _, p := range cell {
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				points = append(points, p)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(shared.ZSort(points)))
+	return points
+}
+
+// Bounds returns the smallest rectangle covering every shape, shapes with empty bounds are ignored. Every shape is
+// checked.
+func (m *Struct) Bounds() (r image.Rectangle) {
+	for _, p := range m.Large {
+		if b := p.Bounds(); !b.Empty() {
+			r = r.Union(b)
+		}
+	}
+	for _, cell := range m.Cells {
+		for _, p := range cell {
+			if b := p.Bounds(); !b.Empty() {
+				r = r.Union(b)
+			}
+		}
+	}
+	return r
+}
+
+// Clear removes every shape, keeping the cells, emptied, and the capacity of them and the large shapes for the next
+// shapes.
+func (m *Struct) Clear() {
+	for c, points := range m.Cells {
+		for i := range points {
+			points[i] = nil
+		}
+		m.Cells[c] = points[:0]
+	}
+	for i := range m.Large {
+		m.Large[i] = nil
+	}
+	m.Large = m.Large[:0]
+	m.Sequence = 0
+	m.members.Clear()
+}
+
+// Clone returns a copy which can be changed independently of m. The shapes themselves are shared, and a point in
+// several cells is still shared between them.
+func (m *Struct) Clone() *Struct {
+	points := shared.PointCloner{}
+	c := &Struct{
+		CellSize: m.CellSize,
+		MaxCells: m.MaxCells,
+		Cells:    make(map[image.Point][]*shared.Point, len(m.Cells)),
+		Large:    points.CloneAll(m.Large),
+		Sequence: m.Sequence,
+		members:  m.members.Clone(),
+	}
+	for cell, cellPoints := range m.Cells {
+		if len(cellPoints) > 0 {
+			c.Cells[cell] = points.CloneAll(cellPoints)
+		}
+	}
+	return c
+}
+
+// MarshalJSON encodes every shape with its z-index, the shapes must be registered with shared.RegisterShape.
+func (m *Struct) MarshalJSON() ([]byte, error) {
+	return shared.MarshalShapes(shared.PointArray(m.allPoints()).ZShapes())
+}
+
+// UnmarshalJSON replaces the shapes of a map created with New with those encoded by MarshalJSON, stacked as they
+// were. Options given to New are kept.
+func (m *Struct) UnmarshalJSON(data []byte) error {
+	shapes, err := shared.UnmarshalShapes(data)
+	if err != nil {
+		return err
+	}
+	m.Clear()
+	for i := len(shapes) - 1; i >= 0; i-- {
+		m.Add(shapes[i].Shape, shapes[i].ZIndex)
+	}
+	return nil
+}
+
+func (m *Struct) GetStackIn(r image.Rectangle, mode shared.Containment) []shared.Shape {
+	return shared.PointArray(m.pointsIn(r, mode)).Shapes()
+}
+
+// GetZStackIn is GetStackIn with the z-index of each shape.
+func (m *Struct) GetZStackIn(r image.Rectangle, mode shared.Containment) []shared.ZShape {
+	return shared.PointArray(m.pointsIn(r, mode)).ZShapes()
+}
+
+// GetZStackAt is GetStackAt with the z-index of each shape.
+func (m *Struct) GetZStackAt(x, y int) []shared.ZShape {
+	result := []shared.ZShape{}
+	m.VisitStackAt(x, y, func(shape shared.Shape, zIndex int) bool {
+		result = append(result, shared.ZShape{Shape: shape, ZIndex: zIndex})
+		return true
+	})
+	return result
+}
+
+// pointsIn returns the points of the shapes matching r, topmost first. It checks every cell r covers, or every occupied
+// cell if there are fewer of them.
+func (m *Struct) pointsIn(r image.Rectangle, mode shared.Containment) []*shared.Point {
+	if r.Empty() {
+		return nil
+	}
+	var found []*shared.Point
+	seen := map[*shared.Point]struct{}{}
+	check := func(points []*shared.Point) {
+		for _, p := range points {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			if mode.Match(p.Bounds(), r) {
+				found = append(found, p)
+			}
+		}
+	}
+	cells := m.CellRange(r)
+	if int64(cells.Dx())*int64(cells.Dy()) > int64(len(m.Cells)) {
+		for c, points := range m.Cells {
+			if c.In(cells) {
+				check(points)
+			}
+		}
+	} else {
+		for y := cells.Min.Y; y < cells.Max.Y; y++ {
+			for x := cells.Min.X; x < cells.Max.X; x++ {
+				check(m.Cells[image.Pt(x, y)])
+			}
+		}
+	}
+	check(m.Large)
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	return found
+}
+
+// Nearest returns the shape nearest to x, y, or nil when there are none.
+func (m *Struct) Nearest(x, y int) shared.Shape {
+	if s := m.KNearest(x, y, 1, math.Inf(1)); len(s) > 0 {
+		return s[0]
+	}
+	return nil
+}
+
+// KNearest returns up to k shapes no further than maxDistance from x, y, nearest first. Only the cells around the point are searched.
+func (m *Struct) KNearest(x, y, k int, maxDistance float64) []shared.Shape {
+	return shared.KNearest(x, y, k, maxDistance, m.extent(), func(r image.Rectangle) []shared.Shape {
+		return m.GetStackIn(r, shared.Intersects)
+	})
+}
+
+// SegmentCast returns the shapes crossed by the line from x0, y0 to x1, y1 in order of first contact. Only the shapes
+// in the cells along the line and the large shapes are checked.
+func (m *Struct) SegmentCast(x0, y0, x1, y1 int) []shared.Hit {
+	seen := map[*shared.Point]struct{}{}
+	var found []*shared.Point
+	check := func(points []*shared.Point) {
+		for _, p := range points {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			if shared.SegmentOverlaps(p.Bounds(), x0, y0, x1, y1) {
+				found = append(found, p)
+			}
+		}
+	}
+	check(m.Large)
+	shared.CoverSegment(x0, y0, x1, y1, func(r image.Rectangle) bool {
+		cells := m.CellRange(r)
+		return cells.Dx() <= 2 && cells.Dy() <= 2
+	}, func(r image.Rectangle) {
+		cells := m.CellRange(r)
+		for y := cells.Min.Y; y < cells.Max.Y; y++ {
+			for x := cells.Min.X; x < cells.Max.X; x++ {
+				check(m.Cells[image.Pt(x, y)])
+			}
+		}
+	})
+	sort.Sort(sort.Reverse(shared.ZSort(found)))
+	candidates := make([]shared.Shape, 0, len(found))
+	for _, p := range found {
+		candidates = append(candidates, p.Shape)
+	}
+	return shared.Cast(x0, y0, x1, y1, candidates)
+}
+
+// RayCast returns the shapes crossed by a ray from x, y in the direction dx, dy, no further than maxDistance which can
+// be +Inf, in order of first contact.
+func (m *Struct) RayCast(x, y int, dx, dy, maxDistance float64) []shared.Hit {
+	return shared.RayCast(x, y, dx, dy, maxDistance, m.extent(), m.SegmentCast)
+}
+
+// extent returns the area covered by every cell and large shape.
+func (m *Struct) extent() image.Rectangle {
+	var r image.Rectangle
+	for _, p := range m.Large {
+		r = r.Union(Envelope(p.Bounds()))
+	}
+	for c, points := range m.Cells {
+		if len(points) == 0 {
+			continue
+		}
+		r = r.Union(image.Rectangle{Min: c.Mul(m.CellSize), Max: c.Add(image.Pt(1, 1)).Mul(m.CellSize)})
+	}
+	return r
+}
+
+// Update moves shape from oldBounds to its current bounds, only the cells it has left or entered are changed.
+func (m *Struct) Update(shape shared.Shape, oldBounds image.Rectangle) {
+	b := shape.Bounds()
+	if b == oldBounds {
+		return
+	}
+	points := m.FindPoints(shape, oldBounds)
+	if len(points) == 0 {
+		return
+	}
+	if m.IsLarge(b) || m.IsLarge(oldBounds) {
+		m.remove(shape, oldBounds)
+		for _, p := range points {
+			m.insert(p, b)
+		}
+		return
+	}
+	oldCells := m.CellRange(Envelope(oldBounds))
+	cells := m.CellRange(Envelope(b))
+	for y := oldCells.Min.Y; y < oldCells.Max.Y; y++ {
+		for x := oldCells.Min.X; x < oldCells.Max.X; x++ {
+			if c := image.Pt(x, y); !c.In(cells) {
+				m.removeFromCell(c, shape)
+			}
+		}
+	}
+	for y := cells.Min.Y; y < cells.Max.Y; y++ {
+		for x := cells.Min.X; x < cells.Max.X; x++ {
+			if c := image.Pt(x, y); !c.In(oldCells) {
+				for _, p := range points {
+					m.Cells[c] = shared.PointArray(m.Cells[c]).Insert(p)
+				}
+			}
+		}
+	}
+}
+
+func (m *Struct) Move(shape shared.Resizable, bounds image.Rectangle) {
+	oldBounds := shape.Bounds()
+	shape.SetBounds(bounds)
+	m.Update(shape, oldBounds)
+}
+
+// ZIndexOf returns the z-index of shape, or of its topmost copy when it was added more than once.
+func (m *Struct) ZIndexOf(shape shared.Shape) (int, bool) {
+	if p := shared.PointArray(m.FindPoints(shape, shape.Bounds())).Top(); p != nil {
+		return p.ZIndex, true
+	}
+	return 0, false
+}
+
+// SetZIndex changes the z-index of each of the shape's points, keeping the order of copies of a shape added more
+// than once, and restacks them in each of their cells.
+func (m *Struct) SetZIndex(shape shared.Shape, zIndex int) {
+	b := shape.Bounds()
+	points := m.FindPoints(shape, b)
+	for _, p := range points {
+		m.Sequence++
+		p.ZIndex = zIndex
+		p.Order = m.Sequence
+		if m.IsLarge(b) {
+			m.Large = shared.PointArray(shared.PointArray(m.Large).RemovePoint(p)).Insert(p)
+			continue
+		}
+		cells := m.CellRange(Envelope(b))
+		for y := cells.Min.Y; y < cells.Max.Y; y++ {
+			for x := cells.Min.X; x < cells.Max.X; x++ {
+				c := image.Pt(x, y)
+				m.Cells[c] = shared.PointArray(shared.PointArray(m.Cells[c]).RemovePoint(p)).Insert(p)
+			}
+		}
+	}
+}
+
+// BringToFront restacks shape above every other shape.
+func (m *Struct) BringToFront(shape shared.Shape) {
+	shared.BringToFront(m, shape)
+}
+
+// SendToBack restacks shape below every other shape.
+func (m *Struct) SendToBack(shape shared.Shape) {
+	shared.SendToBack(m, shape)
+}
+
+// PlaceAbove restacks shape directly above other, even if that lowers it, leaving the order of the other shapes
+// unchanged.
+func (m *Struct) PlaceAbove(shape shared.Shape, other shared.Shape) {
+	shared.PlaceAbove(m, shape, other)
+}
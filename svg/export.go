@@ -0,0 +1,235 @@
+package svg
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/space2trees"
+	"github.com/arran4/spacemap/spacepartition"
+)
+
+// Splits is an option for Write drawing a dashed line across the drawing at each of the HSplits and VSplits of a
+// *spacepartition.Struct.
+type Splits bool
+
+// StackCounts is an option for Write labelling each cell of a *spacepartition.Struct with the number of shapes in its
+// stack.
+type StackCounts bool
+
+// Intervals is an option for Write drawing a line across the drawing at the value of each node in the trees of a
+// *space2trees.Struct, green where intervals begin, red where they end, orange where both do and grey where neither
+// does.
+type Intervals bool
+
+// margin is the space, in pixels, left around the drawing.
+const margin = 20
+
+// Write draws the shapes of m as an SVG document for debugging, bottom first so the topmost is painted last. Shapes
+// are coloured by z-index, from blue for the lowest to red for the highest, and labelled with their String() names.
+// Polygons are drawn through their vertices and circles and ellipses through the centres of their edge pixels, the
+// points PointIn measures, while shapes of other types are drawn as their dashed bounds.
+//
+// The options overlay the structure of the index, Splits and StackCounts for a *spacepartition.Struct and Intervals
+// for a *space2trees.Struct. They draw nothing for other maps.
+func Write(w io.Writer, m spacemap.Interface, ops ...shared.Op) error {
+	var splits, counts, intervals bool
+	for _, op := range ops {
+		switch op := op.(type) {
+		case Splits:
+			splits = bool(op)
+		case StackCounts:
+			counts = bool(op)
+		case Intervals:
+			intervals = bool(op)
+		}
+	}
+	shapes := m.All()
+	zIndexes := make([]int, len(shapes))
+	zo, ordered := m.(spacemap.ZOrderer)
+	for i, s := range shapes {
+		zIndexes[i] = len(shapes) - 1 - i
+		if ordered {
+			if z, ok := zo.ZIndexOf(s); ok {
+				zIndexes[i] = z
+			}
+		}
+	}
+	hues := hues(zIndexes)
+	sp, _ := m.(*spacepartition.Struct)
+	sp2t, _ := m.(*space2trees.Struct)
+	view := m.Bounds()
+	if sp != nil && (splits || counts) && len(sp.HSplits) > 0 && len(sp.VSplits) > 0 {
+		view = view.Union(image.Rect(sp.HSplits[0].Position, sp.VSplits[0].Position,
+			sp.HSplits[len(sp.HSplits)-1].Position, sp.VSplits[len(sp.VSplits)-1].Position))
+	}
+	if sp2t != nil && intervals && sp2t.HTree != nil && sp2t.VTree != nil {
+		minX, _ := sp2t.HTree.Most(0)
+		maxX, _ := sp2t.HTree.Most(1)
+		minY, _ := sp2t.VTree.Most(0)
+		maxY, _ := sp2t.VTree.Most(1)
+		view = view.Union(image.Rect(minX.Value, minY.Value, maxX.Value, maxY.Value))
+	}
+	view = view.Inset(-margin)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="%d %d %d %d" width="%d" height="%d">`+"\n",
+		view.Min.X, view.Min.Y, view.Dx(), view.Dy(), view.Dx(), view.Dy())
+	b.WriteString(`<g id="shapes" fill-opacity="0.3" font-family="sans-serif" font-size="10">` + "\n")
+	for i := len(shapes) - 1; i >= 0; i-- {
+		writeShape(&b, shapes[i], zIndexes[i], hues[zIndexes[i]])
+	}
+	b.WriteString("</g>\n")
+	if sp != nil && splits {
+		writeSplits(&b, sp, view)
+	}
+	if sp != nil && counts {
+		writeStackCounts(&b, sp)
+	}
+	if sp2t != nil && intervals {
+		b.WriteString(`<g id="intervals" stroke-opacity="0.6">` + "\n")
+		sp2t.HTree.Walk(func(n *space2trees.Node) {
+			writeEndpoint(&b, n, "x", image.Pt(n.Value, view.Min.Y), image.Pt(n.Value, view.Max.Y))
+		})
+		sp2t.VTree.Walk(func(n *space2trees.Node) {
+			writeEndpoint(&b, n, "y", image.Pt(view.Min.X, n.Value), image.Pt(view.Max.X, n.Value))
+		})
+		b.WriteString("</g>\n")
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// hues spreads the distinct z-indexes evenly over the hues from blue, 240, for the lowest to red, 0, for the highest.
+func hues(zIndexes []int) map[int]int {
+	hues := map[int]int{}
+	var distinct []int
+	for _, z := range zIndexes {
+		if _, ok := hues[z]; !ok {
+			hues[z] = 240
+			distinct = append(distinct, z)
+		}
+	}
+	sort.Ints(distinct)
+	if len(distinct) > 1 {
+		for i, z := range distinct {
+			hues[z] = 240 - 240*i/(len(distinct)-1)
+		}
+	}
+	return hues
+}
+
+// writeShape draws shape in a group titled with its z-index and name.
+func writeShape(b *strings.Builder, shape shared.Shape, zIndex, hue int) {
+	name := html.EscapeString(shape.String())
+	colour := "hsl(" + strconv.Itoa(hue) + ", 80%, 45%)"
+	fmt.Fprintf(b, `<g fill="%s" stroke="%s"><title>z %d: %s</title>`, colour, colour, zIndex, name)
+	bounds := shape.Bounds()
+	switch s := shape.(type) {
+	case *shared.Rectangle:
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="%d" height="%d"/>`, s.Min.X, s.Min.Y, s.Dx(), s.Dy())
+	case *shared.Circle:
+		fmt.Fprintf(b, `<circle cx="%g" cy="%g" r="%d"/>`, float64(s.Center.X)+0.5, float64(s.Center.Y)+0.5, s.Radius)
+	case *shared.Ellipse:
+		fmt.Fprintf(b, `<ellipse cx="%g" cy="%g" rx="%d" ry="%d"/>`,
+			float64(s.Center.X)+0.5, float64(s.Center.Y)+0.5, s.Radii.X, s.Radii.Y)
+	case *shared.Polygon:
+		var d []string
+		for _, r := range s.Rings {
+			for i, p := range r {
+				command := "L"
+				if i == 0 {
+					command = "M"
+				}
+				d = append(d, command+strconv.Itoa(p.X)+" "+strconv.Itoa(p.Y))
+			}
+			d = append(d, "Z")
+		}
+		fillRule := "nonzero"
+		if s.FillRule == shared.EvenOdd {
+			fillRule = "evenodd"
+		}
+		fmt.Fprintf(b, `<path fill-rule="%s" d="%s"/>`, fillRule, strings.Join(d, " "))
+	default:
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="%d" height="%d" stroke-dasharray="4 2"/>`,
+			bounds.Min.X, bounds.Min.Y, bounds.Dx(), bounds.Dy())
+	}
+	fmt.Fprintf(b, `<text x="%d" y="%d" fill-opacity="1" stroke="none">%s</text></g>`+"\n",
+		bounds.Min.X+2, bounds.Min.Y+10, name)
+}
+
+// writeSplits draws the splits of m across view, titled with their positions and the shapes they are at the edges of.
+// An HSplit is at an x position so it is drawn as a vertical line, and a VSplit as a horizontal one.
+func writeSplits(b *strings.Builder, m *spacepartition.Struct, view image.Rectangle) {
+	title := func(axis string, s *spacepartition.Split) string {
+		names := make([]string, len(s.BecauseOf))
+		for i, shape := range s.BecauseOf {
+			names[i] = shape.String()
+		}
+		return html.EscapeString(axis + "=" + strconv.Itoa(s.Position) + ": " + strings.Join(names, ", "))
+	}
+	b.WriteString(`<g id="splits" stroke="grey" stroke-dasharray="2 2">` + "\n")
+	for _, s := range m.HSplits {
+		fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d"><title>%s</title></line>`+"\n",
+			s.Position, view.Min.Y, s.Position, view.Max.Y, title("x", s))
+	}
+	for _, s := range m.VSplits {
+		fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d"><title>%s</title></line>`+"\n",
+			view.Min.X, s.Position, view.Max.X, s.Position, title("y", s))
+	}
+	b.WriteString("</g>\n")
+}
+
+// writeStackCounts labels the middle of each cell of m holding a stack with the number of shapes in it. A cell begins
+// at its HSplit and VSplit and ends at the next ones.
+func writeStackCounts(b *strings.Builder, m *spacepartition.Struct) {
+	b.WriteString(`<g id="stacks" font-family="sans-serif" font-size="8" text-anchor="middle" dominant-baseline="middle">` + "\n")
+	for i, hs := range m.HSplits {
+		for j, vs := range m.VSplits {
+			stack := m.Stacks[spacepartition.SC(hs, vs)]
+			if len(stack) == 0 {
+				continue
+			}
+			cell := image.Rect(hs.Position, vs.Position, hs.Position+1, vs.Position+1)
+			if i+1 < len(m.HSplits) {
+				cell.Max.X = m.HSplits[i+1].Position
+			}
+			if j+1 < len(m.VSplits) {
+				cell.Max.Y = m.VSplits[j+1].Position
+			}
+			fmt.Fprintf(b, `<text x="%g" y="%g">%d</text>`+"\n",
+				float64(cell.Min.X+cell.Max.X)/2, float64(cell.Min.Y+cell.Max.Y)/2, len(stack))
+		}
+	}
+	b.WriteString("</g>\n")
+}
+
+// writeEndpoint draws a line from one point to another for the node n of the tree along axis, titled with the
+// intervals held at n.
+func writeEndpoint(b *strings.Builder, n *space2trees.Node, axis string, from, to image.Point) {
+	var begins, ends bool
+	entries := make([]string, len(n.Here))
+	for i, h := range n.Here {
+		begins = begins || h.Type == space2trees.Begin
+		ends = ends || h.Type == space2trees.End
+		entries[i] = h.String()
+	}
+	colour := "grey"
+	switch {
+	case begins && ends:
+		colour = "orange"
+	case begins:
+		colour = "green"
+	case ends:
+		colour = "red"
+	}
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"><title>%s</title></line>`+"\n",
+		from.X, from.Y, to.X, to.Y, colour, html.EscapeString(axis+"="+strconv.Itoa(n.Value)+": "+strings.Join(entries, ", ")))
+}
@@ -0,0 +1,194 @@
+package svg
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/simplearray"
+	"github.com/arran4/spacemap/space2trees"
+	"github.com/arran4/spacemap/spacepartition"
+	"github.com/google/go-cmp/cmp"
+)
+
+// element is a drawn element of a written document, with the id of the outer group it is in.
+type element struct {
+	Name  string
+	Group string
+	Attr  map[string]string
+	Text  string
+}
+
+// written writes m and returns the elements of the document other than groups and titles.
+func written(t *testing.T, m spacemap.Interface, ops ...shared.Op) []*element {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Write(&b, m, ops...); err != nil {
+		t.Fatalf("Write() error %v", err)
+	}
+	d := xml.NewDecoder(&b)
+	var elements []*element
+	var open []*element
+	group := ""
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return elements
+		}
+		if err != nil {
+			t.Fatalf("Write() wrote a bad document: %v", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			e := &element{Name: tok.Name.Local, Group: group, Attr: map[string]string{}}
+			for _, a := range tok.Attr {
+				e.Attr[a.Name.Local] = a.Value
+			}
+			if e.Name == "g" && e.Attr["id"] != "" {
+				group = e.Attr["id"]
+			}
+			if e.Name != "g" && e.Name != "title" && e.Name != "svg" {
+				elements = append(elements, e)
+			}
+			open = append(open, e)
+		case xml.CharData:
+			if len(open) > 0 {
+				open[len(open)-1].Text += string(tok)
+			}
+		case xml.EndElement:
+			if e := open[len(open)-1]; e.Name == "g" && e.Attr["id"] != "" {
+				group = ""
+			}
+			open = open[:len(open)-1]
+		}
+	}
+}
+
+// box is a shape of a type Write doesn't know.
+type box struct {
+	*shared.Rectangle
+}
+
+func TestWrite(t *testing.T) {
+	m := simplearray.New()
+	m.Add(shared.NewRectangle(0, 0, 40, 40, shared.Name("back & forth")), 0)
+	m.Add(shared.NewCircle(-5, 30, 10), 1)
+	m.Add(shared.NewEllipse(50, 20, 10, 5), 1)
+	m.Add(box{shared.NewRectangle(60, 60, 70, 80)}, 2)
+	m.Add(shared.NewPolygon([]image.Point{{0, 50}, {30, 50}, {30, 80}, {0, 80}}, shared.Ring{{10, 60}, {20, 60}, {20, 70}}, shared.EvenOdd), 3)
+	var got []string
+	for _, e := range written(t, m, Splits(true), Intervals(true)) {
+		if e.Name == "text" {
+			got = append(got, e.Name+" "+e.Text)
+			continue
+		}
+		attrs := []string{e.Name}
+		for _, a := range []string{"x", "y", "width", "height", "cx", "cy", "r", "rx", "ry", "fill-rule", "d", "stroke-dasharray"} {
+			if v, ok := e.Attr[a]; ok {
+				attrs = append(attrs, a+"="+v)
+			}
+		}
+		got = append(got, strings.Join(attrs, " "))
+	}
+	want := []string{
+		"rect x=0 y=0 width=40 height=40",
+		"text back & forth:Rect((0,0)->(40,40))",
+		"circle cx=-4.5 cy=30.5 r=10",
+		"text Circle((-5,30), r:10)",
+		"ellipse cx=50.5 cy=20.5 rx=10 ry=5",
+		"text Ellipse((50,20), r:(10,5))",
+		"rect x=60 y=60 width=10 height=20 stroke-dasharray=4 2",
+		"text Rect((60,60)->(70,80))",
+		"path fill-rule=evenodd d=M0 50 L30 50 L30 80 L0 80 Z M10 60 L20 60 L20 70 Z",
+		"text Polygon([(0,50) (30,50) (30,80) (0,80)], [(10,60) (20,60) (20,70)])",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Write() = \n%s", diff)
+	}
+}
+
+func TestWrite_Colours(t *testing.T) {
+	m := spacepartition.New()
+	for z := 0; z < 3; z++ {
+		m.Add(shared.NewRectangle(z*10, 0, z*10+5, 5), z*10)
+	}
+	m.Add(shared.NewRectangle(0, 10, 5, 15), 20)
+	var b bytes.Buffer
+	if err := Write(&b, m); err != nil {
+		t.Fatalf("Write() error %v", err)
+	}
+	for _, want := range []string{
+		`<g fill="hsl(240, 80%, 45%)" stroke="hsl(240, 80%, 45%)"><title>z 0: Rect((0,0)-&gt;(5,5))</title>`,
+		`<g fill="hsl(120, 80%, 45%)" stroke="hsl(120, 80%, 45%)"><title>z 10: Rect((10,0)-&gt;(15,5))</title>`,
+		`<g fill="hsl(0, 80%, 45%)" stroke="hsl(0, 80%, 45%)"><title>z 20: Rect((20,0)-&gt;(25,5))</title>`,
+		`<g fill="hsl(0, 80%, 45%)" stroke="hsl(0, 80%, 45%)"><title>z 20: Rect((0,10)-&gt;(5,15))</title>`,
+		`viewBox="-20 -20 65 55"`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Write() = %s\nwant it to contain %s", b.String(), want)
+		}
+	}
+}
+
+func TestWrite_Splits(t *testing.T) {
+	m := spacepartition.New()
+	m.Add(shared.NewRectangle(0, 0, 40, 40), 0)
+	m.Add(shared.NewRectangle(20, 20, 60, 60), 1)
+	lines, labels := map[string]bool{}, map[string]string{}
+	for _, e := range written(t, m, Splits(true), StackCounts(true)) {
+		switch e.Group {
+		case "splits":
+			lines[e.Attr["x1"]+","+e.Attr["y1"]+" "+e.Attr["x2"]+","+e.Attr["y2"]] = true
+		case "stacks":
+			labels[e.Attr["x"]+","+e.Attr["y"]] = e.Text
+		}
+	}
+	wantLines := map[string]bool{}
+	for _, p := range []string{"0", "20", "40", "60"} {
+		wantLines[p+",-20 "+p+",80"] = true
+		wantLines["-20,"+p+" 80,"+p] = true
+	}
+	if diff := cmp.Diff(lines, wantLines); diff != "" {
+		t.Errorf("split lines = \n%s", diff)
+	}
+	// Stacks hold the shapes whose bounds reach a cell, so those at 40 and 60 hold the shapes ending there too.
+	if got := len(labels); got != 14 {
+		t.Errorf("%d cells labelled want 14", got)
+	}
+	for at, want := range map[string]string{"10,10": "1", "30,30": "2", "50,50": "2", "60.5,60.5": "1"} {
+		if labels[at] != want {
+			t.Errorf("cell labelled %q at %s want %q", labels[at], at, want)
+		}
+	}
+	if elements := written(t, simplearray.New(), Splits(true), StackCounts(true), Intervals(true)); len(elements) != 0 {
+		t.Errorf("Write() of an empty simplearray with overlays = %d elements want 0", len(elements))
+	}
+}
+
+func TestWrite_Intervals(t *testing.T) {
+	m := space2trees.New()
+	m.Add(shared.NewRectangle(0, 0, 40, 40), 0)
+	m.Add(shared.NewRectangle(20, 10, 40, 30), 1)
+	colours := map[string]string{}
+	for _, e := range written(t, m, Intervals(true)) {
+		if e.Group == "intervals" {
+			if e.Attr["x1"] == e.Attr["x2"] {
+				colours["x="+e.Attr["x1"]] = e.Attr["stroke"]
+			} else {
+				colours["y="+e.Attr["y1"]] = e.Attr["stroke"]
+			}
+		}
+	}
+	want := map[string]string{
+		"x=0": "green", "x=20": "green", "x=40": "red",
+		"y=0": "green", "y=10": "green", "y=30": "red", "y=40": "red",
+	}
+	if diff := cmp.Diff(colours, want); diff != "" {
+		t.Errorf("interval lines = \n%s", diff)
+	}
+}
@@ -0,0 +1,313 @@
+package svg
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// flatness is the furthest, in pixels, the straight edges replacing a curve may stray from it.
+const flatness = 0.25
+
+// parsePath returns the subpaths of path data as rings, with curves and arcs flattened into edges no further than
+// tolerance from them.
+func parsePath(d string, tolerance float64) ([][]point, error) {
+	sc := scanner{s: d}
+	var rings [][]point
+	var current, start, control point
+	var ring []point
+	var command, last byte
+	lineTo := func(p point) {
+		if ring == nil {
+			ring = []point{current}
+		}
+		ring = append(ring, p)
+		current = p
+	}
+	for sc.skip(); !sc.done(); sc.skip() {
+		if c, ok := sc.command(); ok {
+			command = c
+		} else if command == 0 || command == 'Z' || command == 'z' {
+			return nil, fmt.Errorf("path data %q has numbers without a command", d)
+		}
+		relative := command >= 'a'
+		var origin point
+		if relative {
+			origin = current
+		}
+		var args [7]float64
+		for i := 0; i < arguments(command); i++ {
+			var err error
+			if command&^0x20 == 'A' && (i == 3 || i == 4) {
+				args[i], err = sc.flag()
+			} else {
+				args[i], err = sc.number()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("path data %q: %w", d, err)
+			}
+			sc.skip()
+		}
+		at := func(i int) point {
+			return point{origin.X + args[i], origin.Y + args[i+1]}
+		}
+		// reflected is the control point of a smooth curve, the last control point reflected through the current
+		// point when the previous command was a curve of the same kind.
+		reflected := func(kinds string) point {
+			for i := 0; i < len(kinds); i++ {
+				if last&^0x20 == kinds[i] {
+					return point{2*current.X - control.X, 2*current.Y - control.Y}
+				}
+			}
+			return current
+		}
+		switch command &^ 0x20 {
+		case 'M':
+			if ring != nil {
+				rings = append(rings, ring)
+			}
+			ring = nil
+			current = at(0)
+			start = current
+			// Further coordinates after a move are lines.
+			command = 'L' | command&0x20
+		case 'L':
+			lineTo(at(0))
+		case 'H':
+			p := current
+			p.X = origin.X + args[0]
+			lineTo(p)
+		case 'V':
+			p := current
+			p.Y = origin.Y + args[0]
+			lineTo(p)
+		case 'C', 'S':
+			var c1, c2, end point
+			if command&^0x20 == 'C' {
+				c1, c2, end = at(0), at(2), at(4)
+			} else {
+				c1, c2, end = reflected("CS"), at(0), at(2)
+			}
+			for _, p := range cubic(current, c1, c2, end, tolerance) {
+				lineTo(p)
+			}
+			control = c2
+		case 'Q', 'T':
+			var c, end point
+			if command&^0x20 == 'Q' {
+				c, end = at(0), at(2)
+			} else {
+				c, end = reflected("QT"), at(0)
+			}
+			for _, p := range quadratic(current, c, end, tolerance) {
+				lineTo(p)
+			}
+			control = c
+		case 'A':
+			for _, p := range endpointArc(current, args[0], args[1], args[2], args[3] != 0, args[4] != 0, at(5), tolerance) {
+				lineTo(p)
+			}
+		case 'Z':
+			if ring != nil {
+				rings = append(rings, ring)
+			}
+			ring = nil
+			current = start
+		}
+		last = command
+	}
+	if ring != nil {
+		rings = append(rings, ring)
+	}
+	return rings, nil
+}
+
+// arguments returns the number of arguments command takes.
+func arguments(command byte) int {
+	switch command &^ 0x20 {
+	case 'H', 'V':
+		return 1
+	case 'M', 'L', 'T':
+		return 2
+	case 'S', 'Q':
+		return 4
+	case 'C':
+		return 6
+	case 'A':
+		return 7
+	}
+	return 0
+}
+
+// cubic returns points along the cubic Bézier curve from p0 to p3, excluding p0. The distance from a curve to the
+// edges of n even steps is at most 3/4 of the largest second difference of its points divided by n squared.
+func cubic(p0, p1, p2, p3 point, tolerance float64) []point {
+	dd := math.Max(math.Hypot(p0.X-2*p1.X+p2.X, p0.Y-2*p1.Y+p2.Y), math.Hypot(p1.X-2*p2.X+p3.X, p1.Y-2*p2.Y+p3.Y))
+	n := steps(math.Sqrt(0.75 * dd / tolerance))
+	result := make([]point, 0, n)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+		result = append(result, point{a*p0.X + b*p1.X + c*p2.X + d*p3.X, a*p0.Y + b*p1.Y + c*p2.Y + d*p3.Y})
+	}
+	return result
+}
+
+// quadratic returns points along the quadratic Bézier curve from p0 to p2, excluding p0.
+func quadratic(p0, p1, p2 point, tolerance float64) []point {
+	dd := math.Hypot(p0.X-2*p1.X+p2.X, p0.Y-2*p1.Y+p2.Y)
+	n := steps(math.Sqrt(dd / (4 * tolerance)))
+	result := make([]point, 0, n)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		a, b, c := u*u, 2*u*t, t*t
+		result = append(result, point{a*p0.X + b*p1.X + c*p2.X, a*p0.Y + b*p1.Y + c*p2.Y})
+	}
+	return result
+}
+
+// steps rounds n up to a whole number of steps, at least one and at most 1024.
+func steps(n float64) int {
+	if !(n >= 1) {
+		return 1
+	}
+	if n > 1024 {
+		return 1024
+	}
+	return int(math.Ceil(n))
+}
+
+// endpointArc returns points along an arc as path data describes it, from p0 to p1 on an ellipse with radii rx and ry
+// rotated by phi degrees, excluding p0. It follows the conversion to a centre and angles in the SVG specification,
+// scaling up radii too small to reach p1.
+func endpointArc(p0 point, rx, ry, phi float64, large, sweep bool, p1 point, tolerance float64) []point {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if p0 == p1 {
+		return nil
+	}
+	if rx == 0 || ry == 0 {
+		return []point{p1}
+	}
+	sin, cos := math.Sincos(phi * math.Pi / 180)
+	dx, dy := (p0.X-p1.X)/2, (p0.Y-p1.Y)/2
+	x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	k := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		k = -k
+	}
+	cx1, cy1 := k*rx*y1/ry, -k*ry*x1/rx
+	center := point{cos*cx1 - sin*cy1 + (p0.X+p1.X)/2, sin*cx1 + cos*cy1 + (p0.Y+p1.Y)/2}
+	theta := math.Atan2((y1-cy1)/ry, (x1-cx1)/rx)
+	delta := math.Atan2((-y1-cy1)/ry, (-x1-cx1)/rx) - theta
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+	points := arc(center, rx, ry, phi, theta, delta, tolerance)
+	points[len(points)-1] = p1
+	return points[1:]
+}
+
+// arc returns points along an ellipse around c with radii rx and ry rotated by phi degrees, from the angle start
+// through sweep radians, including both ends.
+func arc(c point, rx, ry, phi, start, sweep, tolerance float64) []point {
+	// The sagitta of a chord spanning step radians of a circle of radius r is r * (1 - cos(step/2)).
+	step := 2 * math.Acos(math.Max(-1, 1-tolerance/math.Max(rx, ry)))
+	n := steps(math.Abs(sweep) / step)
+	sin, cos := math.Sincos(phi * math.Pi / 180)
+	points := make([]point, 0, n+1)
+	for i := 0; i <= n; i++ {
+		s, c0 := math.Sincos(start + sweep*float64(i)/float64(n))
+		x, y := rx*c0, ry*s
+		points = append(points, point{c.X + cos*x - sin*y, c.Y + sin*x + cos*y})
+	}
+	return points
+}
+
+// scanner reads the numbers, flags and commands of path data and number lists.
+type scanner struct {
+	s string
+	i int
+}
+
+func (sc *scanner) done() bool {
+	return sc.i >= len(sc.s)
+}
+
+// skip moves past whitespace and a comma.
+func (sc *scanner) skip() {
+	comma := false
+	for ; sc.i < len(sc.s); sc.i++ {
+		switch c := sc.s[sc.i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f':
+		case c == ',' && !comma:
+			comma = true
+		default:
+			return
+		}
+	}
+}
+
+// command returns the next byte if it is a letter, moving past it.
+func (sc *scanner) command() (byte, bool) {
+	if sc.done() {
+		return 0, false
+	}
+	c := sc.s[sc.i]
+	switch c &^ 0x20 {
+	case 'M', 'L', 'H', 'V', 'C', 'S', 'Q', 'T', 'A', 'Z':
+		sc.i++
+		return c, true
+	}
+	return 0, false
+}
+
+// number reads a number, which ends at anything which can't continue it, so "1-2.5.5" is 1, -2.5 and .5.
+func (sc *scanner) number() (float64, error) {
+	begin := sc.i
+	i := sc.i
+	if i < len(sc.s) && (sc.s[i] == '+' || sc.s[i] == '-') {
+		i++
+	}
+	digits := 0
+	for ; i < len(sc.s) && sc.s[i] >= '0' && sc.s[i] <= '9'; i++ {
+		digits++
+	}
+	if i < len(sc.s) && sc.s[i] == '.' {
+		for i++; i < len(sc.s) && sc.s[i] >= '0' && sc.s[i] <= '9'; i++ {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return 0, fmt.Errorf("expected a number at %q", sc.s[begin:])
+	}
+	if i < len(sc.s) && (sc.s[i] == 'e' || sc.s[i] == 'E') {
+		j := i + 1
+		if j < len(sc.s) && (sc.s[j] == '+' || sc.s[j] == '-') {
+			j++
+		}
+		if j < len(sc.s) && sc.s[j] >= '0' && sc.s[j] <= '9' {
+			for i = j; i < len(sc.s) && sc.s[i] >= '0' && sc.s[i] <= '9'; i++ {
+			}
+		}
+	}
+	sc.i = i
+	return strconv.ParseFloat(sc.s[begin:i], 64)
+}
+
+// flag reads an arc flag, a single 0 or 1 which needn't be separated from what follows.
+func (sc *scanner) flag() (float64, error) {
+	if !sc.done() && (sc.s[sc.i] == '0' || sc.s[sc.i] == '1') {
+		sc.i++
+		return float64(sc.s[sc.i-1] - '0'), nil
+	}
+	return 0, fmt.Errorf("expected a flag at %q", sc.s[sc.i:])
+}
@@ -0,0 +1,419 @@
+// Package svg reads the shapes of SVG documents into space maps, and draws space maps as SVG for debugging.
+package svg
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/arran4/spacemap"
+	"github.com/arran4/spacemap/shared"
+)
+
+// Read adds the rect, circle, ellipse, polygon and path elements of the SVG document r to m and returns the shapes
+// added, in document order. Each shape's z-index is its position in that order, so shapes painted later are above, and
+// it is named after the element's id.
+//
+// Coordinates are in the document's user units, rounded to whole pixels, after applying the transform attributes of
+// the element and the groups around it. A rect, circle or ellipse which is only moved, scaled or turned by right
+// angles stays a Rectangle, Circle or Ellipse, otherwise it becomes a Polygon. Curves and arcs in paths are flattened
+// into straight edges. Elements which aren't drawn, those in defs, symbol, clipPath, mask, pattern and marker, are
+// skipped.
+//
+// Lengths can be in px, in, cm, mm, pt or pc, or percentages of the viewBox of the svg element around them, or of
+// its width and height when it has no viewBox. Elements sized in units which depend on the font or the window, such
+// as em or vw, can't be placed, so they are skipped and once the rest of the document has been read they are
+// reported with a *SkippedError.
+func Read(r io.Reader, m spacemap.Interface) ([]shared.Shape, error) {
+	d := xml.NewDecoder(r)
+	// transforms holds the transform of each open element, including those of its ancestors, and viewports holds the
+	// size of the svg element around each, zero when it isn't known.
+	transforms := []matrix{identity}
+	viewports := []point{{}}
+	hidden := 0
+	var shapes []shared.Shape
+	var skipped []string
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			if skipped != nil {
+				return shapes, &SkippedError{Elements: skipped}
+			}
+			return shapes, nil
+		}
+		if err != nil {
+			return shapes, fmt.Errorf("svg: %w", err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			tm := transforms[len(transforms)-1]
+			if s := attr(t, "transform"); s != "" {
+				et, err := parseTransform(s)
+				if err != nil {
+					return shapes, fmt.Errorf("svg: %s element: %w", t.Name.Local, err)
+				}
+				tm = tm.mul(et)
+			}
+			transforms = append(transforms, tm)
+			viewport := viewports[len(viewports)-1]
+			if t.Name.Local == "svg" {
+				viewport = viewportOf(t, viewport)
+			}
+			viewports = append(viewports, viewport)
+			switch t.Name.Local {
+			case "defs", "symbol", "clipPath", "mask", "pattern", "marker":
+				hidden++
+				continue
+			}
+			if hidden > 0 {
+				continue
+			}
+			shape, err := elementShape(t, tm, viewport)
+			if errors.Is(err, errUnsized) {
+				skipped = append(skipped, fmt.Sprintf("%s element %q", t.Name.Local, attr(t, "id")))
+				continue
+			}
+			if err != nil {
+				return shapes, fmt.Errorf("svg: %s element %q: %w", t.Name.Local, attr(t, "id"), err)
+			}
+			if shape != nil {
+				m.Add(shape, len(shapes))
+				shapes = append(shapes, shape)
+			}
+		case xml.EndElement:
+			transforms = transforms[:len(transforms)-1]
+			viewports = viewports[:len(viewports)-1]
+			switch t.Name.Local {
+			case "defs", "symbol", "clipPath", "mask", "pattern", "marker":
+				hidden--
+			}
+		}
+	}
+}
+
+// SkippedError is returned by Read, along with the shapes it could read, when it skipped elements sized in units it
+// can't convert into pixels.
+type SkippedError struct {
+	// Elements describes each element skipped, in document order.
+	Elements []string
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("svg: skipped %d elements sized in relative units: %s", len(e.Elements), strings.Join(e.Elements, ", "))
+}
+
+// errUnsized is returned by parseLength for lengths it can't convert into user units.
+var errUnsized = errors.New("length depends on the font or window")
+
+// units holds the user units, or pixels, in each absolute unit of length.
+var units = map[string]float64{"": 1, "px": 1, "in": 96, "cm": 96 / 2.54, "mm": 96 / 25.4, "pt": 4.0 / 3, "pc": 16}
+
+// relativeUnits holds the units of length which depend on the font or window.
+var relativeUnits = map[string]bool{"em": true, "ex": true, "ch": true, "rem": true, "vw": true, "vh": true, "vmin": true, "vmax": true}
+
+// parseLength converts the length s into user units, resolving a percentage against reference, which is zero when it
+// isn't known.
+func parseLength(s string, reference float64) (float64, error) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 && (s[i-1] == '%' || 'a' <= s[i-1] && s[i-1] <= 'z' || 'A' <= s[i-1] && s[i-1] <= 'Z') {
+		i--
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a length", s)
+	}
+	unit := strings.ToLower(s[i:])
+	switch {
+	case unit == "%" && reference > 0:
+		return v * reference / 100, nil
+	case unit == "%" || relativeUnits[unit]:
+		return 0, errUnsized
+	}
+	scale, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("%q is not a length", s)
+	}
+	return v * scale, nil
+}
+
+// viewportOf returns the size in user units of the svg element e inside a viewport of size parent: its viewBox, or
+// failing that its width and height.
+func viewportOf(e xml.StartElement, parent point) point {
+	if box, err := parseNumbers(attr(e, "viewBox")); err == nil && len(box) == 4 && box[2] > 0 && box[3] > 0 {
+		return point{box[2], box[3]}
+	}
+	// A missing or unusable width or height is 100%, the same as the parent's.
+	size := parent
+	if w, err := parseLength(attr(e, "width"), parent.X); err == nil && w > 0 {
+		size.X = w
+	}
+	if h, err := parseLength(attr(e, "height"), parent.Y); err == nil && h > 0 {
+		size.Y = h
+	}
+	return size
+}
+
+// attr returns the value of the attribute of e called name.
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// style returns a presentation attribute of e, which the style attribute overrides.
+func style(e xml.StartElement, name string) string {
+	value := attr(e, name)
+	for _, decl := range strings.Split(attr(e, "style"), ";") {
+		if k, v, ok := strings.Cut(decl, ":"); ok && strings.TrimSpace(k) == name {
+			value = strings.TrimSpace(v)
+		}
+	}
+	return value
+}
+
+// elementShape returns the shape drawn by e with the transform tm inside a viewport of size viewport, or nil when e
+// doesn't draw one. The error wraps errUnsized when e is sized in units which can't be converted into user units.
+func elementShape(e xml.StartElement, tm matrix, viewport point) (shared.Shape, error) {
+	name := shared.Name(attr(e, "id"))
+	// Curves are flattened before they are transformed, so their tolerance is scaled down by as much as tm scales up.
+	tolerance := flatness
+	if scale := tm.scale(); scale > 0 {
+		tolerance /= scale
+	}
+	fillRule := shared.NonZero
+	if style(e, "fill-rule") == "evenodd" {
+		fillRule = shared.EvenOdd
+	}
+	lengths := func(names ...string) ([]float64, error) {
+		values := make([]float64, len(names))
+		for i, n := range names {
+			s := attr(e, n)
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			// Percentages of horizontal lengths are of the viewport's width, vertical ones of its height and others,
+			// like a radius, of its diagonal divided by the square root of two.
+			reference := math.Sqrt((viewport.X*viewport.X + viewport.Y*viewport.Y) / 2)
+			switch n {
+			case "x", "width", "cx", "rx":
+				reference = viewport.X
+			case "y", "height", "cy", "ry":
+				reference = viewport.Y
+			}
+			v, err := parseLength(s, reference)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", n, err)
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+	switch e.Name.Local {
+	case "rect":
+		v, err := lengths("x", "y", "width", "height")
+		if err != nil || v[2] <= 0 || v[3] <= 0 {
+			return nil, err
+		}
+		corners := []point{{v[0], v[1]}, {v[0] + v[2], v[1]}, {v[0] + v[2], v[1] + v[3]}, {v[0], v[1] + v[3]}}
+		if tm.keepsAxes() {
+			p0, p1 := tm.apply(corners[0]).round(), tm.apply(corners[2]).round()
+			r := shared.NewRectangle(p0.X, p0.Y, p1.X, p1.Y, name)
+			r.Rectangle = r.Canon()
+			return r, nil
+		}
+		return polygon(tm, [][]point{corners}, shared.NonZero, name), nil
+	case "circle", "ellipse":
+		var v []float64
+		var err error
+		if e.Name.Local == "circle" {
+			v, err = lengths("cx", "cy", "r", "r")
+		} else {
+			v, err = lengths("cx", "cy", "rx", "ry")
+		}
+		if err != nil || v[2] <= 0 || v[3] <= 0 {
+			return nil, err
+		}
+		center := point{v[0], v[1]}
+		if tm.keepsAxes() {
+			// One of each pair of terms is zero, depending on whether tm swaps the axes.
+			c := tm.apply(center).round()
+			rx := int(math.Round(math.Abs(v[2]*tm[0]) + math.Abs(v[3]*tm[2])))
+			ry := int(math.Round(math.Abs(v[2]*tm[1]) + math.Abs(v[3]*tm[3])))
+			if rx == ry {
+				return shared.NewCircle(c.X, c.Y, rx, name), nil
+			}
+			return shared.NewEllipse(c.X, c.Y, rx, ry, name), nil
+		}
+		outline := arc(center, v[2], v[3], 0, 0, 2*math.Pi, tolerance)
+		return polygon(tm, [][]point{outline[:len(outline)-1]}, shared.NonZero, name), nil
+	case "polygon":
+		coords, err := parseNumbers(attr(e, "points"))
+		if err != nil {
+			return nil, err
+		}
+		ring := make([]point, 0, len(coords)/2)
+		for i := 0; i+1 < len(coords); i += 2 {
+			ring = append(ring, point{coords[i], coords[i+1]})
+		}
+		return polygon(tm, [][]point{ring}, fillRule, name), nil
+	case "path":
+		rings, err := parsePath(attr(e, "d"), tolerance)
+		if err != nil {
+			return nil, err
+		}
+		return polygon(tm, rings, fillRule, name), nil
+	}
+	return nil, nil
+}
+
+// polygon transforms rings into a Polygon, dropping rings with fewer than three points. It returns nil when none
+// are left.
+func polygon(tm matrix, rings [][]point, fillRule shared.FillRule, name shared.Name) shared.Shape {
+	ops := []shared.Op{fillRule, name}
+	var outline []image.Point
+	for _, ring := range rings {
+		if len(ring) < 3 {
+			continue
+		}
+		r := make(shared.Ring, len(ring))
+		for i, p := range ring {
+			r[i] = tm.apply(p).round()
+		}
+		if outline == nil {
+			outline = r
+		} else {
+			ops = append(ops, r)
+		}
+	}
+	if outline == nil {
+		return nil
+	}
+	return shared.NewPolygon(outline, ops...)
+}
+
+type point struct {
+	X, Y float64
+}
+
+func (p point) round() image.Point {
+	return image.Pt(int(math.Round(p.X)), int(math.Round(p.Y)))
+}
+
+// matrix is an affine transform as SVG writes it, matrix(a b c d e f) maps x, y to a*x + c*y + e, b*x + d*y + f.
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform applying n then m.
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m matrix) apply(p point) point {
+	return point{m[0]*p.X + m[2]*p.Y + m[4], m[1]*p.X + m[3]*p.Y + m[5]}
+}
+
+// keepsAxes reports if m only moves, scales and turns by right angles, so rectangles and ellipses stay axis aligned.
+func (m matrix) keepsAxes() bool {
+	return m[1] == 0 && m[2] == 0 || m[0] == 0 && m[3] == 0
+}
+
+// scale returns the most m stretches any line.
+func (m matrix) scale() float64 {
+	return math.Max(math.Hypot(m[0], m[1]), math.Hypot(m[2], m[3]))
+}
+
+// parseTransform parses a transform attribute, a list of matrix, translate, scale, rotate, skewX and skewY functions
+// which apply right to left.
+func parseTransform(s string) (matrix, error) {
+	result := identity
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " \t\r\n,") {
+		open := strings.IndexByte(s, '(')
+		end := strings.IndexByte(s, ')')
+		if open < 0 || end < open {
+			return result, fmt.Errorf("bad transform %q", s)
+		}
+		name := strings.TrimSpace(s[:open])
+		args, err := parseNumbers(s[open+1 : end])
+		if err != nil {
+			return result, err
+		}
+		s = s[end+1:]
+		arg := func(i int, otherwise float64) float64 {
+			if i < len(args) {
+				return args[i]
+			}
+			return otherwise
+		}
+		var t matrix
+		switch {
+		case name == "matrix" && len(args) == 6:
+			copy(t[:], args)
+		case name == "translate" && (len(args) == 1 || len(args) == 2):
+			t = matrix{1, 0, 0, 1, args[0], arg(1, 0)}
+		case name == "scale" && (len(args) == 1 || len(args) == 2):
+			t = matrix{args[0], 0, 0, arg(1, args[0]), 0, 0}
+		case name == "rotate" && (len(args) == 1 || len(args) == 3):
+			t = rotation(args[0])
+			if len(args) == 3 {
+				t = matrix{1, 0, 0, 1, args[1], args[2]}.mul(t).mul(matrix{1, 0, 0, 1, -args[1], -args[2]})
+			}
+		case name == "skewX" && len(args) == 1:
+			t = matrix{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}
+		case name == "skewY" && len(args) == 1:
+			t = matrix{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return result, fmt.Errorf("bad transform %s with %d arguments", name, len(args))
+		}
+		result = result.mul(t)
+	}
+	return result, nil
+}
+
+// rotation returns a rotation by degrees, which are exact for multiples of 90 so rectangles stay rectangles.
+func rotation(degrees float64) matrix {
+	var sin, cos float64
+	switch math.Mod(degrees, 360) {
+	case 0:
+		sin, cos = 0, 1
+	case 90, -270:
+		sin, cos = 1, 0
+	case 180, -180:
+		sin, cos = 0, -1
+	case 270, -90:
+		sin, cos = -1, 0
+	default:
+		sin, cos = math.Sincos(degrees * math.Pi / 180)
+	}
+	return matrix{cos, sin, -sin, cos, 0, 0}
+}
+
+// parseNumbers parses a list of numbers separated by whitespace or commas.
+func parseNumbers(s string) ([]float64, error) {
+	var numbers []float64
+	sc := scanner{s: s}
+	for sc.skip(); !sc.done(); sc.skip() {
+		n, err := sc.number()
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
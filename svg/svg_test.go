@@ -0,0 +1,199 @@
+package svg
+
+import (
+	"errors"
+	"image"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/arran4/spacemap/shared"
+	"github.com/arran4/spacemap/simplearray"
+	"github.com/google/go-cmp/cmp"
+)
+
+const document = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="200" height="200">
+  <defs>
+    <rect id="template" x="0" y="0" width="500" height="500"/>
+  </defs>
+  <rect id="background" x="0" y="0" width="200px" height="200"/>
+  <g transform="translate(100, 0)">
+    <circle id="sun" cx="20" cy="20" r="10"/>
+    <ellipse id="stretched" cx="10" cy="10" rx="5" ry="5" transform="scale(4, 2)"/>
+    <rect id="turned" x="0" y="0" width="10" height="20" transform="translate(60 60) rotate(90)"/>
+  </g>
+  <rect id="diamond" x="-10" y="-10" width="20" height="20" transform="translate(50,50) rotate(45)"/>
+  <polygon id="triangle" points="0,100 40,100 0,140" style="fill: red; fill-rule: evenodd"/>
+  <path id="frame" fill-rule="evenodd" d="M100 100 h60 v60 h-60 z m10 10 h40 v40 h-40 z"/>
+</svg>`
+
+func TestRead(t *testing.T) {
+	m := simplearray.New()
+	shapes, err := Read(strings.NewReader(document), m)
+	if err != nil {
+		t.Fatalf("Read() error %v", err)
+	}
+	var names []string
+	for _, s := range shapes {
+		names = append(names, s.String())
+	}
+	want := []string{
+		"background:Rect((0,0)->(200,200))",
+		"sun:Circle((120,20), r:10)",
+		"stretched:Ellipse((140,20), r:(20,10))",
+		"turned:Rect((140,60)->(160,70))",
+		"diamond:Polygon([(50,36) (64,50) (50,64) (36,50)])",
+		"triangle:Polygon([(0,100) (40,100) (0,140)])",
+		"frame:Polygon([(100,100) (160,100) (160,160) (100,160)], [(110,110) (150,110) (150,150) (110,150)])",
+	}
+	if diff := cmp.Diff(names, want); diff != "" {
+		t.Errorf("Read() = \n%s", diff)
+	}
+	if got := shapes[5].(*shared.Polygon).FillRule; got != shared.EvenOdd {
+		t.Errorf("triangle FillRule = %s want EvenOdd", got)
+	}
+	for _, test := range []struct {
+		X, Y int
+		Want string
+	}{
+		{X: 112, Y: 20, Want: "sun"},
+		{X: 50, Y: 50, Want: "diamond"},
+		{X: 105, Y: 105, Want: "frame"},
+		{X: 130, Y: 130, Want: "background"},
+		{X: 400, Y: 400, Want: ""},
+	} {
+		got := ""
+		if s := m.GetAt(test.X, test.Y); s != nil {
+			got = strings.Split(s.String(), ":")[0]
+		}
+		if got != test.Want {
+			t.Errorf("GetAt(%d, %d) = %s want %s", test.X, test.Y, got, test.Want)
+		}
+	}
+}
+
+func TestRead_Curves(t *testing.T) {
+	for _, test := range []struct {
+		Name string
+		Doc  string
+	}{
+		{Name: "Arcs", Doc: `<svg><path d="M40 50 A10 10 0 0 1 60 50 a10 10 0 0 1-20 0z"/></svg>`},
+		{Name: "Small arc radii", Doc: `<svg><path d="M40 50 A1 1 0 1 1 60 50 A1 1 0 1 1 40 50Z"/></svg>`},
+		{Name: "Cubic", Doc: `<svg><path d="M60,50 C60,55.523 55.523,60 50,60 S40,55.523 40,50 S44.477,40 50,40 S60,44.477 60,50"/></svg>`},
+		{Name: "Rotated circle", Doc: `<svg><circle cx="0" cy="0" r="10" transform="translate(50 50) rotate(30)"/></svg>`},
+		{Name: "Scaled quadratic", Doc: `<svg><path transform="scale(10)" d="M5,4 Q6,4 6,5 T5,6 T4,5 T5,4"/></svg>`},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			shapes, err := Read(strings.NewReader(test.Doc), simplearray.New())
+			if err != nil {
+				t.Fatalf("Read() error %v", err)
+			}
+			if len(shapes) != 1 {
+				t.Fatalf("Read() = %d shapes want 1", len(shapes))
+			}
+			// The curves are all close to a circle of radius 10 around 50, 50. The quadratic curves are furthest from
+			// it, bulging out to 10.6 between the points they join.
+			for y := 35; y < 65; y++ {
+				for x := 35; x < 65; x++ {
+					d := math.Hypot(float64(x)+0.5-50, float64(y)+0.5-50)
+					if in := shapes[0].PointIn(x, y); d < 9.2 && !in || d > 11 && in {
+						t.Errorf("PointIn(%d, %d) = %v at %.2f from the centre", x, y, in, d)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRead_Units(t *testing.T) {
+	const doc = `<svg xmlns="http://www.w3.org/2000/svg" width="600" height="300" viewBox="0 0 200 100">
+  <rect id="background" width="100%" height="100%"/>
+  <rect id="label" x="10" y="10" width="8em" height="2em"/>
+  <rect id="inch" x="1in" y="1cm" width="10mm" height="6pt"/>
+  <circle id="dot" cx="50%" cy="50%" r="10%"/>
+  <svg width="50" height="20">
+    <rect id="nested" width="50%" height="50%"/>
+  </svg>
+  <ellipse id="wide" cx="10" cy="10" rx="10vw" ry="5"/>
+</svg>`
+	m := simplearray.New()
+	shapes, err := Read(strings.NewReader(doc), m)
+	var skipped *SkippedError
+	if !errors.As(err, &skipped) {
+		t.Fatalf("Read() error %v want a *SkippedError", err)
+	}
+	if diff := cmp.Diff(skipped.Elements, []string{`rect element "label"`, `ellipse element "wide"`}); diff != "" {
+		t.Errorf("SkippedError.Elements = \n%s", diff)
+	}
+	var names []string
+	for _, s := range shapes {
+		names = append(names, s.String())
+	}
+	want := []string{
+		"background:Rect((0,0)->(200,100))",
+		"inch:Rect((96,38)->(134,46))",
+		"dot:Circle((100,50), r:16)",
+		"nested:Rect((0,0)->(25,10))",
+	}
+	if diff := cmp.Diff(names, want); diff != "" {
+		t.Errorf("Read() = \n%s", diff)
+	}
+	if s := m.GetAt(150, 90); s == nil || !strings.HasPrefix(s.String(), "background:") {
+		t.Errorf("GetAt(150, 90) = %v want background", s)
+	}
+}
+
+func TestRead_Errors(t *testing.T) {
+	for _, doc := range []string{
+		`<svg><path d="M0 0 L10"/></svg>`,
+		`<svg><path d="10 10"/></svg>`,
+		`<svg><path d="M0 0 A1 1 0 2 1 5 5"/></svg>`,
+		`<svg><rect width="ten" height="10"/></svg>`,
+		`<svg><rect width="10furlongs" height="10"/></svg>`,
+		`<svg><g transform="spin(10)"><rect width="10" height="10"/></g></svg>`,
+		`<svg><rect width="10" height="10" transform="translate(1, 2, 3)"/></svg>`,
+		`<svg><rect width="10" height="10">`,
+	} {
+		if _, err := Read(strings.NewReader(doc), simplearray.New()); err == nil {
+			t.Errorf("Read(%s) gave no error", doc)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	rings, err := parsePath("M1-2.5.5 3e1,4 1 L1 1zl2 2 3 3", 1)
+	if err != nil {
+		t.Fatalf("parsePath() error %v", err)
+	}
+	want := [][]point{
+		{{1, -2.5}, {0.5, 3e1}, {4, 1}, {1, 1}},
+		{{1, -2.5}, {3, -0.5}, {6, 2.5}},
+	}
+	if diff := cmp.Diff(rings, want); diff != "" {
+		t.Errorf("parsePath() = \n%s", diff)
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	for _, test := range []struct {
+		Transform string
+		From, To  image.Point
+	}{
+		{Transform: "translate(10)", From: image.Pt(1, 2), To: image.Pt(11, 2)},
+		{Transform: "scale(2) translate(10, 5)", From: image.Pt(1, 2), To: image.Pt(22, 14)},
+		{Transform: "rotate(90, 10, 10)", From: image.Pt(20, 10), To: image.Pt(10, 20)},
+		{Transform: "matrix(1 0 0 1 5 6)", From: image.Pt(1, 2), To: image.Pt(6, 8)},
+		{Transform: "skewX(45)", From: image.Pt(0, 10), To: image.Pt(10, 10)},
+		{Transform: "skewY(45)", From: image.Pt(10, 0), To: image.Pt(10, 10)},
+	} {
+		m, err := parseTransform(test.Transform)
+		if err != nil {
+			t.Errorf("parseTransform(%q) error %v", test.Transform, err)
+			continue
+		}
+		if got := m.apply(point{float64(test.From.X), float64(test.From.Y)}).round(); got != test.To {
+			t.Errorf("parseTransform(%q) maps %v to %v want %v", test.Transform, test.From, got, test.To)
+		}
+	}
+}